@@ -7,14 +7,38 @@ import (
 	"gufeijun/hustgen/parse"
 	"io"
 	"path"
+	"sort"
 	"strings"
 	"text/template"
 )
 
 var infos *parse.Symbols
 
+// 当前文件以及导入的文件中定义的所有message和enum。
+// 结构体定义来自导入文件的头文件，但序列化等static函数需要在本文件中生成
+var allMessages map[string]*parse.Message
+var allEnums map[string]*parse.Enum
+
+// 所有用到的list和map类型，每种容器类型都会生成一个对应的结构体
+var containers []*parse.Type
+
+// 导入的文件中已经定义过结构体的容器类型
+var importedContainers map[string]bool
+
 func Gen(_infos *parse.Symbols, conf *config.ComplileConfig) error {
 	infos = _infos
+	if err := checkMessageStreams(); err != nil {
+		return err
+	}
+	if err := checkMethodOptions(); err != nil {
+		return err
+	}
+	prefix = cPrefix(infos.Package)
+	allMessages = infos.AllMessages()
+	allEnums = infos.AllEnums()
+	containers = collectContainers(infos)
+	importedContainers = make(map[string]bool)
+	collectImportedContainers(infos)
 	if err := genServerHeaderFile(conf); err != nil {
 		return err
 	}
@@ -27,11 +51,54 @@ func Gen(_infos *parse.Symbols, conf *config.ComplileConfig) error {
 	return genClientSourceFile(conf)
 }
 
+// C暂不支持消息流，使用了stream<Msg>的服务不生成代码
+func checkMessageStreams() error {
+	var err error
+	utils.TraverseMethod(infos, func(method *parse.Method) bool {
+		for _, t := range append(method.ReqTypes, method.RetType) {
+			if t.Kind == parse.TypeKindStream {
+				err = fmt.Errorf("c does not support message stream: method %s of service %s uses %s",
+					method.Name, method.Service.Name, t.Name)
+				return true
+			}
+		}
+		return false
+	})
+	return err
+}
+
+// rpch-c的客户端只能同步调用，没有异步发送以及超时的接口，C不支持oneway以及超时
+func checkMethodOptions() error {
+	var err error
+	utils.TraverseMethod(infos, func(method *parse.Method) bool {
+		if method.Oneway {
+			err = fmt.Errorf("c does not support oneway: method %s of service %s is oneway",
+				method.Name, method.Service.Name)
+			return true
+		}
+		if d := method.Timeout(); d != 0 {
+			err = fmt.Errorf("c does not support timeout: method %s of service %s has timeout %s",
+				method.Name, method.Service.Name, d)
+			return true
+		}
+		return false
+	})
+	return err
+}
+
 func genDef(w io.Writer, srcIDL string, side string) {
+	// 只使用文件名，且宏名中只能包含字母、数字和下划线
+	srcIDL = path.Base(srcIDL)
 	index := strings.Index(srcIDL, ".")
 	if index != -1 {
 		srcIDL = srcIDL[:index]
 	}
+	srcIDL = strings.Map(func(r rune) rune {
+		if r >= 'a' && r <= 'z' || r >= 'A' && r <= 'Z' || r >= '0' && r <= '9' {
+			return r
+		}
+		return '_'
+	}, srcIDL)
 	macro := fmt.Sprintf("__%s_RPCH_%s_H_", srcIDL, side)
 	fmt.Fprintf(w, "#ifndef %s\n", macro)
 	fmt.Fprintf(w, "#define %s\n\n", macro)
@@ -45,12 +112,18 @@ func genServerHeaderFile(conf *config.ComplileConfig) error {
 	defer hte.Close()
 	genStatement(hte)
 	genDef(hte.W, conf.SrcIDL, "SERVER")
-	genHeaderFileIncludes(hte, []string{`<stdint.h>`, `"error.h"`, `"server.h"`})
+	genHeaderFileIncludes(hte, append([]string{`<stdbool.h>`, `<stdint.h>`, `"error.h"`, `"server.h"`}, importHeaders(".rpch.server.h")...))
+	genBytesStruct(hte)
+	genTimeStruct(hte)
+	genEnums(hte)
+	genTypedefs(hte)
+	genConsts(hte)
 	genStructs(hte)
 	genStructCreate(hte)
+	genErrorDecls(hte, true)
 	genStructCloneH(hte)
 	genServiceMethod(hte)
-	fmt.Fprint(hte.W, "#endif")
+	fmt.Fprint(hte.W, "\n#endif")
 	return hte.Err
 }
 
@@ -62,9 +135,15 @@ func genClientHeaderFile(conf *config.ComplileConfig) error {
 	defer cte.Close()
 	genStatement(cte)
 	genDef(cte.W, conf.SrcIDL, "CLIENT")
-	genHeaderFileIncludes(cte, []string{`<stdint.h>`, `"client.h"`})
+	genHeaderFileIncludes(cte, append([]string{`<stdbool.h>`, `<stdint.h>`, `"client.h"`}, importHeaders(".rpch.client.h")...))
+	genBytesStruct(cte)
+	genTimeStruct(cte)
+	genEnums(cte)
+	genTypedefs(cte)
+	genConsts(cte)
 	genStructs(cte)
 	genStructDelete(cte)
+	genErrorDecls(cte, false)
 	genClientMethod(cte)
 	fmt.Fprint(cte.W, "\n#endif")
 	return cte.Err
@@ -77,12 +156,21 @@ func genServerSourceFile(conf *config.ComplileConfig) error {
 	}
 	defer cte.Close()
 	genStatement(cte)
-	genSourceFileIncludes(cte, []string{"stdint.h", "stdlib.h", "string.h"}, []string{"argument.h", "cJSON.h", "error.h", "request.h", "server.h"}, "server")
+	stdlib := []string{"stdint.h", "stdio.h", "stdlib.h", "string.h"}
+	if len(infos.Services) != 0 && usePattern() {
+		stdlib = append(stdlib, "regex.h")
+	}
+	genSourceFileIncludes(cte, stdlib, []string{"argument.h", "cJSON.h", "error.h", "request.h", "server.h"}, "server")
+	genEnumValid(cte)
+	genBytesFuncs(cte)
+	genTimeFuncs(cte)
 	genArgumentInitAndDestroy(cte, true)
 	genStructCloneC(cte)
 	genErrorMacro(cte, "return")
 	genMashalFunc(cte, true)
 	genUnmarshalFunc(cte)
+	genValidateFuncs(cte)
+	genErrorFuncs(cte, errorThrowTmpl)
 	genHandlers(cte)
 	genRegisterService(cte)
 	return cte.Err
@@ -95,58 +183,290 @@ func genClientSourceFile(conf *config.ComplileConfig) error {
 	}
 	defer cte.Close()
 	genStatement(cte)
-	genSourceFileIncludes(cte, []string{"stdint.h", "string.h", "stdlib.h"}, []string{"argument.h", "cJSON.h", "error.h", "client.h"}, "client")
+	genSourceFileIncludes(cte, []string{"stdint.h", "stdio.h", "string.h", "stdlib.h"}, []string{"argument.h", "cJSON.h", "error.h", "client.h"}, "client")
+	genEnumValid(cte)
+	genBytesFuncs(cte)
+	genTimeFuncs(cte)
 	genArgumentInitAndDestroy(cte, false)
 	genErrorMacro(cte, "goto end")
 	genMashalFunc(cte, false)
 	genUnmarshalFunc(cte)
+	genErrorFuncs(cte, errorCatchTmpl)
 	genCallFuncs(cte)
 	return cte.Err
 }
 
+// 导入的文件生成的头文件
+func importHeaders(suffix string) []string {
+	var headers []string
+	for _, imp := range infos.Imports {
+		headers = append(headers, fmt.Sprintf(`"%s"`, path.Base(utils.GenFilePath(imp.File, "", suffix))))
+	}
+	return headers
+}
+
+func isImportedMessage(msg *parse.Message) bool {
+	return infos.Messages[msg.Name] != msg
+}
+
+func collectImportedContainers(syms *parse.Symbols) {
+	for _, imp := range syms.Imports {
+		for _, t := range collectContainers(imp.Infos) {
+			importedContainers[cTypeName(t)] = true
+		}
+		collectImportedContainers(imp.Infos)
+	}
+}
+
+func collectContainers(infos *parse.Symbols) []*parse.Type {
+	m := make(map[string]*parse.Type)
+	var collect func(t *parse.Type)
+	collect = func(t *parse.Type) {
+		for ; isContainer(t); t = t.Elem {
+			m[cTypeName(t)] = t
+		}
+	}
+	for _, msg := range infos.AllMessages() {
+		for _, mem := range msg.Mems {
+			collect(mem.Type)
+		}
+	}
+	utils.TraverseMethod(infos, func(method *parse.Method) bool {
+		for _, t := range append(method.ReqTypes, method.RetType) {
+			collect(t)
+		}
+		return false
+	})
+	res := make([]*parse.Type, 0, len(m))
+	for _, t := range m {
+		res = append(res, t)
+	}
+	sort.Slice(res, func(i, j int) bool {
+		return cTypeName(res[i]) < cTypeName(res[j])
+	})
+	return res
+}
+
+// IDL中是否使用了bytes类型
+func useBytes() bool {
+	var use bool
+	check := func(t *parse.Type) {
+		for ; isContainer(t); t = t.Elem {
+		}
+		use = use || t.Name == "bytes"
+	}
+	for _, msg := range allMessages {
+		for _, mem := range msg.Mems {
+			check(mem.Type)
+		}
+	}
+	utils.TraverseMethod(infos, func(method *parse.Method) bool {
+		for _, t := range append(method.ReqTypes, method.RetType) {
+			check(t)
+		}
+		return use
+	})
+	return use
+}
+
+func genBytesStruct(te *utils.TmplExec) {
+	if useBytes() {
+		te.Execute(bytesStructTmpl, nil)
+	}
+}
+
+func genBytesFuncs(te *utils.TmplExec) {
+	if useBytes() {
+		te.Execute(bytesFuncTmpl, nil)
+	}
+}
+
+// IDL中是否使用了timestamp或duration类型
+func useTime() bool {
+	var use bool
+	check := func(t *parse.Type) {
+		for ; isContainer(t); t = t.Elem {
+		}
+		use = use || utils.IsTime(t)
+	}
+	for _, msg := range allMessages {
+		for _, mem := range msg.Mems {
+			check(mem.Type)
+		}
+	}
+	utils.TraverseMethod(infos, func(method *parse.Method) bool {
+		for _, t := range append(method.ReqTypes, method.RetType) {
+			check(t)
+		}
+		return use
+	})
+	return use
+}
+
+func genTimeStruct(te *utils.TmplExec) {
+	if useTime() {
+		te.Execute(timeStructTmpl, nil)
+	}
+}
+
+func genTimeFuncs(te *utils.TmplExec) {
+	if useTime() {
+		te.Execute(timeFuncTmpl, nil)
+	}
+}
+
+// 带有注释的声明，Doc为已经格式化好的注释行
+type declaration struct {
+	Doc    string
+	Def    string
+	Macros []string
+}
+
+type containerDesc struct {
+	ServerSide    bool
+	Imported      bool // 导入的文件中已经生成过该容器类型
+	Name          string
+	WireName      string
+	ElemType      string
+	ElemInit      string
+	ElemDestroy   string
+	ElemMarshal   string
+	ElemUnmarshal string
+	ElemClone     string
+	// 以下仅map使用
+	StringKey    bool
+	KeyType      string
+	KeyDestroy   string
+	KeyMarshal   string
+	KeyUnmarshal string
+	KeyClone     string
+}
+
+func buildContainerDesc(t *parse.Type, serverSide bool) *containerDesc {
+	field := "data"
+	if t.Kind == parse.TypeKindMap {
+		field = "values"
+	}
+	desc := &containerDesc{
+		ServerSide:    serverSide,
+		Imported:      importedContainers[cTypeName(t)],
+		Name:          cTypeName(t),
+		WireName:      t.Name,
+		ElemType:      toClangType(unaliased(t.Elem), false),
+		ElemInit:      buildElemInit(t.Elem, field),
+		ElemDestroy:   buildElemDestroy(t.Elem, field),
+		ElemMarshal:   buildElemMarshal(t.Elem, field),
+		ElemUnmarshal: buildElemUnmarshal(t.Elem, field),
+		ElemClone:     buildElemClone(t.Elem, field),
+	}
+	if t.Kind == parse.TypeKindMap {
+		desc.StringKey = t.Key.Name == "string"
+		desc.KeyType = toClangType(unaliased(t.Key), false)
+		desc.KeyDestroy = buildElemDestroy(t.Key, "keys")
+		desc.KeyMarshal = buildKeyMarshal(t.Key)
+		desc.KeyUnmarshal = buildKeyUnmarshal(t.Key)
+		desc.KeyClone = buildElemClone(t.Key, "keys")
+	}
+	return desc
+}
+
+// 根据容器类型选择对应的模板，ownOnly为true时跳过导入的文件中已经生成过的容器类型
+func genContainers(te *utils.TmplExec, listTmpl, mapTmpl *template.Template, serverSide, ownOnly bool) {
+	for _, t := range containers {
+		if ownOnly && importedContainers[cTypeName(t)] {
+			continue
+		}
+		tmpl := listTmpl
+		if t.Kind == parse.TypeKindMap {
+			tmpl = mapTmpl
+		}
+		te.Execute(tmpl, buildContainerDesc(t, serverSide))
+	}
+}
+
 func genStructCloneC(te *utils.TmplExec) {
+	genContainers(te, listCloneCTmpl, mapCloneCTmpl, true, true)
 	for _, t := range infos.Messages {
 		data := &struct {
 			Name        string
 			Assignments []string
-		}{Name: t.Name}
+		}{Name: cName(t.Name)}
 		for _, mem := range t.Mems {
 			data.Assignments = append(data.Assignments, buildAssignment(mem))
 		}
+		for _, oneof := range t.Oneofs {
+			data.Assignments = append(data.Assignments, buildOneofAssignment(t, oneof))
+		}
 		te.Execute(structCloneCTmpl, data)
 	}
 }
 
 func genStructCloneH(te *utils.TmplExec) {
+	for _, t := range containers {
+		if !importedContainers[cTypeName(t)] {
+			te.Execute(structCloneHTmpl, cTypeName(t))
+		}
+	}
 	for _, t := range infos.Messages {
-		te.Execute(structCloneHTmpl, t.Name)
+		te.Execute(structCloneHTmpl, cName(t.Name))
 	}
 }
 
 func genStructDelete(te *utils.TmplExec) {
 	var data []string
 	utils.TraverseRespArgs(infos, func(t *parse.Type) bool {
-		if t.Kind != parse.TypeKindMessage {
+		if !isStruct(t) {
 			return false
 		}
-		data = append(data, t.Name)
+		data = append(data, cTypeName(t))
 		return false
 	})
+	// 客户端需要释放还原的error
+	for _, e := range infos.Errors {
+		data = append(data, cName(e.Name))
+	}
 	te.Execute(structDeleteTmpl, data)
 }
 
 func genStructCreate(te *utils.TmplExec) {
 	var data []string
 	utils.TraverseRespArgs(infos, func(t *parse.Type) bool {
-		if t.Kind != parse.TypeKindMessage {
+		if !isStruct(t) {
 			return false
 		}
-		data = append(data, t.Name)
+		data = append(data, cTypeName(t))
 		return false
 	})
+	// 服务端需要创建error后抛出
+	for _, e := range infos.Errors {
+		data = append(data, cName(e.Name))
+	}
 	te.Execute(structCreateTmpl, data)
 }
 
+// 服务端通过<Error>_throw将error写入err，客户端通过<Error>_catch从调用失败的错误中还原error
+func genErrorDecls(te *utils.TmplExec, serverSide bool) {
+	for _, e := range infos.Errors {
+		name := cName(e.Name)
+		fmt.Fprintf(te.W, "\n#define %s_CODE %d", name, e.Code)
+		if serverSide {
+			fmt.Fprintf(te.W, "\nvoid %s_throw(error_t* err, struct %s* e);", name, name)
+		} else {
+			fmt.Fprintf(te.W, "\nstruct %s* %s_catch(error_t* err);", name, name)
+		}
+	}
+}
+
+func genErrorFuncs(te *utils.TmplExec, tmpl *template.Template) {
+	for _, e := range infos.Errors {
+		te.Execute(tmpl, &struct {
+			Name     string
+			WireName string
+			Code     int32
+		}{Name: cName(e.Name), WireName: infos.Qualify(e.Name), Code: e.Code})
+	}
+}
+
 func genCallFuncs(te *utils.TmplExec) {
 	type Data struct {
 		HasRtn        bool
@@ -170,7 +490,7 @@ func genCallFuncs(te *utils.TmplExec) {
 		}
 		var i int
 		for _, t := range method.ReqTypes {
-			if t.Kind == parse.TypeKindMessage {
+			if isStruct(t) || utils.IsTime(t) {
 				i++
 				data.MessageArgs = append(data.MessageArgs, fmt.Sprintf("node%d", i))
 			}
@@ -185,16 +505,20 @@ func genDestroyResponse(te *utils.TmplExec) {
 		if t.Kind == parse.TypeKindNormal {
 			return false
 		}
-		fmt.Fprintf(te.W, "\nvoid %s_destroy(struct %s*);", t.Name, t.Name)
+		fmt.Fprintf(te.W, "\nvoid %s_destroy(struct %s*);", cTypeName(t), cTypeName(t))
 		return false
 	})
 }
 
 func genClientMethod(te *utils.TmplExec) {
 	for _, s := range infos.Services {
-		var methods []string
+		var methods []*declaration
 		for _, method := range s.Methods {
-			methods = append(methods, buildMethod(method, "client_t*"))
+			methods = append(methods, &declaration{
+				Doc:    utils.LineComment(utils.DocLines(method.Doc, method.Annos), ""),
+				Def:    buildMethod(method, "client_t*"),
+				Macros: buildMethodMacros(method),
+			})
 		}
 		te.Execute(clientMethodTmpl, methods)
 	}
@@ -209,6 +533,7 @@ func genHandlers(te *utils.TmplExec) {
 		ArgChecks     string   //参数合法性检查
 		ArgInits      []string //传参初始化
 		ArgUnmarshals []string //传参反序列化
+		Validates     string   //参数校验
 		CallArgs      string
 		Resp          string //返回值序列化
 		End           string //资源释放
@@ -216,12 +541,13 @@ func genHandlers(te *utils.TmplExec) {
 	utils.TraverseMethod(infos, func(method *parse.Method) (end bool) {
 		data := new(Data)
 		data.NoResp = method.RetType.Name == "void"
-		data.MessageResp = method.RetType.Kind == parse.TypeKindMessage
-		data.FuncName = fmt.Sprintf("%s_%s", method.Service.Name, method.Name)
+		data.MessageResp = isStruct(method.RetType) || utils.IsTime(method.RetType)
+		data.FuncName = fmt.Sprintf("%s_%s", cName(method.Service.Name), method.Name)
 		data.Defines = buildArgDefines(method)
 		data.ArgChecks = buildArgChecks(method)
 		data.ArgInits = buildArgInits(method)
 		data.ArgUnmarshals = buildArgUnmarshals(method)
+		data.Validates = buildArgValidates(method)
 		data.CallArgs = buildCallArgs(method)
 		data.Resp = buildResp(method)
 		data.End = buildEnd(method)
@@ -231,70 +557,203 @@ func genHandlers(te *utils.TmplExec) {
 }
 
 func common(te *utils.TmplExec, tmpl *template.Template, serverSide bool) {
-	for _, message := range infos.Messages {
+	for _, message := range allMessages {
 		data := &struct {
-			TypeName   string
-			Message    *parse.Message
-			MessageMem bool
-			IDL2CType  map[string]string
-			ServerSide bool
-		}{TypeName: message.Name, Message: message, IDL2CType: IDLtoCType, ServerSide: serverSide}
+			TypeName        string
+			Message         *parse.Message
+			MessageMem      bool
+			IDL2CType       map[string]string
+			ServerSide      bool
+			OneofMarshals   []string
+			OneofUnmarshals []string
+		}{TypeName: cName(message.Name), Message: message, IDL2CType: IDLtoCType, ServerSide: serverSide}
 		for _, mem := range message.Mems {
-			if mem.Type.Kind == parse.TypeKindMessage {
+			if isStruct(mem.Type) {
 				data.MessageMem = true
 				break
 			}
 		}
+		for _, oneof := range message.Oneofs {
+			for _, mem := range oneof.Mems {
+				data.MessageMem = data.MessageMem || isStruct(mem.Type)
+			}
+			data.OneofMarshals = append(data.OneofMarshals, buildOneofMarshal(message, oneof))
+			data.OneofUnmarshals = append(data.OneofUnmarshals, buildOneofUnmarshal(message, oneof))
+		}
 		te.Execute(tmpl, data)
 	}
 }
 
 func genUnmarshalFunc(te *utils.TmplExec) {
-	for _, message := range infos.Messages {
+	for _, t := range containers {
+		fmt.Fprintf(te.W, "static void %s_unmarshal(struct %s* dst, char* data, error_t* err);\n",
+			cTypeName(t), cTypeName(t))
+	}
+	for _, message := range allMessages {
 		fmt.Fprintf(te.W, "static void %s_unmarshal(struct %s* dst, char* data, error_t* err);\n",
-			message.Name, message.Name)
+			cName(message.Name), cName(message.Name))
 	}
+	genContainers(te, listUnmarshalFuncTmpl, mapUnmarshalFuncTmpl, false, false)
 	common(te, unmarshalFuncTmpl, false)
 }
 
+// 为需要校验的message生成X_validate函数，handler在调用用户实现之前对参数进行校验
+func genValidateFuncs(te *utils.TmplExec) {
+	if len(infos.Services) == 0 {
+		return
+	}
+	if usePattern() {
+		te.Execute(matchPatternTmpl, nil)
+	}
+	var messages []*parse.Message
+	for _, message := range allMessages {
+		if utils.NeedsValidate(message, allMessages) {
+			messages = append(messages, message)
+		}
+	}
+	if len(messages) == 0 {
+		return
+	}
+	fmt.Fprint(te.W, "\n")
+	for _, message := range messages {
+		fmt.Fprintf(te.W, "static void %s_validate(struct %s* x, error_t* err);\n", cName(message.Name), cName(message.Name))
+	}
+	for _, message := range messages {
+		b := &validateBuilder{fail: "return;"}
+		for _, mem := range message.Mems {
+			v := "x->" + mem.Name
+			var has string
+			switch {
+			case !mem.Optional || mem.Type.Name == "bytes":
+			case isStruct(mem.Type) || mem.Type.Name == "string":
+				has = v + " != NULL"
+			default:
+				has = "x->has_" + mem.Name
+			}
+			b.check(1, v, mem.Type, has, mem.Constraints, message.QualName()+"."+mem.Name)
+		}
+		for _, oneof := range message.Oneofs {
+			for _, mem := range oneof.Mems {
+				if !utils.TypeNeedsValidate(mem.Type, allMessages) {
+					continue
+				}
+				b.line(1, "if (x->%s_case == %s) {", oneof.Name, oneofCase(message, oneof, mem.Name))
+				b.elem(2, fmt.Sprintf("x->%s.%s", oneof.Name, mem.Name), mem.Type, 0)
+				b.line(1, "}")
+			}
+		}
+		te.Execute(validateFuncTmpl, &struct {
+			Name string
+			Body string
+		}{Name: cName(message.Name), Body: b.String()})
+	}
+}
+
+// 可见的message成员以及当前文件中的方法参数是否使用了pattern约束
+func usePattern() bool {
+	for _, message := range allMessages {
+		for _, mem := range message.Mems {
+			if mem.Constraints.Get("pattern") != nil {
+				return true
+			}
+		}
+	}
+	var use bool
+	utils.TraverseMethod(infos, func(method *parse.Method) bool {
+		for _, cs := range method.ReqConstraints {
+			use = use || cs.Get("pattern") != nil
+		}
+		return use
+	})
+	return use
+}
+
 func genMashalFunc(te *utils.TmplExec, serverSide bool) {
 	fmt.Fprint(te.W, "\n\n")
-	for _, message := range infos.Messages {
+	for _, t := range containers {
 		fmt.Fprintf(te.W, "static cJSON* %s_marshal(struct %s* arg, error_t* err);\n",
-			message.Name, message.Name)
+			cTypeName(t), cTypeName(t))
 	}
+	for _, message := range allMessages {
+		fmt.Fprintf(te.W, "static cJSON* %s_marshal(struct %s* arg, error_t* err);\n",
+			cName(message.Name), cName(message.Name))
+	}
+	genContainers(te, listMarshalFuncTmpl, mapMarshalFuncTmpl, serverSide, false)
 	common(te, marshalFuncTmpl, serverSide)
 }
 
 func genRegisterService(te *utils.TmplExec) {
 	for _, s := range infos.Services {
-		te.Execute(registerServiceTmpl, s)
+		te.Execute(registerServiceTmpl, &struct {
+			Name     string
+			WireName string
+			Methods  []*parse.Method
+		}{
+			Name:     cName(s.Name),
+			WireName: infos.Qualify(s.Name),
+			Methods:  s.Methods,
+		})
 	}
 }
 
 func genArgumentInitAndDestroy(te *utils.TmplExec, serverSide bool) {
 	te.W.Write([]byte{'\n'})
-	for _, m := range infos.Messages {
-		fmt.Fprintf(te.W, "static inline __attribute__((always_inline)) void %s_init(struct %s*);\n", m.Name, m.Name)
-		fmt.Fprintf(te.W, "static inline __attribute__((always_inline)) void %s_destroy(struct %s*);\n", m.Name, m.Name)
+	for _, t := range containers {
+		name := cTypeName(t)
+		fmt.Fprintf(te.W, "static inline __attribute__((always_inline)) void %s_init(struct %s*);\n", name, name)
+		fmt.Fprintf(te.W, "static inline __attribute__((always_inline)) void %s_destroy(struct %s*);\n", name, name)
+	}
+	for _, m := range allMessages {
+		name := cName(m.Name)
+		fmt.Fprintf(te.W, "static inline __attribute__((always_inline)) void %s_init(struct %s*);\n", name, name)
+		fmt.Fprintf(te.W, "static inline __attribute__((always_inline)) void %s_destroy(struct %s*);\n", name, name)
 	}
 
-	for _, m := range infos.Messages {
+	genContainers(te, listInitAndDestroyTmpl, mapInitAndDestroyTmpl, serverSide, false)
+
+	for _, m := range allMessages {
 		data := &struct {
-			ServerSide  bool
-			Name        string
-			MessageMems []*parse.Member
-			StringMems  []*parse.Member
-		}{Name: m.Name, ServerSide: serverSide}
+			ServerSide   bool
+			Imported     bool // 导入的message的create、delete函数由被导入的文件生成
+			Name         string
+			Empty        bool
+			MessageMems  []*parse.Member
+			OptionalMems []*parse.Member // 可选的结构体成员，初始为NULL
+			StringMems   []*parse.Member
+			BytesMems    []*parse.Member
+			FlagMems     []*parse.Member // 可选的数值成员，以has_<name>标记是否存在
+			ArrayMems    []*parse.Member // 定长数组成员，初始化为全0
+			Defaults     []string        // 为有默认值的成员赋值的语句
+			OneofInits   []string        // 将oneof标记为没有变体有值的语句
+			OneofFrees   []string        // 释放oneof中变体的语句
+		}{Name: cName(m.Name), ServerSide: serverSide, Imported: isImportedMessage(m)}
+		for _, oneof := range m.Oneofs {
+			data.OneofInits = append(data.OneofInits, fmt.Sprintf("data->%s_case = %s;", oneof.Name, oneofCase(m, oneof, "NOT_SET")))
+			data.OneofFrees = append(data.OneofFrees, buildOneofDestroy(m, oneof)...)
+		}
 		for _, mem := range m.Mems {
-			if mem.Type.Kind != parse.TypeKindMessage {
-				if mem.Type.Name == "string" {
+			if mem.Default != nil {
+				data.Defaults = append(data.Defaults, buildDefault(mem))
+			}
+			if !isStruct(mem.Type) {
+				if isArray(mem.Type) {
+					data.ArrayMems = append(data.ArrayMems, mem)
+				} else if mem.Type.Name == "string" {
 					data.StringMems = append(data.StringMems, mem)
+				} else if mem.Type.Name == "bytes" {
+					data.BytesMems = append(data.BytesMems, mem)
+				} else if mem.Optional {
+					data.FlagMems = append(data.FlagMems, mem)
 				}
 				continue
 			}
-			data.MessageMems = append(data.MessageMems, mem)
+			if mem.Optional {
+				data.OptionalMems = append(data.OptionalMems, mem)
+			} else {
+				data.MessageMems = append(data.MessageMems, mem)
+			}
 		}
+		data.Empty = len(data.MessageMems)+len(data.OptionalMems)+len(data.StringMems)+len(data.BytesMems)+len(data.FlagMems)+len(data.ArrayMems)+len(data.Defaults)+len(data.OneofInits) == 0
 		te.Execute(argumentInitAndDestroyTmpl, data)
 	}
 }
@@ -315,26 +774,107 @@ func genServiceMethod(te *utils.TmplExec) {
 	for _, s := range infos.Services {
 		data := &struct {
 			ServiceName string
-			Methods     []string
-		}{ServiceName: s.Name}
+			Doc         string
+			Methods     []*declaration
+		}{ServiceName: cName(s.Name), Doc: utils.LineComment(utils.DocLines(s.Doc, s.Annos), "")}
 		for _, method := range s.Methods {
-			data.Methods = append(data.Methods, buildMethod(method, "error_t*"))
+			data.Methods = append(data.Methods, &declaration{
+				Doc: utils.LineComment(utils.DocLines(method.Doc, method.Annos), ""),
+				Def: buildMethod(method, "error_t*"),
+			})
 		}
 		te.Execute(serviceMethodTmpl, data)
 	}
 }
 
+func genEnums(te *utils.TmplExec) {
+	for _, enum := range infos.Enums {
+		te.Execute(enumTmpl, buildEnumDesc(enum))
+	}
+}
+
+// string常量生成为宏，其他常量生成为static const变量
+func genConsts(te *utils.TmplExec) {
+	if len(infos.Consts) == 0 {
+		return
+	}
+	var consts []*declaration
+	for _, c := range infos.Consts {
+		def := fmt.Sprintf("#define %s %s", cName(c.Name), utils.Quote(c.Value.Value))
+		if c.Type.Name != "string" {
+			def = fmt.Sprintf("static const %s %s = %s;", toClangType(c.Type, false), cName(c.Name), buildLiteral(c.Type, c.Value))
+		}
+		consts = append(consts, &declaration{Doc: utils.LineComment(c.Doc, ""), Def: def})
+	}
+	te.Execute(constTmpl, consts)
+}
+
+func genTypedefs(te *utils.TmplExec) {
+	if len(infos.Typedefs) == 0 {
+		return
+	}
+	var defs []*declaration
+	for _, def := range infos.Typedefs {
+		defs = append(defs, &declaration{
+			Doc: utils.LineComment(def.Doc, ""),
+			Def: fmt.Sprintf("typedef %s %s;", toClangType(def.Type, false), cName(def.Name)),
+		})
+	}
+	te.Execute(constTmpl, defs)
+}
+
+func genEnumValid(te *utils.TmplExec) {
+	for _, enum := range allEnums {
+		te.Execute(enumValidTmpl, buildEnumDesc(enum))
+	}
+}
+
+func buildEnumDesc(enum *parse.Enum) *parse.Enum {
+	return &parse.Enum{Name: cName(enum.Name), Mems: enum.Mems}
+}
+
 func genStructs(te *utils.TmplExec) {
-	te.Execute(structStateTmpl, infos.Messages)
+	var names []string
+	for _, message := range infos.Messages {
+		names = append(names, cName(message.Name))
+	}
+	te.Execute(structStateTmpl, names)
+	genContainers(te, listStructTmpl, mapStructTmpl, false, true)
 	for _, message := range infos.Messages {
 		s := &struct {
+			Doc     string
 			Name    string
-			Members []string
+			Members []*declaration
 		}{}
-		s.Name = message.Name
-		s.Members = make([]string, len(message.Mems))
-		for i, mem := range message.Mems {
-			s.Members[i] = fmt.Sprintf("%s %s", toClangType(mem.Type, true), mem.Name)
+		s.Doc = utils.LineComment(utils.DocLines(message.Doc, message.Annos), "")
+		s.Name = cName(message.Name)
+		for _, mem := range message.Mems {
+			// 注释放在成员的第一个字段之前
+			doc := utils.LineComment(utils.DocLines(mem.Doc, mem.Annos), "\t")
+			if mem.Optional && !isStruct(mem.Type) && !utils.IsVarLen(mem.Type) {
+				s.Members = append(s.Members, &declaration{Doc: doc, Def: fmt.Sprintf("int has_%s", mem.Name)})
+				doc = ""
+			}
+			if isArray(mem.Type) {
+				s.Members = append(s.Members, &declaration{Doc: doc, Def: fmt.Sprintf("%s %s[%d]", toClangType(mem.Type.Elem, true), mem.Name, mem.Type.Len)})
+				continue
+			}
+			s.Members = append(s.Members, &declaration{Doc: doc, Def: fmt.Sprintf("%s %s", toClangType(mem.Type, true), mem.Name)})
+		}
+		for _, oneof := range message.Oneofs {
+			cases := []string{oneofCase(message, oneof, "NOT_SET")}
+			for _, mem := range oneof.Mems {
+				cases = append(cases, oneofCase(message, oneof, mem.Name))
+			}
+			te.Execute(oneofCaseTmpl, &struct {
+				Type  string
+				Cases []string
+			}{Type: oneofCaseType(message, oneof), Cases: cases})
+			s.Members = append(s.Members, buildOneofFields(message, oneof)...)
+		}
+		// 没有成员的message或error，标准C不允许空结构体
+		if len(s.Members) == 0 {
+			s.Members = append(s.Members, &declaration{Def: "char placeholder"})
 		}
 		te.Execute(structTmpl, s)
 	}
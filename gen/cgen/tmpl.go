@@ -1,6 +1,9 @@
 package cgen
 
-import "text/template"
+import (
+	"gufeijun/hustgen/gen/utils"
+	"text/template"
+)
 
 var (
 	macroTmpl                  = must(_macroTmpl)
@@ -8,6 +11,7 @@ var (
 	includesTmpl               = must(_includesTmpl)
 	structStateTmpl            = must(_structStateTmpl)
 	structTmpl                 = must(_structTmpl)
+	oneofCaseTmpl              = must(_oneofCaseTmpl)
 	serviceMethodTmpl          = must(_serviceMethodTmpl)
 	sourceFileIncludesTmpl     = must(_sourceFileIncludesTmpl)
 	registerServiceTmpl        = must(_registerServiceTmpl)
@@ -15,16 +19,48 @@ var (
 	marshalFuncTmpl            = must(_marshalFuncTmpl)
 	unmarshalFuncTmpl          = must(_unmarshalFuncTmpl)
 	handlerTmpl                = must(_handlerTmpl)
+	validateFuncTmpl           = must(_validateFuncTmpl)
+	matchPatternTmpl           = must(_matchPatternTmpl)
 	clientMethodTmpl           = must(_clientMethodTmpl)
 	clientCallTmpl             = must(_clientCallTmpl)
 	structCreateTmpl           = must(_structCreateTmpl)
 	structDeleteTmpl           = must(_structDeleteTmpl)
 	structCloneHTmpl           = must(_structCloneHTmpl)
 	structCloneCTmpl           = must(_structCloneCTmpl)
+	listStructTmpl             = must(_listStructTmpl)
+	listInitAndDestroyTmpl     = must(_listInitAndDestroyTmpl)
+	listMarshalFuncTmpl        = must(_listMarshalFuncTmpl)
+	listUnmarshalFuncTmpl      = must(_listUnmarshalFuncTmpl)
+	listCloneCTmpl             = must(_listCloneCTmpl)
+	enumTmpl                   = must(_enumTmpl)
+	constTmpl                  = must(_constTmpl)
+	enumValidTmpl              = must(_enumValidTmpl)
+	mapStructTmpl              = must(_mapStructTmpl)
+	mapInitAndDestroyTmpl      = must(_mapInitAndDestroyTmpl)
+	mapMarshalFuncTmpl         = must(_mapMarshalFuncTmpl)
+	mapUnmarshalFuncTmpl       = must(_mapUnmarshalFuncTmpl)
+	mapCloneCTmpl              = must(_mapCloneCTmpl)
+	bytesStructTmpl            = must(_bytesStructTmpl)
+	bytesFuncTmpl              = must(_bytesFuncTmpl)
+	errorThrowTmpl             = must(_errorThrowTmpl)
+	errorCatchTmpl             = must(_errorCatchTmpl)
+	timeStructTmpl             = must(_timeStructTmpl)
+	timeFuncTmpl               = must(_timeFuncTmpl)
 )
 
+var funcs = template.FuncMap{
+	"cname":          cTypeName,
+	"isStruct":       isStruct,
+	"isList":         isList,
+	"isEnum":         isEnum,
+	"isArray":        isArray,
+	"arrayMarshal":   buildArrayMarshal,
+	"arrayUnmarshal": buildArrayUnmarshal,
+	"isTime":         utils.IsTime,
+}
+
 func must(tmpl string) *template.Template {
-	return template.Must(template.New("").Parse(tmpl))
+	return template.Must(template.New("").Funcs(funcs).Parse(tmpl))
 }
 
 const _statementTmpl = `// This is code generated by hgen. DO NOT EDIT!!!
@@ -41,24 +77,58 @@ const _includesTmpl = `
 
 const _structStateTmpl = `
 {{- range . }}
-struct {{.Name}};
+struct {{.}};
 {{- end }}
 `
 
 const _structTmpl = `
-struct {{ .Name }}{
+{{.Doc}}struct {{ .Name }}{
 {{- range .Members }}		
-	{{.}};
+{{.Doc}}	{{.Def}};
+{{- end }}
+};
+`
+
+const _oneofCaseTmpl = `
+enum {{.Type}} {
+{{- range $i, $v := .Cases }}
+	{{$v}} = {{$i}},
 {{- end }}
 };
 `
 
+const _enumTmpl = `
+enum {{.Name}} {
+{{- range .Mems }}
+	{{$.Name}}_{{.Name}} = {{.Value}},
+{{- end }}
+};
+`
+
+const _constTmpl = `
+{{ range . -}}
+{{.Doc}}{{.Def}}
+{{ end -}}
+`
+
+const _enumValidTmpl = `
+static inline int {{.Name}}_valid(int32_t v) {
+	switch (v) {
+	{{- range .Mems }}
+	case {{$.Name}}_{{.Name}}:
+	{{- end }}
+		return 1;
+	}
+	return 0;
+}
+`
+
 const _serviceMethodTmpl = `
 
 // server should implement following functions for service: {{.ServiceName}}
-//**********************************************************
+{{.Doc}}//**********************************************************
 {{- range .Methods }}
-{{.}}
+{{.Doc}}{{.Def}}
 {{- end }}
 //**********************************************************
 void register_{{.ServiceName}}_service(server_t*);
@@ -78,38 +148,71 @@ const _sourceFileIncludesTmpl = `#include "{{.Header}}"
 const _registerServiceTmpl = `
 
 {{ $name:=.Name -}}
+{{ $wireName:=.WireName -}}
 void register_{{.Name}}_service(server_t* svr) {
 	{{- range .Methods }}
-	server_register(svr, "{{$name}}.{{.Name}}", {{$name}}_{{.Name}}_handler);
+	server_register(svr, "{{$wireName}}.{{.Name}}", {{$name}}_{{.Name}}_handler);
 	{{- end }}
 }`
 
 const _argumentInitAndDestroyTmpl = `
 void {{.Name}}_init(struct {{.Name}}* data)
-{{- if and (eq (len .MessageMems) 0) (eq (len .StringMems) 0) }} {}
+{{- if .Empty }} {}
 {{- else }} {
 	{{- range .MessageMems}}
-	data->{{.Name}} = malloc(sizeof(struct {{.Type.Name}}));
-	{{.Type.Name}}_init(data->{{.Name}});
+	data->{{.Name}} = malloc(sizeof(struct {{cname .Type}}));
+	{{cname .Type}}_init(data->{{.Name}});
+	{{- end }}
+	{{- range .OptionalMems}}
+	data->{{.Name}} = NULL;
 	{{- end }}
 	{{- range .StringMems}}
+	{{- if not .Default }}
 	data->{{.Name}} = NULL;
 	{{- end }}
+	{{- end }}
+	{{- range .BytesMems}}
+	data->{{.Name}}.len = 0;
+	data->{{.Name}}.data = NULL;
+	{{- end }}
+	{{- range .FlagMems}}
+	data->has_{{.Name}} = 0;
+	{{- end }}
+	{{- range .ArrayMems}}
+	memset(data->{{.Name}}, 0, sizeof(data->{{.Name}}));
+	{{- end }}
+	{{- range .Defaults}}
+	{{.}}
+	{{- end }}
+	{{- range .OneofInits}}
+	{{.}}
+	{{- end }}
 }
 {{- end }}
 void {{.Name}}_destroy(struct {{.Name}}* data)
-{{- if and (eq (len .MessageMems) 0) (eq (len .StringMems) 0) }} {}
+{{- if and (eq (len .MessageMems) 0) (eq (len .OptionalMems) 0) (eq (len .StringMems) 0) (eq (len .BytesMems) 0) (eq (len .OneofFrees) 0) }} {}
 {{- else }} {
 	{{- range .MessageMems}}
-	{{.Type.Name}}_destroy(data->{{.Name}});
+	{{cname .Type}}_destroy(data->{{.Name}});
+	free(data->{{.Name}});
+	{{- end }}
+	{{- range .OptionalMems}}
+	if (data->{{.Name}}) {{cname .Type}}_destroy(data->{{.Name}});
 	free(data->{{.Name}});
 	{{- end }}
 	{{- range .StringMems}}
 	free(data->{{.Name}});
 	{{- end }}
+	{{- range .BytesMems}}
+	free(data->{{.Name}}.data);
+	{{- end }}
+	{{- range .OneofFrees}}
+	{{.}}
+	{{- end }}
 }
 {{- end }}
-{{- if .ServerSide }}
+{{- if .Imported }}
+{{- else if .ServerSide }}
 struct {{.Name}}* {{.Name}}_create() {
 	struct {{.Name}}* v = malloc(sizeof(struct {{.Name}}));
 	{{.Name}}_init(v);
@@ -134,20 +237,41 @@ cJSON* {{.TypeName}}_marshal(struct {{.TypeName}}* data, error_t* err) {
     if (!root) goto bad;
 	{{- $serverSide:= .ServerSide}}
 	{{- range .Message.Mems -}}
-	{{- if eq .Type.Kind 2 }}
+	{{- if isArray .Type }}
+	{{arrayMarshal .}}
+	{{- else if eq .Type.Name "bytes" }}
+	if ({{if .Optional}}data->{{.Name}}.data != NULL && {{end}}!cJSON_AddItemToObject(root, "{{ .JSONName }}", bytes_marshal(&data->{{.Name}}))) goto bad;
+	{{- else if isTime .Type }}
+	if ({{if .Optional}}data->has_{{.Name}} && {{end}}!cJSON_AddItemToObject(root, "{{ .JSONName }}", {{.Type.Name}}_marshal(&data->{{.Name}}))) goto bad;
+{{- else if eq .Type.Name "bool" }}
+	if ({{if .Optional}}data->has_{{.Name}} && {{end}}cJSON_AddBoolToObject(root, "{{ .JSONName }}", data->{{.Name}}) == NULL) goto bad;
+	{{- else if and .Optional (isStruct .Type) }}
+    if (data->{{.Name}} != NULL) {
+		item = {{ cname .Type }}_marshal(data->{{.Name}}, err);
+		if (!err->null) goto bad;
+    	if (!cJSON_AddItemToObject(root, "{{ .JSONName }}", item)) goto bad;
+    }
+	{{- else if and .Optional (eq .Type.Name "string") }}
+	if (data->{{.Name}} != NULL && cJSON_AddStringToObject(root, "{{ .JSONName }}", data->{{.Name}}) == NULL) goto bad;
+	{{- else if .Optional }}
+	if (data->has_{{.Name}} && cJSON_AddNumberToObject(root, "{{ .JSONName }}", (double)data->{{.Name}}) == NULL) goto bad;
+	{{- else if isStruct .Type }}
     if (data->{{.Name}} == NULL) {
-        if (cJSON_AddNullToObject(root, "{{.Name}}") == NULL) goto bad;
+        if (cJSON_AddNullToObject(root, "{{.JSONName}}") == NULL) goto bad;
     } else {
-		item = {{ .Type.Name }}_marshal(data->{{.Name}}, err);
+		item = {{ cname .Type }}_marshal(data->{{.Name}}, err);
 		if (!err->null) goto bad;
-    	if (!cJSON_AddItemToObject(root, "{{ .Name }}", item)) goto bad;
+    	if (!cJSON_AddItemToObject(root, "{{ .JSONName }}", item)) goto bad;
     }
 	{{- else if eq .Type.Name "string" }}
 	if (data->{{.Name}} == NULL) data->{{.Name}} = {{if $serverSide}}strdup(""){{else}}""{{end}};
-    if (cJSON_AddStringToObject(root, "{{ .Name }}", data->{{.Name}}) == NULL) goto bad;
+    if (cJSON_AddStringToObject(root, "{{ .JSONName }}", data->{{.Name}}) == NULL) goto bad;
 	{{- else }}
-    if (cJSON_AddNumberToObject(root, "{{ .Name }}", (double)data->{{.Name}}) == NULL) goto bad;
+    if (cJSON_AddNumberToObject(root, "{{ .JSONName }}", (double)data->{{.Name}}) == NULL) goto bad;
+	{{- end }}
 	{{- end }}
+	{{- range .OneofMarshals }}
+	{{.}}
 	{{- end }}
 	return root;
 bad:
@@ -160,25 +284,110 @@ bad:
 const _unmarshalFuncTmpl = `
 void {{.TypeName}}_unmarshal(struct {{.TypeName}}* dst, char* data, error_t* err) {
     cJSON* root = NULL;
+	{{- if or .Message.Mems .Message.Oneofs }}
     cJSON* item = NULL;
+	{{- end }}
 
     root = cJSON_Parse(data);
     if (!root) goto bad;
 	{{- $map:=.IDL2CType -}}
 	{{ range .Message.Mems }}
-    item = cJSON_GetObjectItemCaseSensitive(root, "{{ .Name }}");
-	{{- if eq .Type.Kind 2 }}
+    item = cJSON_GetObjectItemCaseSensitive(root, "{{ .JSONName }}");
+	{{- if isArray .Type }}
+	{{arrayUnmarshal .}}
+	{{- else if eq .Type.Name "bytes" }}
+	{{- if .Optional }}
+	if (item && !cJSON_IsNull(item) && !bytes_unmarshal(&dst->{{.Name}}, item)) goto bad;
+	{{- else }}
+	if (!item || !bytes_unmarshal(&dst->{{.Name}}, item)) goto bad;
+	{{- end }}
+	{{- else if isTime .Type }}
+	{{- if .Optional }}
+	dst->has_{{.Name}} = 0;
+	if (item && !cJSON_IsNull(item)) {
+		if (!{{.Type.Name}}_unmarshal(&dst->{{.Name}}, item)) goto bad;
+		dst->has_{{.Name}} = 1;
+	}
+	{{- else }}
+	if (!item || !{{.Type.Name}}_unmarshal(&dst->{{.Name}}, item)) goto bad;
+	{{- end }}
+	{{- else if .Optional }}
+	if (!item || cJSON_IsNull(item)) {
+		{{- if or (isStruct .Type) (eq .Type.Name "string") }}
+		dst->{{.Name}} = NULL;
+		{{- else }}
+		dst->has_{{.Name}} = 0;
+		{{- end }}
+	} else {
+		{{- if isStruct .Type }}
+		if (!{{if isList .Type}}cJSON_IsArray{{else}}cJSON_IsObject{{end}}(item)) goto bad;
+		dst->{{.Name}} = malloc(sizeof(struct {{cname .Type}}));
+		{{cname .Type}}_init(dst->{{.Name}});
+		data = cJSON_Print(item);
+		{{cname .Type}}_unmarshal(dst->{{.Name}}, data, err);
+		free(data);
+		if (!err->null) goto bad;
+		{{- else if eq .Type.Name "string" }}
+		if (!cJSON_IsString(item)) goto bad;
+		dst->{{.Name}} = strdup(cJSON_GetStringValue(item));
+		{{- else if eq .Type.Name "bool" }}
+		if (!cJSON_IsBool(item)) goto bad;
+		dst->has_{{.Name}} = 1;
+		dst->{{.Name}} = cJSON_IsTrue(item);
+		{{- else }}
+		if (!cJSON_IsNumber(item)) goto bad;
+		dst->has_{{.Name}} = 1;
+		{{- if isEnum .Type }}
+		dst->{{.Name}} = (enum {{cname .Type}})item->valueint;
+		if (!{{cname .Type}}_valid(dst->{{.Name}})) goto bad;
+		{{- else if or (eq .Type.Name "float32") (eq .Type.Name "float64")}}
+		dst->{{.Name}} = ({{index $map .Type.Name}})item->valuedouble;
+		{{- else }}
+		dst->{{.Name}} = ({{index $map .Type.Name}})item->valueint;
+		{{- end }}
+		{{- end }}
+	}
+	{{- else if isStruct .Type }}
     if (cJSON_IsNull(item))
         dst->{{ .Name }} = NULL;
     else {
-		if (!item || !cJSON_IsObject(item)) goto bad;
+		if (!item || !{{if isList .Type}}cJSON_IsArray{{else}}cJSON_IsObject{{end}}(item)) goto bad;
     	data = cJSON_Print(item);
-		{{.Type.Name}}_unmarshal(dst->{{.Name}}, data, err);
+		{{cname .Type}}_unmarshal(dst->{{.Name}}, data, err);
+		free(data);
 		if (!err->null) goto bad;
     }
+	{{- else if .Default }}
+	if (item) {
+		{{- if eq .Type.Name "string" }}
+		if (!cJSON_IsString(item)) goto bad;
+		free(dst->{{.Name}});
+		dst->{{.Name}} = strdup(cJSON_GetStringValue(item));
+		{{- else if eq .Type.Name "bool" }}
+		if (!cJSON_IsBool(item)) goto bad;
+		dst->{{.Name}} = cJSON_IsTrue(item);
+		{{- else }}
+		if (!cJSON_IsNumber(item)) goto bad;
+		{{- if isEnum .Type }}
+		dst->{{.Name}} = (enum {{cname .Type}})item->valueint;
+		if (!{{cname .Type}}_valid(dst->{{.Name}})) goto bad;
+		{{- else if or (eq .Type.Name "float32") (eq .Type.Name "float64")}}
+		dst->{{.Name}} = ({{index $map .Type.Name}})item->valuedouble;
+		{{- else }}
+		dst->{{.Name}} = ({{index $map .Type.Name}})item->valueint;
+		{{- end }}
+		{{- end }}
+	}
 	{{- else if eq .Type.Name "string" }}
 	if (!item || !cJSON_IsString(item)) goto bad;
 	dst->{{.Name}} = strdup(cJSON_GetStringValue(item));
+	{{- else if eq .Type.Name "bool" }}
+	if (!item || !cJSON_IsBool(item)) goto bad;
+	dst->{{.Name}} = cJSON_IsTrue(item);
+	{{- else if isEnum .Type }}
+	if (!item || !cJSON_IsNumber(item)) goto bad;
+	dst->{{.Name}} = (enum {{cname .Type}})item->valueint;
+	if (!{{cname .Type}}_valid(dst->{{.Name}})) goto bad;
 	{{- else if or (eq .Type.Name "float32") (eq .Type.Name "float64")}}
 	if (!item || !cJSON_IsNumber(item)) goto bad;
 	dst->{{.Name}} = ({{index $map .Type.Name}})item->valuedouble;
@@ -187,6 +396,9 @@ void {{.TypeName}}_unmarshal(struct {{.TypeName}}* dst, char* data, error_t* err
 	dst->{{.Name}} = ({{index $map .Type.Name}})item->valueint;
 	{{- end }}
 	{{- end }}
+	{{- range .OneofUnmarshals }}
+	{{.}}
+	{{- end }}
     cJSON_Delete(root);
     return;
 bad:
@@ -211,7 +423,7 @@ void {{.FuncName}}_handler(request_t* req, error_t* err, struct argument* resp)
 	{{- range .ArgUnmarshals }}
 	{{.}}
 	{{- end }}
-	{{if not .NoResp}}res = {{end}}{{.FuncName}}({{.CallArgs}});
+{{.Validates}}	{{if not .NoResp}}res = {{end}}{{.FuncName}}({{.CallArgs}});
 	if (!err->null) goto end;
 	{{.Resp}}
 end:{{.End}}
@@ -219,10 +431,31 @@ end:{{.End}}
 }
 `
 
+// 检查message是否满足IDL中声明的约束，不满足时设置err
+const _validateFuncTmpl = `
+static void {{.Name}}_validate(struct {{.Name}}* x, error_t* err) {
+	if (x == NULL) return;
+{{.Body}}}
+`
+
+// pattern约束使用POSIX扩展正则表达式
+const _matchPatternTmpl = `
+static int match_pattern(const char* pattern, const char* s) {
+	regex_t re;
+	if (regcomp(&re, pattern, REG_EXTENDED | REG_NOSUB) != 0) return 0;
+	int matched = regexec(&re, s, 0, NULL, 0) == 0;
+	regfree(&re);
+	return matched;
+}
+`
+
 const _clientMethodTmpl = `
 {{- range . }}
+{{.Doc}}{{.Def}}
+{{- range .Macros }}
 {{.}}
 {{- end }}
+{{- end }}
 `
 
 const _clientCallTmpl = `
@@ -316,3 +549,524 @@ const _macroTmpl = `
     }
 #define MARSHAL_FAILED(obj) error_put(err, "marshal struct " obj " failed");
 #define UNMARSHAL_FAILED(obj) error_put(err, "unmarshal struct " obj " failed")`
+
+const _listStructTmpl = `
+struct {{.Name}}{
+	uint32_t len;
+	{{.ElemType}}* data;
+};
+`
+
+const _listInitAndDestroyTmpl = `
+void {{.Name}}_init(struct {{.Name}}* data) {
+	data->len = 0;
+	data->data = NULL;
+}
+void {{.Name}}_destroy(struct {{.Name}}* data) {
+	{{- if .ElemDestroy }}
+	for (uint32_t i = 0; i < data->len; i++) {
+		{{.ElemDestroy}}
+	}
+	{{- end }}
+	free(data->data);
+	data->len = 0;
+	data->data = NULL;
+}
+{{- if .Imported }}
+{{- else if .ServerSide }}
+struct {{.Name}}* {{.Name}}_create() {
+	struct {{.Name}}* v = malloc(sizeof(struct {{.Name}}));
+	{{.Name}}_init(v);
+	return v;
+}
+{{- else }}
+void {{.Name}}_delete(struct {{.Name}}* arg) {
+	{{.Name}}_destroy(arg);
+	free(arg);
+}
+{{- end -}}
+`
+
+const _listMarshalFuncTmpl = `
+cJSON* {{.Name}}_marshal(struct {{.Name}}* data, error_t* err) {
+	cJSON* root = NULL;
+	cJSON* item = NULL;
+	if (data == NULL) goto bad;
+	root = cJSON_CreateArray();
+	if (!root) goto bad;
+	for (uint32_t i = 0; i < data->len; i++) {
+		{{.ElemMarshal}}
+		if (!item || !cJSON_AddItemToArray(root, item)) goto bad;
+	}
+	return root;
+bad:
+	if (!err->null) MARSHAL_FAILED("{{.WireName}}")
+	if (root) cJSON_Delete(root);
+	return NULL;
+}
+`
+
+const _listUnmarshalFuncTmpl = `
+void {{.Name}}_unmarshal(struct {{.Name}}* dst, char* data, error_t* err) {
+	cJSON* root = NULL;
+	cJSON* item = NULL;
+	uint32_t i = 0;
+
+	root = cJSON_Parse(data);
+	if (!root || !cJSON_IsArray(root)) goto bad;
+	dst->len = cJSON_GetArraySize(root);
+	dst->data = calloc(dst->len, sizeof(*dst->data));
+	{{- if .ElemInit }}
+	for (i = 0; i < dst->len; i++) {
+		{{.ElemInit}}
+	}
+	i = 0;
+	{{- end }}
+	cJSON_ArrayForEach(item, root) {
+		{{.ElemUnmarshal}}
+		i++;
+	}
+	cJSON_Delete(root);
+	return;
+bad:
+	if (!err->null) UNMARSHAL_FAILED("{{.WireName}}");
+	if (root) cJSON_Delete(root);
+}
+`
+
+const _listCloneCTmpl = `
+struct {{.Name}}* {{.Name}}_clone(struct {{.Name}}* src) {
+	if (src == NULL) return NULL;
+	struct {{.Name}}* dst = malloc(sizeof(struct {{.Name}}));
+	dst->len = src->len;
+	dst->data = malloc(sizeof(*dst->data) * src->len);
+	for (uint32_t i = 0; i < src->len; i++) {
+		{{.ElemClone}}
+	}
+	return dst;
+}`
+
+const _mapStructTmpl = `
+struct {{.Name}}{
+	uint32_t len;
+	{{.KeyType}}* keys;
+	{{.ElemType}}* values;
+};
+`
+
+const _mapInitAndDestroyTmpl = `
+void {{.Name}}_init(struct {{.Name}}* data) {
+	data->len = 0;
+	data->keys = NULL;
+	data->values = NULL;
+}
+void {{.Name}}_destroy(struct {{.Name}}* data) {
+	{{- if or .KeyDestroy .ElemDestroy }}
+	for (uint32_t i = 0; i < data->len; i++) {
+		{{- if .KeyDestroy }}
+		{{.KeyDestroy}}
+		{{- end }}
+		{{- if .ElemDestroy }}
+		{{.ElemDestroy}}
+		{{- end }}
+	}
+	{{- end }}
+	free(data->keys);
+	free(data->values);
+	data->len = 0;
+	data->keys = NULL;
+	data->values = NULL;
+}
+{{- if .Imported }}
+{{- else if .ServerSide }}
+struct {{.Name}}* {{.Name}}_create() {
+	struct {{.Name}}* v = malloc(sizeof(struct {{.Name}}));
+	{{.Name}}_init(v);
+	return v;
+}
+{{- else }}
+void {{.Name}}_delete(struct {{.Name}}* arg) {
+	{{.Name}}_destroy(arg);
+	free(arg);
+}
+{{- end -}}
+`
+
+const _mapMarshalFuncTmpl = `
+cJSON* {{.Name}}_marshal(struct {{.Name}}* data, error_t* err) {
+	cJSON* root = NULL;
+	cJSON* item = NULL;
+	const char* key = NULL;
+	{{- if not .StringKey }}
+	char buf[24];
+	{{- end }}
+	if (data == NULL) goto bad;
+	root = cJSON_CreateObject();
+	if (!root) goto bad;
+	for (uint32_t i = 0; i < data->len; i++) {
+		{{.KeyMarshal}}
+		{{.ElemMarshal}}
+		if (!item || !cJSON_AddItemToObject(root, key, item)) goto bad;
+	}
+	return root;
+bad:
+	if (!err->null) MARSHAL_FAILED("{{.WireName}}")
+	if (root) cJSON_Delete(root);
+	return NULL;
+}
+`
+
+const _mapUnmarshalFuncTmpl = `
+void {{.Name}}_unmarshal(struct {{.Name}}* dst, char* data, error_t* err) {
+	cJSON* root = NULL;
+	cJSON* item = NULL;
+	uint32_t i = 0;
+	{{- if not .StringKey }}
+	char* end = NULL;
+	{{- end }}
+
+	root = cJSON_Parse(data);
+	if (!root || !cJSON_IsObject(root)) goto bad;
+	dst->len = cJSON_GetArraySize(root);
+	dst->keys = calloc(dst->len, sizeof(*dst->keys));
+	dst->values = calloc(dst->len, sizeof(*dst->values));
+	{{- if .ElemInit }}
+	for (i = 0; i < dst->len; i++) {
+		{{.ElemInit}}
+	}
+	i = 0;
+	{{- end }}
+	cJSON_ArrayForEach(item, root) {
+		{{.KeyUnmarshal}}
+		{{.ElemUnmarshal}}
+		i++;
+	}
+	cJSON_Delete(root);
+	return;
+bad:
+	if (!err->null) UNMARSHAL_FAILED("{{.WireName}}");
+	if (root) cJSON_Delete(root);
+}
+`
+
+const _mapCloneCTmpl = `
+struct {{.Name}}* {{.Name}}_clone(struct {{.Name}}* src) {
+	if (src == NULL) return NULL;
+	struct {{.Name}}* dst = malloc(sizeof(struct {{.Name}}));
+	dst->len = src->len;
+	dst->keys = malloc(sizeof(*dst->keys) * src->len);
+	dst->values = malloc(sizeof(*dst->values) * src->len);
+	for (uint32_t i = 0; i < src->len; i++) {
+		{{.KeyClone}}
+		{{.ElemClone}}
+	}
+	return dst;
+}`
+
+const _bytesStructTmpl = `
+#ifndef RPCH_BYTES
+#define RPCH_BYTES
+struct bytes {
+	uint32_t len;
+	uint8_t* data;
+};
+#endif
+`
+
+// bytes在json中以base64字符串表示
+const _bytesFuncTmpl = `
+static const char base64_table[] = "ABCDEFGHIJKLMNOPQRSTUVWXYZabcdefghijklmnopqrstuvwxyz0123456789+/";
+
+static inline char* base64_encode(const uint8_t* src, uint32_t len) {
+	char* dst = malloc((size_t)(len + 2) / 3 * 4 + 1);
+	char* p = dst;
+	uint32_t i;
+	if (dst == NULL) return NULL;
+	for (i = 0; i + 2 < len; i += 3) {
+		*p++ = base64_table[src[i] >> 2];
+		*p++ = base64_table[((src[i] & 0x03) << 4) | (src[i + 1] >> 4)];
+		*p++ = base64_table[((src[i + 1] & 0x0f) << 2) | (src[i + 2] >> 6)];
+		*p++ = base64_table[src[i + 2] & 0x3f];
+	}
+	if (i < len) {
+		*p++ = base64_table[src[i] >> 2];
+		if (i + 1 == len) {
+			*p++ = base64_table[(src[i] & 0x03) << 4];
+			*p++ = '=';
+		} else {
+			*p++ = base64_table[((src[i] & 0x03) << 4) | (src[i + 1] >> 4)];
+			*p++ = base64_table[(src[i + 1] & 0x0f) << 2];
+		}
+		*p++ = '=';
+	}
+	*p = '\0';
+	return dst;
+}
+
+static inline int base64_value(char c) {
+	if (c >= 'A' && c <= 'Z') return c - 'A';
+	if (c >= 'a' && c <= 'z') return c - 'a' + 26;
+	if (c >= '0' && c <= '9') return c - '0' + 52;
+	if (c == '+') return 62;
+	if (c == '/') return 63;
+	return -1;
+}
+
+// 解码失败返回0
+static inline int base64_decode(const char* src, struct bytes* dst) {
+	size_t n = strlen(src);
+	uint32_t len = 0;
+	uint8_t* data;
+	int v[4];
+	if (n % 4 != 0) return 0;
+	data = malloc(n / 4 * 3 + 1);
+	if (data == NULL) return 0;
+	for (size_t i = 0; i < n; i += 4) {
+		for (int j = 0; j < 4; j++) {
+			v[j] = base64_value(src[i + j]);
+			// 仅允许最后一组末尾存在填充
+			if (v[j] < 0 && !(src[i + j] == '=' && i + 4 == n && j >= 2)) goto bad;
+		}
+		if (v[2] < 0 && v[3] >= 0) goto bad;
+		data[len++] = (uint8_t)(v[0] << 2 | v[1] >> 4);
+		if (v[2] >= 0) data[len++] = (uint8_t)((v[1] & 0x0f) << 4 | v[2] >> 2);
+		if (v[3] >= 0) data[len++] = (uint8_t)((v[2] & 0x03) << 6 | v[3]);
+	}
+	dst->len = len;
+	dst->data = data;
+	return 1;
+bad:
+	free(data);
+	return 0;
+}
+
+static inline cJSON* bytes_marshal(struct bytes* data) {
+	char* str = base64_encode(data->data, data->len);
+	cJSON* item = str == NULL ? NULL : cJSON_CreateString(str);
+	free(str);
+	return item;
+}
+
+static inline int bytes_unmarshal(struct bytes* dst, cJSON* item) {
+	if (!cJSON_IsString(item)) return 0;
+	return base64_decode(cJSON_GetStringValue(item), dst);
+}
+
+static inline struct bytes bytes_clone(struct bytes* src) {
+	struct bytes dst = {src->len, NULL};
+	if (src->data != NULL) {
+		dst.data = malloc(src->len + 1);
+		memcpy(dst.data, src->data, src->len);
+	}
+	return dst;
+}
+`
+
+const _errorThrowTmpl = `
+void {{.Name}}_throw(error_t* err, struct {{.Name}}* e) {
+	char* msg = NULL;
+	cJSON* data = NULL;
+	cJSON* root = cJSON_CreateObject();
+	if (!root) goto bad;
+	if (cJSON_AddNumberToObject(root, "code", {{.Code}}) == NULL) goto bad;
+	if (cJSON_AddStringToObject(root, "error", "{{.WireName}}") == NULL) goto bad;
+	data = {{.Name}}_marshal(e, err);
+	if (!err->null) goto end;
+	if (!cJSON_AddItemToObject(root, "data", data)) {
+		cJSON_Delete(data);
+		goto bad;
+	}
+	msg = cJSON_PrintUnformatted(root);
+	if (!msg) goto bad;
+	errorf(err, "%s", msg);
+	free(msg);
+	goto end;
+bad:
+	MARSHAL_FAILED("{{.Name}}")
+end:
+	if (root) cJSON_Delete(root);
+}
+`
+
+const _errorCatchTmpl = `
+struct {{.Name}}* {{.Name}}_catch(error_t* err) {
+	struct {{.Name}}* e = NULL;
+	error_t tmp = {.null = 1};
+	cJSON* root = NULL;
+	cJSON* item = NULL;
+	char* data = NULL;
+	if (err->null || err->msg == NULL) return NULL;
+	root = cJSON_Parse(err->msg);
+	if (!root) return NULL;
+	item = cJSON_GetObjectItemCaseSensitive(root, "code");
+	if (!cJSON_IsNumber(item) || item->valueint != {{.Code}}) goto end;
+	item = cJSON_GetObjectItemCaseSensitive(root, "error");
+	if (!cJSON_IsString(item) || strcmp(cJSON_GetStringValue(item), "{{.WireName}}") != 0) goto end;
+	item = cJSON_GetObjectItemCaseSensitive(root, "data");
+	if (!cJSON_IsObject(item)) goto end;
+	data = cJSON_PrintUnformatted(item);
+	if (!data) goto end;
+	e = malloc(sizeof(struct {{.Name}}));
+	{{.Name}}_init(e);
+	{{.Name}}_unmarshal(e, data, &tmp);
+	if (!tmp.null) {
+		{{.Name}}_delete(e);
+		e = NULL;
+	}
+end:
+	free(data);
+	cJSON_Delete(root);
+	return e;
+}
+`
+
+// timestamp为自1970-01-01T00:00:00Z起的秒数以及纳秒数，duration的seconds与nanos符号相同
+const _timeStructTmpl = `
+#ifndef RPCH_TIME
+#define RPCH_TIME
+#include <time.h>
+struct timestamp {
+	int64_t seconds;
+	int32_t nanos;
+};
+struct duration {
+	int64_t seconds;
+	int32_t nanos;
+};
+
+static inline struct timestamp timestamp_now() {
+	struct timespec ts;
+	struct timestamp t = {0, 0};
+	if (timespec_get(&ts, TIME_UTC) == TIME_UTC) {
+		t.seconds = ts.tv_sec;
+		t.nanos = (int32_t)ts.tv_nsec;
+	}
+	return t;
+}
+
+static inline struct duration duration_from_nanos(int64_t ns) {
+	struct duration d = {ns / 1000000000, (int32_t)(ns % 1000000000)};
+	return d;
+}
+
+static inline int64_t duration_to_nanos(struct duration d) {
+	return d.seconds * 1000000000 + d.nanos;
+}
+#endif
+`
+
+// timestamp在json中为UTC时间的RFC3339字符串，如"2006-01-02T15:04:05.999999999Z"，解析时允许时区偏移；duration为纳秒数
+const _timeFuncTmpl = `
+static inline int time_digits(const char* p, int n) {
+	int v = 0;
+	for (int i = 0; i < n; i++) {
+		if (p[i] < '0' || p[i] > '9') return -1;
+		v = v * 10 + p[i] - '0';
+	}
+	return v;
+}
+
+static inline cJSON* timestamp_marshal(struct timestamp* data) {
+	char buf[48];
+	int64_t days = data->seconds / 86400, secs = data->seconds % 86400;
+	if (secs < 0) {
+		secs += 86400;
+		days--;
+	}
+	if (data->nanos < 0 || data->nanos > 999999999) return NULL;
+	// 由1970-01-01起的天数计算年月日
+	int64_t z = days + 719468;
+	int64_t era = (z >= 0 ? z : z - 146096) / 146097;
+	int64_t doe = z - era * 146097;
+	int64_t yoe = (doe - doe / 1460 + doe / 36524 - doe / 146096) / 365;
+	int64_t doy = doe - (365 * yoe + yoe / 4 - yoe / 100);
+	int64_t mp = (5 * doy + 2) / 153;
+	int64_t d = doy - (153 * mp + 2) / 5 + 1;
+	int64_t m = mp < 10 ? mp + 3 : mp - 9;
+	int64_t y = yoe + era * 400 + (m <= 2);
+	if (y < 0 || y > 9999) return NULL;
+	int n = snprintf(buf, sizeof(buf), "%04d-%02d-%02dT%02d:%02d:%02d", (int)y, (int)m, (int)d,
+					 (int)(secs / 3600), (int)(secs / 60 % 60), (int)(secs % 60));
+	if (data->nanos != 0) {
+		n += snprintf(buf + n, sizeof(buf) - n, ".%09d", (int)data->nanos);
+		while (buf[n - 1] == '0') n--;
+	}
+	snprintf(buf + n, sizeof(buf) - n, "Z");
+	return cJSON_CreateString(buf);
+}
+
+static inline int timestamp_unmarshal(struct timestamp* dst, cJSON* item) {
+	const char* p;
+	int y, mo, d, h, mi, s, digits = 0;
+	int64_t nanos = 0, offset = 0;
+	if (!cJSON_IsString(item)) return 0;
+	p = cJSON_GetStringValue(item);
+	if (strlen(p) < 20 || p[4] != '-' || p[7] != '-' || (p[10] != 'T' && p[10] != 't') || p[13] != ':' || p[16] != ':') return 0;
+	y = time_digits(p, 4);
+	mo = time_digits(p + 5, 2);
+	d = time_digits(p + 8, 2);
+	h = time_digits(p + 11, 2);
+	mi = time_digits(p + 14, 2);
+	s = time_digits(p + 17, 2);
+	if (y < 0 || mo < 1 || mo > 12 || d < 1 || d > 31 || h < 0 || h > 23 || mi < 0 || mi > 59 || s < 0 || s > 60) return 0;
+	p += 19;
+	if (*p == '.') {
+		for (p++; *p >= '0' && *p <= '9'; p++, digits++) {
+			if (digits < 9) nanos = nanos * 10 + *p - '0';
+		}
+		if (digits == 0) return 0;
+		for (; digits < 9; digits++) nanos *= 10;
+	}
+	if (*p == 'Z' || *p == 'z') {
+		p++;
+	} else if (*p == '+' || *p == '-') {
+		int oh = time_digits(p + 1, 2), om = -1;
+		if (oh >= 0 && p[3] == ':') om = time_digits(p + 4, 2);
+		if (oh < 0 || oh > 23 || om < 0 || om > 59) return 0;
+		offset = (oh * 60 + om) * 60;
+		if (*p == '-') offset = -offset;
+		p += 6;
+	} else {
+		return 0;
+	}
+	if (*p != '\0') return 0;
+	// 由年月日计算自1970-01-01起的天数
+	int64_t yy = mo <= 2 ? y - 1 : y;
+	int64_t era = (yy >= 0 ? yy : yy - 399) / 400;
+	int64_t yoe = yy - era * 400;
+	int64_t doy = (153 * (mo > 2 ? mo - 3 : mo + 9) + 2) / 5 + d - 1;
+	int64_t doe = yoe * 365 + yoe / 4 - yoe / 100 + doy;
+	int64_t days = era * 146097 + doe - 719468;
+	dst->seconds = days * 86400 + h * 3600 + mi * 60 + s - offset;
+	dst->nanos = (int32_t)nanos;
+	return 1;
+}
+
+static inline cJSON* duration_marshal(struct duration* data) {
+	// 以整数形式输出，避免大的纳秒数被序列化为科学计数法
+	char buf[24];
+	snprintf(buf, sizeof(buf), "%lld", (long long)duration_to_nanos(*data));
+	return cJSON_CreateRaw(buf);
+}
+
+static inline int duration_unmarshal(struct duration* dst, cJSON* item) {
+	if (!cJSON_IsNumber(item)) return 0;
+	*dst = duration_from_nanos((int64_t)item->valuedouble);
+	return 1;
+}
+
+// 解析作为参数或返回值传输的json文本，失败返回0
+static inline int timestamp_parse(struct timestamp* dst, const char* data) {
+	cJSON* item = cJSON_Parse(data);
+	int ok = item != NULL && timestamp_unmarshal(dst, item);
+	cJSON_Delete(item);
+	return ok;
+}
+
+static inline int duration_parse(struct duration* dst, const char* data) {
+	cJSON* item = cJSON_Parse(data);
+	int ok = item != NULL && duration_unmarshal(dst, item);
+	cJSON_Delete(item);
+	return ok;
+}
+`
@@ -8,41 +8,154 @@ import (
 )
 
 var IDLtoCType = map[string]string{
-	"int8":    "int8_t",
-	"int16":   "int16_t",
-	"int32":   "int32_t",
-	"int64":   "int64_t",
-	"uint8":   "uint8_t",
-	"uint16":  "uint16_t",
-	"uint32":  "uint32_t",
-	"uint64":  "uint64_t",
-	"float32": "float",
-	"float64": "double",
-	"void":    "void",
-	"string":  "char*",
+	"int8":      "int8_t",
+	"int16":     "int16_t",
+	"int32":     "int32_t",
+	"int64":     "int64_t",
+	"uint8":     "uint8_t",
+	"uint16":    "uint16_t",
+	"uint32":    "uint32_t",
+	"uint64":    "uint64_t",
+	"float32":   "float",
+	"float64":   "double",
+	"void":      "void",
+	"bool":      "bool",
+	"string":    "char*",
+	"bytes":     "struct bytes",
+	"timestamp": "struct timestamp",
+	"duration":  "struct duration",
+}
+
+// 在init函数中为成员赋默认值的语句，string成员的默认值同样需要在destroy时释放
+func buildDefault(mem *parse.Member) string {
+	var value string
+	switch {
+	case mem.Type.Kind == parse.TypeKindEnum:
+		value = fmt.Sprintf("%s_%s", cTypeName(mem.Type), mem.Default.Value)
+	case mem.Type.Name == "string":
+		value = fmt.Sprintf("strdup(%s)", utils.Quote(mem.Default.Value))
+	default:
+		value = buildLiteral(mem.Type, mem.Default)
+	}
+	return fmt.Sprintf("data->%s = %s;", mem.Name, value)
+}
+
+// 数值常量的字面量，64位整数使用stdint.h中的宏以免超出int的范围
+func buildLiteral(t *parse.Type, v *parse.Literal) string {
+	switch {
+	case t.Name == "int64" && v.Value == "-9223372036854775808":
+		return "INT64_MIN"
+	case t.Name == "int64" && v.Kind == parse.LiteralInt:
+		return fmt.Sprintf("INT64_C(%s)", v.Value)
+	case t.Name == "uint64" && v.Kind == parse.LiteralInt:
+		return fmt.Sprintf("UINT64_C(%s)", v.Value)
+	}
+	return v.Value
+}
+
+// package对应的C符号前缀，如foo.bar对应foo_bar_，未声明package时为空
+var prefix string
+
+func cPrefix(pkg string) string {
+	if pkg == "" {
+		return ""
+	}
+	return strings.ReplaceAll(pkg, ".", "_") + "_"
+}
+
+// 加上package前缀的C符号名
+func cName(name string) string {
+	return prefix + name
 }
 
 func toClangType(t *parse.Type, pointer bool) string {
 	switch t.Kind {
 	case parse.TypeKindNormal:
+		if t.Alias != "" {
+			return cName(t.Alias)
+		}
 		return IDLtoCType[t.Name]
-	case parse.TypeKindMessage:
+	case parse.TypeKindEnum:
+		return "enum " + cTypeName(t)
+	case parse.TypeKindMessage, parse.TypeKindList, parse.TypeKindMap:
 		if pointer {
-			return fmt.Sprintf("struct %s*", t.Name)
+			return fmt.Sprintf("struct %s*", cTypeName(t))
 		} else {
-			return fmt.Sprintf("struct %s", t.Name)
+			return fmt.Sprintf("struct %s", cTypeName(t))
 		}
 	default:
 	}
 	return ""
 }
 
+// 容器类型可能由多个文件共享，元素以及键统一使用底层类型而非typedef的别名
+func unaliased(t *parse.Type) *parse.Type {
+	if t.Alias == "" {
+		return t
+	}
+	u := *t
+	u.Alias = ""
+	return &u
+}
+
+// C代码中使用的类型名，list类型会生成名为<elem>_list的结构体，map类型为<key>_<value>_map。
+// message、enum以及容器类型带有package前缀
+func cTypeName(t *parse.Type) string {
+	if t.Kind == parse.TypeKindNormal {
+		return t.Name
+	}
+	return cName(rawTypeName(t))
+}
+
+// 不带package前缀的类型名
+func rawTypeName(t *parse.Type) string {
+	switch t.Kind {
+	case parse.TypeKindList:
+		return rawTypeName(t.Elem) + "_list"
+	case parse.TypeKindMap:
+		return rawTypeName(t.Key) + "_" + rawTypeName(t.Elem) + "_map"
+	}
+	return t.Name
+}
+
+// 在C中以结构体表示的类型
+func isStruct(t *parse.Type) bool {
+	return t.Kind == parse.TypeKindMessage || isContainer(t)
+}
+
+func isContainer(t *parse.Type) bool {
+	return t.Kind == parse.TypeKindList || t.Kind == parse.TypeKindMap
+}
+
+func isList(t *parse.Type) bool {
+	return t.Kind == parse.TypeKindList
+}
+
+func isArray(t *parse.Type) bool {
+	return t.Kind == parse.TypeKindArray
+}
+
+func isEnum(t *parse.Type) bool {
+	return t.Kind == parse.TypeKindEnum
+}
+
+// 检查enum的值是否合法
+func buildEnumCheck(t *parse.Type, v string) string {
+	return fmt.Sprintf(`if (!%s_valid(%s)) {
+		errorf(err, "invalid value %%d for enum %s", %s);
+		goto end;
+	}`, cTypeName(t), v, t.Name, v)
+}
+
 func buildMethod(method *parse.Method, lastArg string) string {
 	var builder strings.Builder
 	builder.WriteString(toClangType(method.RetType, true))
-	fmt.Fprintf(&builder, " %s_%s(", method.Service.Name, method.Name)
-	for _, t := range method.ReqTypes {
+	fmt.Fprintf(&builder, " %s_%s(", cName(method.Service.Name), method.Name)
+	for i, t := range method.ReqTypes {
 		builder.WriteString(toClangType(t, true))
+		if name := method.ReqNames[i]; name != "" {
+			fmt.Fprintf(&builder, " %s", name)
+		}
 		builder.WriteString(", ")
 	}
 	builder.WriteString(lastArg)
@@ -50,6 +163,14 @@ func buildMethod(method *parse.Method, lastArg string) string {
 	return builder.String()
 }
 
+// 方法修饰符对应的宏，oneway以及超时已由checkMethodOptions拒绝
+func buildMethodMacros(method *parse.Method) (macros []string) {
+	if method.Idempotent {
+		macros = append(macros, fmt.Sprintf("#define %s_%s_IDEMPOTENT 1", cName(method.Service.Name), method.Name))
+	}
+	return
+}
+
 func buildArgDefines(method *parse.Method) []string {
 	defines := make([]string, 0, len(method.ReqTypes)+1)
 	for i, t := range method.ReqTypes {
@@ -57,8 +178,10 @@ func buildArgDefines(method *parse.Method) []string {
 	}
 	var str string
 	t := method.RetType
-	if t.Kind == parse.TypeKindMessage || t.Name == "string" {
+	if isStruct(t) || t.Name == "string" {
 		str = fmt.Sprintf("%s res = NULL;", toClangType(t, true))
+	} else if t.Name == "bytes" {
+		str = "struct bytes res = {0, NULL};"
 	} else {
 		if t.Name == "void" {
 			return defines
@@ -72,8 +195,8 @@ func buildArgDefines(method *parse.Method) []string {
 func buildArgInits(method *parse.Method) []string {
 	strs := []string{}
 	for i, v := range method.ReqTypes {
-		if v.Kind == parse.TypeKindMessage {
-			strs = append(strs, fmt.Sprintf("%s_init(&arg%d);", v.Name, i+1))
+		if isStruct(v) {
+			strs = append(strs, fmt.Sprintf("%s_init(&arg%d);", cTypeName(v), i+1))
 		}
 	}
 	return strs
@@ -82,9 +205,9 @@ func buildArgInits(method *parse.Method) []string {
 func buildArgUnmarshals(method *parse.Method) []string {
 	strs := make([]string, 0, len(method.ReqTypes))
 	for i, t := range method.ReqTypes {
-		if t.Kind == parse.TypeKindMessage {
+		if isStruct(t) {
 			var builder strings.Builder
-			builder.WriteString(fmt.Sprintf("%s_unmarshal(&arg%d, req->args[%d].data, err);", t.Name, i+1, i))
+			builder.WriteString(fmt.Sprintf("%s_unmarshal(&arg%d, req->args[%d].data, err);", cTypeName(t), i+1, i))
 			builder.WriteString("\n\tif (!err->null) goto end;")
 			strs = append(strs, builder.String())
 			continue
@@ -93,7 +216,25 @@ func buildArgUnmarshals(method *parse.Method) []string {
 			strs = append(strs, fmt.Sprintf("arg%d = req->args[%d].data;", i+1, i))
 			continue
 		}
-		strs = append(strs, fmt.Sprintf("arg%d = *(%s*)req->args[%d].data;", i+1, IDLtoCType[t.Name], i))
+		if t.Name == "bytes" {
+			strs = append(strs, fmt.Sprintf("arg%d.data = (uint8_t*)req->args[%d].data;\n\targ%d.len = req->args[%d].data_len;", i+1, i, i+1, i))
+			continue
+		}
+		if t.Name == "bool" {
+			strs = append(strs, fmt.Sprintf("arg%d = *(uint8_t*)req->args[%d].data != 0;", i+1, i))
+			continue
+		}
+		if utils.IsTime(t) {
+			strs = append(strs, fmt.Sprintf(`if (!%s_parse(&arg%d, req->args[%d].data)) {
+		UNMARSHAL_FAILED("%s");
+		goto end;
+	}`, t.Name, i+1, i, t.Name))
+			continue
+		}
+		strs = append(strs, fmt.Sprintf("arg%d = *(%s*)req->args[%d].data;", i+1, IDLtoCType[t.WireName()], i))
+		if isEnum(t) {
+			strs = append(strs, buildEnumCheck(t, fmt.Sprintf("arg%d", i+1)))
+		}
 	}
 	return strs
 }
@@ -103,13 +244,13 @@ func buildArgChecks(method *parse.Method) string {
 	builder.WriteString(fmt.Sprintf("CHECK_ARG_CNT(%d, req->argcnt)", len(method.ReqTypes)))
 	for i, t := range method.ReqTypes {
 		builder.WriteString("\n\t")
-		str := fmt.Sprintf(`CHECK_ARG_TYPE("%s", req->args[%d].type_name)`, t.Name, i)
+		str := fmt.Sprintf(`CHECK_ARG_TYPE("%s", req->args[%d].type_name)`, t.WireName(), i)
 		builder.WriteString(str)
 		builder.WriteString("\n\t")
-		if t.Kind == parse.TypeKindMessage || t.Name == "string" {
+		if isStruct(t) || utils.IsVarLen(t) || utils.IsTime(t) {
 			continue
 		}
-		str = fmt.Sprintf(`CHECK_ARG_SIZE("%s", %d, req->args[%d].data_len)`, t.Name, utils.TypeLength[t.Name], i)
+		str = fmt.Sprintf(`CHECK_ARG_SIZE("%s", %d, req->args[%d].data_len)`, t.WireName(), utils.TypeLength[t.WireName()], i)
 		builder.WriteString(str)
 	}
 	return builder.String()
@@ -118,7 +259,7 @@ func buildArgChecks(method *parse.Method) string {
 func buildCallArgs(method *parse.Method) string {
 	var str string
 	for i, t := range method.ReqTypes {
-		if t.Kind == parse.TypeKindMessage {
+		if isStruct(t) {
 			str += "&"
 		}
 		str += fmt.Sprintf("arg%d, ", i+1)
@@ -130,19 +271,31 @@ func buildCallArgs(method *parse.Method) string {
 func buildResp(method *parse.Method) string {
 	var builder strings.Builder
 	t := method.RetType
-	if t.Kind == parse.TypeKindMessage {
+	if isStruct(t) {
 		builder.WriteString(fmt.Sprintf(`root = %s_marshal(res, err);
     if (!err->null) goto end;
     char* data = cJSON_Print(root);
-    build_resp(resp, %d, "%s", strlen(data), data);`, t.Name, parse.TypeKindMessage, t.Name))
+    build_resp(resp, %d, "%s", strlen(data), data);`, cTypeName(t), parse.TypeKindMessage, t.Name))
+		return builder.String()
+	}
+	if utils.IsTime(t) {
+		builder.WriteString(fmt.Sprintf(`root = %s_marshal(&res);
+	if (root == NULL) {
+		MARSHAL_FAILED("%s")
+		goto end;
+	}
+	char* data = cJSON_Print(root);
+	build_resp(resp, %d, "%s", strlen(data), data);`, t.Name, t.Name, parse.TypeKindMessage, t.Name))
 		return builder.String()
 	}
 	if t.Name == "string" {
 		builder.WriteString(fmt.Sprintf(`build_resp(resp, 0, "string", res == NULL? 0 : strlen(res), res);`))
+	} else if t.Name == "bytes" {
+		builder.WriteString(`build_resp(resp, 0, "bytes", res.len, (char*)res.data);`)
 	} else if t.Name == "void" {
 		builder.WriteString(`build_resp(resp, 4, "", 0, NULL);`)
 	} else {
-		builder.WriteString(fmt.Sprintf(`build_resp(resp, 0, "%s", %d, (char*)&res);`, t.Name, utils.TypeLength[t.Name]))
+		builder.WriteString(fmt.Sprintf(`build_resp(resp, 0, "%s", %d, (char*)&res);`, t.WireName(), utils.TypeLength[t.WireName()]))
 	}
 	return builder.String()
 }
@@ -150,28 +303,34 @@ func buildResp(method *parse.Method) string {
 func buildEnd(method *parse.Method) string {
 	var builder strings.Builder
 	for i, t := range method.ReqTypes {
-		if t.Kind == parse.TypeKindMessage {
-			fmt.Fprintf(&builder, "\n\t%s_destroy(&arg%d);", t.Name, i+1)
+		if isStruct(t) {
+			fmt.Fprintf(&builder, "\n\t%s_destroy(&arg%d);", cTypeName(t), i+1)
 		}
 	}
 	t := method.RetType
 	if t.Name == "string" {
 		fmt.Fprintf(&builder, "\n\tfree(res);")
 	}
-	if t.Kind == parse.TypeKindMessage {
-		fmt.Fprintf(&builder, "\n\tif (res) %s_destroy(res);", t.Name)
+	if t.Name == "bytes" {
+		fmt.Fprintf(&builder, "\n\tfree(res.data);")
+	}
+	if isStruct(t) {
+		fmt.Fprintf(&builder, "\n\tif (res) %s_destroy(res);", cTypeName(t))
 		fmt.Fprintf(&builder, "\n\tfree(res);")
 		fmt.Fprintf(&builder, "\n\tif (root) cJSON_Delete(root);")
 	}
+	if utils.IsTime(t) {
+		fmt.Fprintf(&builder, "\n\tif (root) cJSON_Delete(root);")
+	}
 	return builder.String()
 }
 
 func buildCallFuncSignature(method *parse.Method) string {
 	var builder strings.Builder
 	builder.WriteString(toClangType(method.RetType, true))
-	fmt.Fprintf(&builder, " %s_%s(", method.Service.Name, method.Name)
+	fmt.Fprintf(&builder, " %s_%s(", cName(method.Service.Name), method.Name)
 	for i, t := range method.ReqTypes {
-		fmt.Fprintf(&builder, "%s arg%d, ", toClangType(t, true), i+1)
+		fmt.Fprintf(&builder, "%s %s, ", toClangType(t, true), method.ArgName(i))
 	}
 	builder.WriteString("client_t* client)")
 	return builder.String()
@@ -183,10 +342,14 @@ func buildRespArgDefine(method *parse.Method) string {
 		return ""
 	}
 	var resp string
-	if ret.Kind == parse.TypeKindMessage {
+	if isStruct(ret) {
 		resp = fmt.Sprintf("%s v = NULL;", toClangType(ret, true))
 	} else if ret.Name == "string" {
 		resp = "char* v = NULL;"
+	} else if ret.Name == "bytes" {
+		resp = "struct bytes v = {0, NULL};"
+	} else if utils.IsTime(ret) {
+		resp = fmt.Sprintf("struct %s v = {0, 0};", ret.Name)
 	} else {
 		resp = fmt.Sprintf("%s v = 0;", toClangType(ret, false))
 	}
@@ -194,16 +357,17 @@ func buildRespArgDefine(method *parse.Method) string {
 }
 
 func buildCallRequestInit(method *parse.Method) string {
-	return fmt.Sprintf(`client_request_init(&req, "%s", "%s", %d);`, method.Service.Name, method.Name, len(method.ReqTypes))
+	return fmt.Sprintf(`client_request_init(&req, "%s", "%s", %d);`, infos.Qualify(method.Service.Name), method.Name, len(method.ReqTypes))
 }
 
 func buildCallArgInits(method *parse.Method) (res []string) {
 	var ii int
 	for i, t := range method.ReqTypes {
-		if t.Kind == parse.TypeKindMessage {
+		arg := method.ArgName(i)
+		if isStruct(t) {
 			ii++
 			var builder strings.Builder
-			fmt.Fprintf(&builder, `node%d = %s_marshal(arg%d, &client->err);`, ii, t.Name, i+1)
+			fmt.Fprintf(&builder, `node%d = %s_marshal(%s, &client->err);`, ii, cTypeName(t), arg)
 			fmt.Fprint(&builder, "\n\t")
 			fmt.Fprint(&builder, `if (client_failed(client)) return`)
 			if method.RetType.Name == "void" {
@@ -214,17 +378,34 @@ func buildCallArgInits(method *parse.Method) (res []string) {
 			fmt.Fprint(&builder, "\n\t")
 			fmt.Fprintf(&builder, `data = cJSON_Print(node%d);`, ii)
 			fmt.Fprint(&builder, "\n\t")
-			fmt.Fprintf(&builder, `argument_init_with_option(req.args + %d, %d, "%s", data, strlen(data));`, i, t.Kind, t.Name)
+			fmt.Fprintf(&builder, `argument_init_with_option(req.args + %d, %d, "%s", data, strlen(data));`, i, t.WireKind(), t.Name)
 			res = append(res, builder.String())
 		}
+		if utils.IsTime(t) {
+			ii++
+			ret := " v;"
+			if method.RetType.Name == "void" {
+				ret = ";"
+			}
+			res = append(res, fmt.Sprintf(`node%d = %s_marshal(&%s);
+	if (node%d == NULL) {
+		error_put(&client->err, "marshal struct %s failed");
+		return%s
+	}
+	data = cJSON_Print(node%d);
+	argument_init_with_option(req.args + %d, %d, "%s", data, strlen(data));`, ii, t.Name, arg, ii, t.Name, ret, ii, i, t.WireKind(), t.Name))
+		}
 		var str string
 		if t.Name == "string" {
-			str = fmt.Sprintf(`arg%d = arg%d == NULL ? "" : arg%d;
-	argument_init_with_option(req.args + %d, %d, "%s", arg%d, strlen(arg%d));`, i+1, i+1, i+1,
-				i, t.Kind, t.Name, i+1, i+1)
-		} else if t.Kind == parse.TypeKindNormal {
-			str = fmt.Sprintf(`argument_init_with_option(req.args + %d, %d, "%s", &arg%d, %d);`,
-				i, t.Kind, t.Name, i+1, utils.TypeLength[t.Name])
+			str = fmt.Sprintf(`%s = %s == NULL ? "" : %s;
+	argument_init_with_option(req.args + %d, %d, "%s", %s, strlen(%s));`, arg, arg, arg,
+				i, t.Kind, t.Name, arg, arg)
+		} else if t.Name == "bytes" {
+			str = fmt.Sprintf(`argument_init_with_option(req.args + %d, %d, "%s", (char*)%s.data, %s.len);`,
+				i, t.Kind, t.Name, arg, arg)
+		} else if t.WireKind() == parse.TypeKindNormal {
+			str = fmt.Sprintf(`argument_init_with_option(req.args + %d, %d, "%s", &%s, %d);`,
+				i, t.WireKind(), t.WireName(), arg, utils.TypeLength[t.WireName()])
 		}
 		res = append(res, str)
 	}
@@ -237,10 +418,10 @@ func buildRespCheck(method *parse.Method) string {
 	if ret.Kind == parse.TypeKindNoRTN {
 		return ""
 	}
-	fmt.Fprintf(&builder, `CHECK_ARG_TYPE("%s", resp.type_name)`, ret.Name)
+	fmt.Fprintf(&builder, `CHECK_ARG_TYPE("%s", resp.type_name)`, ret.WireName())
 	builder.WriteByte('\n')
-	if ret.Kind == parse.TypeKindNormal && ret.Name != "string" {
-		fmt.Fprintf(&builder, `	CHECK_ARG_SIZE("%s", %d, resp.data_len)`, ret.Name, utils.TypeLength[ret.Name])
+	if ret.WireKind() == parse.TypeKindNormal && !utils.IsVarLen(ret) {
+		fmt.Fprintf(&builder, `	CHECK_ARG_SIZE("%s", %d, resp.data_len)`, ret.WireName(), utils.TypeLength[ret.WireName()])
 		builder.WriteByte('\n')
 	}
 	return builder.String()
@@ -252,21 +433,425 @@ func buildRespUnmarshal(method *parse.Method) string {
 		return `	v = resp.data;
 	free_data = 0;`
 	}
+	if ret.Name == "bytes" {
+		return `	v.data = (uint8_t*)resp.data;
+	v.len = resp.data_len;
+	free_data = 0;`
+	}
+	if ret.Name == "bool" {
+		return `	v = *(uint8_t*)resp.data != 0;`
+	}
+	if utils.IsTime(ret) {
+		return fmt.Sprintf(`	if (!%s_parse(&v, resp.data)) UNMARSHAL_FAILED("%s");`, ret.Name, ret.Name)
+	}
+	if isEnum(ret) {
+		return fmt.Sprintf(`	memcpy(&v, resp.data, %d);
+	if (!%s_valid(v)) errorf(err, "invalid value %%d for enum %s", v);`, utils.TypeLength[ret.WireName()], cTypeName(ret), ret.Name)
+	}
 	if ret.Kind == parse.TypeKindNormal {
 		return fmt.Sprintf(`	memcpy(&v, resp.data, %d);`, utils.TypeLength[ret.Name])
 	}
+	name := cTypeName(ret)
 	return fmt.Sprintf(`	v = malloc(sizeof(struct %s));
 	%s_init(v);
 	%s_unmarshal(v, resp.data, &client->err);
-	`, ret.Name, ret.Name, ret.Name)
+	`, name, name, name)
 }
 
 func buildAssignment(mem *parse.Member) string {
+	if isArray(mem.Type) {
+		return fmt.Sprintf("memcpy(dst->%s, src->%s, sizeof(dst->%s));", mem.Name, mem.Name, mem.Name)
+	}
 	if mem.Type.Name == "string" {
 		return fmt.Sprintf("dst->%s = src->%s == NULL? NULL : strdup(src->%s);", mem.Name, mem.Name, mem.Name)
 	}
-	if mem.Type.Kind == parse.TypeKindNormal {
+	if mem.Type.Name == "bytes" {
+		return fmt.Sprintf("dst->%s = bytes_clone(&src->%s);", mem.Name, mem.Name)
+	}
+	if mem.Type.WireKind() == parse.TypeKindNormal || utils.IsTime(mem.Type) {
+		if mem.Optional {
+			return fmt.Sprintf("dst->has_%s = src->has_%s;\n\tdst->%s = src->%s;", mem.Name, mem.Name, mem.Name, mem.Name)
+		}
 		return fmt.Sprintf("dst->%s = src->%s;", mem.Name, mem.Name)
 	}
-	return fmt.Sprintf("dst->%s = %s_clone(src->%s);", mem.Name, mem.Type.Name, mem.Name)
+	return fmt.Sprintf("dst->%s = %s_clone(src->%s);", mem.Name, cTypeName(mem.Type), mem.Name)
+}
+
+// 定长数组内联于结构体中，逐个元素序列化为json数组
+func buildArrayMarshal(mem *parse.Member) string {
+	return fmt.Sprintf(`{
+		cJSON* arr = cJSON_AddArrayToObject(root, "%s");
+		if (arr == NULL) goto bad;
+		for (int i = 0; i < %d; i++) {
+			cJSON* item = NULL;
+			%s
+			if (!cJSON_AddItemToArray(arr, item)) goto bad;
+		}
+	}`, mem.JSONName(), mem.Type.Len, strings.ReplaceAll(buildElemMarshal(mem.Type.Elem, mem.Name), "\n", "\n\t"))
+}
+
+// json数组的长度必须与定长数组一致，避免越界写入
+func buildArrayUnmarshal(mem *parse.Member) string {
+	return fmt.Sprintf(`if (!item || !cJSON_IsArray(item) || cJSON_GetArraySize(item) != %d) goto bad;
+	{
+		cJSON* arr = item;
+		int i = 0;
+		cJSON_ArrayForEach(item, arr) {
+			%s
+			i++;
+		}
+	}`, mem.Type.Len, strings.ReplaceAll(buildElemUnmarshal(mem.Type.Elem, mem.Name), "\n", "\n\t"))
+}
+
+// 以下函数用于生成list或map中第i个元素的处理代码，field为元素所在的数组
+
+func buildElemDestroy(t *parse.Type, field string) string {
+	if isStruct(t) {
+		return fmt.Sprintf("%s_destroy(&data->%s[i]);", cTypeName(t), field)
+	}
+	if t.Name == "string" {
+		return fmt.Sprintf("free(data->%s[i]);", field)
+	}
+	if t.Name == "bytes" {
+		return fmt.Sprintf("free(data->%s[i].data);", field)
+	}
+	return ""
+}
+
+func buildElemInit(t *parse.Type, field string) string {
+	if isStruct(t) {
+		return fmt.Sprintf("%s_init(&dst->%s[i]);", cTypeName(t), field)
+	}
+	return ""
+}
+
+func buildElemMarshal(t *parse.Type, field string) string {
+	if isStruct(t) {
+		return fmt.Sprintf(`item = %s_marshal(&data->%s[i], err);
+		if (!err->null) goto bad;`, cTypeName(t), field)
+	}
+	if t.Name == "string" {
+		return fmt.Sprintf(`item = cJSON_CreateString(data->%s[i] == NULL ? "" : data->%s[i]);`, field, field)
+	}
+	if t.Name == "bytes" {
+		return fmt.Sprintf("item = bytes_marshal(&data->%s[i]);", field)
+	}
+	if utils.IsTime(t) {
+		return fmt.Sprintf("item = %s_marshal(&data->%s[i]);", t.Name, field)
+	}
+	if t.Name == "bool" {
+		return fmt.Sprintf("item = cJSON_CreateBool(data->%s[i]);", field)
+	}
+	return fmt.Sprintf("item = cJSON_CreateNumber((double)data->%s[i]);", field)
+}
+
+func buildElemUnmarshal(t *parse.Type, field string) string {
+	if isStruct(t) {
+		check := "cJSON_IsObject"
+		if isList(t) {
+			check = "cJSON_IsArray"
+		}
+		return fmt.Sprintf(`if (!%s(item)) goto bad;
+		data = cJSON_Print(item);
+		%s_unmarshal(&dst->%s[i], data, err);
+		free(data);
+		if (!err->null) goto bad;`, check, cTypeName(t), field)
+	}
+	if t.Name == "string" {
+		return fmt.Sprintf(`if (!cJSON_IsString(item)) goto bad;
+		dst->%s[i] = strdup(cJSON_GetStringValue(item));`, field)
+	}
+	if t.Name == "bytes" {
+		return fmt.Sprintf("if (!bytes_unmarshal(&dst->%s[i], item)) goto bad;", field)
+	}
+	if utils.IsTime(t) {
+		return fmt.Sprintf("if (!%s_unmarshal(&dst->%s[i], item)) goto bad;", t.Name, field)
+	}
+	if t.Name == "bool" {
+		return fmt.Sprintf(`if (!cJSON_IsBool(item)) goto bad;
+		dst->%s[i] = cJSON_IsTrue(item);`, field)
+	}
+	if isEnum(t) {
+		return fmt.Sprintf(`if (!cJSON_IsNumber(item)) goto bad;
+		dst->%s[i] = (enum %s)item->valueint;
+		if (!%s_valid(dst->%s[i])) goto bad;`, field, cTypeName(t), cTypeName(t), field)
+	}
+	value := "valueint"
+	if t.Name == "float32" || t.Name == "float64" {
+		value = "valuedouble"
+	}
+	return fmt.Sprintf(`if (!cJSON_IsNumber(item)) goto bad;
+		dst->%s[i] = (%s)item->%s;`, field, IDLtoCType[t.Name], value)
+}
+
+func buildElemClone(t *parse.Type, field string) string {
+	if isStruct(t) {
+		return fmt.Sprintf(`struct %s* elem = %s_clone(&src->%s[i]);
+		dst->%s[i] = *elem;
+		free(elem);`, cTypeName(t), cTypeName(t), field, field)
+	}
+	if t.Name == "string" {
+		return fmt.Sprintf("dst->%s[i] = src->%s[i] == NULL? NULL : strdup(src->%s[i]);", field, field, field)
+	}
+	if t.Name == "bytes" {
+		return fmt.Sprintf("dst->%s[i] = bytes_clone(&src->%s[i]);", field, field)
+	}
+	return fmt.Sprintf("dst->%s[i] = src->%s[i];", field, field)
+}
+
+// json对象的键只能为字符串，整数类型的键需要与字符串相互转换
+
+func buildKeyMarshal(t *parse.Type) string {
+	if t.Name == "string" {
+		return `key = data->keys[i] == NULL ? "" : data->keys[i];`
+	}
+	if strings.HasPrefix(t.Name, "uint") {
+		return `snprintf(buf, sizeof(buf), "%llu", (unsigned long long)data->keys[i]);
+		key = buf;`
+	}
+	return `snprintf(buf, sizeof(buf), "%lld", (long long)data->keys[i]);
+		key = buf;`
+}
+
+func buildKeyUnmarshal(t *parse.Type) string {
+	if t.Name == "string" {
+		return "dst->keys[i] = strdup(item->string);"
+	}
+	conv := "strtoll"
+	if strings.HasPrefix(t.Name, "uint") {
+		conv = "strtoull"
+	}
+	return fmt.Sprintf(`dst->keys[i] = (%s)%s(item->string, &end, 10);
+		if (end == item->string || *end != '\0') goto bad;`, IDLtoCType[t.Name], conv)
+}
+
+// oneof在C中为带判别字段的union，<oneof名>_case标记当前有值的变体，如Shape_Kind_Circle，没有变体有值时为Shape_Kind_NOT_SET
+
+func oneofCaseType(msg *parse.Message, oneof *parse.Oneof) string {
+	return fmt.Sprintf("%s_%s_case", cName(msg.Name), oneof.Name)
+}
+
+func oneofCase(msg *parse.Message, oneof *parse.Oneof, variant string) string {
+	return fmt.Sprintf("%s_%s_%s", cName(msg.Name), oneof.Name, variant)
+}
+
+// 结构体中oneof对应的判别字段以及union
+func buildOneofFields(msg *parse.Message, oneof *parse.Oneof) []*declaration {
+	var b strings.Builder
+	b.WriteString("union {")
+	for _, mem := range oneof.Mems {
+		fmt.Fprintf(&b, "\n%s\t\t%s %s;", utils.LineComment(utils.DocLines(mem.Doc, mem.Annos), "\t\t"), toClangType(mem.Type, true), mem.Name)
+	}
+	fmt.Fprintf(&b, "\n\t} %s", oneof.Name)
+	return []*declaration{
+		{Doc: utils.LineComment(oneof.Doc, "\t"), Def: fmt.Sprintf("enum %s %s_case", oneofCaseType(msg, oneof), oneof.Name)},
+		{Def: b.String()},
+	}
+}
+
+// 释放oneof中有值的string或message变体
+func buildOneofDestroy(msg *parse.Message, oneof *parse.Oneof) []string {
+	var lines []string
+	for _, mem := range oneof.Mems {
+		field := fmt.Sprintf("data->%s.%s", oneof.Name, mem.Name)
+		cond := fmt.Sprintf("data->%s_case == %s", oneof.Name, oneofCase(msg, oneof, mem.Name))
+		if isStruct(mem.Type) {
+			lines = append(lines, fmt.Sprintf("if (%s) {\n\t\t%s_destroy(%s);\n\t\tfree(%s);\n\t}", cond, cTypeName(mem.Type), field, field))
+		} else if mem.Type.Name == "string" {
+			lines = append(lines, fmt.Sprintf("if (%s) free(%s);", cond, field))
+		}
+	}
+	return lines
+}
+
+// clone时先整体复制union，再深拷贝string和message变体
+func buildOneofAssignment(msg *parse.Message, oneof *parse.Oneof) string {
+	var b strings.Builder
+	fmt.Fprintf(&b, "dst->%s_case = src->%s_case;\n\tdst->%s = src->%s;", oneof.Name, oneof.Name, oneof.Name, oneof.Name)
+	for _, mem := range oneof.Mems {
+		field := fmt.Sprintf("%s.%s", oneof.Name, mem.Name)
+		cond := fmt.Sprintf("src->%s_case == %s", oneof.Name, oneofCase(msg, oneof, mem.Name))
+		if isStruct(mem.Type) {
+			fmt.Fprintf(&b, "\n\tif (%s) dst->%s = %s_clone(src->%s);", cond, field, cTypeName(mem.Type), field)
+		} else if mem.Type.Name == "string" {
+			fmt.Fprintf(&b, "\n\tif (%s) dst->%s = src->%s == NULL? NULL : strdup(src->%s);", cond, field, field, field)
+		}
+	}
+	return b.String()
+}
+
+// 序列化为仅包含当前变体一个键的对象，没有变体有值时不进行序列化
+func buildOneofMarshal(msg *parse.Message, oneof *parse.Oneof) string {
+	var b strings.Builder
+	fmt.Fprintf(&b, "if (data->%s_case != %s) {\n", oneof.Name, oneofCase(msg, oneof, "NOT_SET"))
+	fmt.Fprintf(&b, "\t\tcJSON* variant = cJSON_AddObjectToObject(root, \"%s\");\n", oneof.Name)
+	b.WriteString("\t\tif (variant == NULL) goto bad;\n")
+	fmt.Fprintf(&b, "\t\tswitch (data->%s_case) {\n", oneof.Name)
+	for _, mem := range oneof.Mems {
+		field := fmt.Sprintf("data->%s.%s", oneof.Name, mem.Name)
+		key := utils.Quote(mem.JSONName())
+		fmt.Fprintf(&b, "\t\tcase %s:\n", oneofCase(msg, oneof, mem.Name))
+		switch {
+		case isStruct(mem.Type):
+			fmt.Fprintf(&b, "\t\t\titem = %s_marshal(%s, err);\n", cTypeName(mem.Type), field)
+			b.WriteString("\t\t\tif (!err->null) goto bad;\n")
+			fmt.Fprintf(&b, "\t\t\tif (!cJSON_AddItemToObject(variant, %s, item)) goto bad;\n", key)
+		case mem.Type.Name == "string":
+			fmt.Fprintf(&b, "\t\t\tif (cJSON_AddStringToObject(variant, %s, %s == NULL? \"\" : %s) == NULL) goto bad;\n", key, field, field)
+		case mem.Type.Name == "bool":
+			fmt.Fprintf(&b, "\t\t\tif (cJSON_AddBoolToObject(variant, %s, %s) == NULL) goto bad;\n", key, field)
+		default:
+			fmt.Fprintf(&b, "\t\t\tif (cJSON_AddNumberToObject(variant, %s, (double)%s) == NULL) goto bad;\n", key, field)
+		}
+		b.WriteString("\t\t\tbreak;\n")
+	}
+	b.WriteString("\t\tdefault:\n\t\t\tgoto bad;\n\t\t}\n\t}")
+	return b.String()
+}
+
+// 反序列化时对象至多只能有一个键，且必须为已知的变体
+func buildOneofUnmarshal(msg *parse.Message, oneof *parse.Oneof) string {
+	var b strings.Builder
+	fmt.Fprintf(&b, "item = cJSON_GetObjectItemCaseSensitive(root, \"%s\");\n", oneof.Name)
+	b.WriteString("\tif (item && !cJSON_IsNull(item)) {\n")
+	b.WriteString("\t\tif (!cJSON_IsObject(item) || cJSON_GetArraySize(item) > 1) goto bad;\n")
+	b.WriteString("\t\tif ((item = item->child) != NULL) {\n\t\t\t")
+	for _, mem := range oneof.Mems {
+		field := fmt.Sprintf("dst->%s.%s", oneof.Name, mem.Name)
+		setCase := fmt.Sprintf("dst->%s_case = %s;", oneof.Name, oneofCase(msg, oneof, mem.Name))
+		fmt.Fprintf(&b, "if (strcmp(item->string, %s) == 0) {\n", utils.Quote(mem.JSONName()))
+		var lines []string
+		switch {
+		case isStruct(mem.Type):
+			lines = []string{
+				"if (!cJSON_IsObject(item)) goto bad;",
+				fmt.Sprintf("%s = malloc(sizeof(struct %s));", field, cTypeName(mem.Type)),
+				fmt.Sprintf("%s_init(%s);", cTypeName(mem.Type), field),
+				setCase,
+				"data = cJSON_Print(item);",
+				fmt.Sprintf("%s_unmarshal(%s, data, err);", cTypeName(mem.Type), field),
+				"free(data);",
+				"if (!err->null) goto bad;",
+			}
+		case mem.Type.Name == "string":
+			lines = []string{"if (!cJSON_IsString(item)) goto bad;", setCase, fmt.Sprintf("%s = strdup(cJSON_GetStringValue(item));", field)}
+		case mem.Type.Name == "bool":
+			lines = []string{"if (!cJSON_IsBool(item)) goto bad;", setCase, fmt.Sprintf("%s = cJSON_IsTrue(item);", field)}
+		case isEnum(mem.Type):
+			lines = []string{
+				"if (!cJSON_IsNumber(item)) goto bad;",
+				fmt.Sprintf("%s = (enum %s)item->valueint;", field, cTypeName(mem.Type)),
+				fmt.Sprintf("if (!%s_valid(%s)) goto bad;", cTypeName(mem.Type), field),
+				setCase,
+			}
+		case mem.Type.Name == "float32" || mem.Type.Name == "float64":
+			lines = []string{"if (!cJSON_IsNumber(item)) goto bad;", setCase, fmt.Sprintf("%s = (%s)item->valuedouble;", field, IDLtoCType[mem.Type.Name])}
+		default:
+			lines = []string{"if (!cJSON_IsNumber(item)) goto bad;", setCase, fmt.Sprintf("%s = (%s)item->valueint;", field, IDLtoCType[mem.Type.Name])}
+		}
+		for _, line := range lines {
+			fmt.Fprintf(&b, "\t\t\t\t%s\n", line)
+		}
+		b.WriteString("\t\t\t} else ")
+	}
+	b.WriteString("goto bad;\n\t\t}\n\t}")
+	return b.String()
+}
+
+// 生成校验函数以及handler中的校验语句，fail为校验失败时执行的语句
+type validateBuilder struct {
+	strings.Builder
+	fail string
+}
+
+func (b *validateBuilder) line(depth int, format string, args ...interface{}) {
+	b.WriteString(strings.Repeat("\t", depth))
+	fmt.Fprintf(b, format, args...)
+	b.WriteByte('\n')
+}
+
+// 访问结构体成员的前缀，&arg形式的表达式直接访问arg的成员
+func arrow(p string) string {
+	if strings.HasPrefix(p, "&") {
+		return p[1:] + "."
+	}
+	return p + "->"
+}
+
+// 检查v是否满足约束cs，message、list以及map的v为指针。has为可选成员是否存在的判断条件，非可选时为空
+func (b *validateBuilder) check(depth int, v string, t *parse.Type, has string, cs parse.Constraints, label string) {
+	guard := ""
+	if has != "" {
+		guard = has + " && "
+	}
+	var length string
+	switch {
+	case t.Name == "string":
+		length = fmt.Sprintf("strlen(%s)", v)
+	case t.Name == "bytes":
+		length = v + ".len"
+	case isContainer(t) && strings.HasPrefix(v, "&"):
+		length = arrow(v) + "len"
+	case isContainer(t):
+		// json中的null反序列化为NULL
+		length = fmt.Sprintf("(%s == NULL ? 0 : %slen)", v, arrow(v))
+	}
+	for _, c := range cs {
+		var cond string
+		switch c.Name {
+		case "min":
+			cond = fmt.Sprintf("%s < %s", v, c.Value.Value)
+		case "max":
+			cond = fmt.Sprintf("%s > %s", v, c.Value.Value)
+		case "minlen":
+			cond = fmt.Sprintf("%s < %s", length, c.Value.Value)
+		case "maxlen":
+			cond = fmt.Sprintf("%s > %s", length, c.Value.Value)
+		case "pattern":
+			cond = fmt.Sprintf("!match_pattern(%s, %s)", utils.Quote(c.Value.Value), v)
+		}
+		b.line(depth, "if (%s%s) {", guard, cond)
+		b.line(depth+1, `errorf(err, "%%s", %s);`, utils.Quote(utils.ConstraintError(label, c)))
+		b.line(depth+1, b.fail)
+		b.line(depth, "}")
+	}
+	b.elem(depth, v, t, 0)
+}
+
+// 递归检查message以及list、map中的message，p为指向它们的指针
+func (b *validateBuilder) elem(depth int, p string, t *parse.Type, level int) {
+	if !utils.TypeNeedsValidate(t, allMessages) {
+		return
+	}
+	if t.Kind == parse.TypeKindMessage {
+		b.line(depth, "%s_validate(%s, err);", cName(t.Name), p)
+		b.line(depth, "if (!err->null) %s", b.fail)
+		return
+	}
+	if !strings.HasPrefix(p, "&") {
+		b.line(depth, "if (%s != NULL) {", p)
+		defer b.line(depth, "}")
+		depth++
+	}
+	i := fmt.Sprintf("i%d", level)
+	field := "data"
+	if t.Kind == parse.TypeKindMap {
+		field = "values"
+	}
+	b.line(depth, "for (uint32_t %s = 0; %s < %slen; %s++) {", i, i, arrow(p), i)
+	b.elem(depth+1, fmt.Sprintf("&%s%s[%s]", arrow(p), field, i), t.Elem, level+1)
+	b.line(depth, "}")
+}
+
+// handler中在调用用户实现之前校验参数
+func buildArgValidates(method *parse.Method) string {
+	b := &validateBuilder{fail: "goto end;"}
+	for i, t := range method.ReqTypes {
+		v := fmt.Sprintf("arg%d", i+1)
+		if isStruct(t) {
+			v = "&" + v
+		}
+		b.check(1, v, t, "", method.ReqConstraints[i], method.Service.Name+"."+method.Name+"."+method.ArgName(i))
+	}
+	return b.String()
 }
@@ -8,18 +8,34 @@ import (
 	"gufeijun/hustgen/parse"
 	"io"
 	"path"
+	"strings"
+	"time"
 )
 
 const (
 	RPCH = `rpch "github.com/gufeijun/rpch-go"`
 	IO   = `"io"`
 	JSON = `"encoding/json"`
+	FMT  = `"fmt"`
+	ERRS = `"errors"`
+	BIN  = `"encoding/binary"`
+	TIME = `"time"`
+	RE   = `"regexp"`
+	OS   = `"os"`
 )
 
 var infos *parse.Symbols
 
+// 当前文件以及导入的文件中定义的所有message
+var allMessages map[string]*parse.Message
+
+// stream<Msg>类型对应的Go类型名，由定义该方法的服务名和方法名组成，如UsersWatchStream
+var streamTypes map[*parse.Type]string
+
 func Gen(_infos *parse.Symbols, conf *config.ComplileConfig) error {
 	infos = _infos
+	allMessages = infos.AllMessages()
+	streamTypes = collectStreamTypes()
 	te, err := utils.NewTmplExec(conf, utils.GenFilePath(conf.SrcIDL, conf.OutDir, ".rpch.go"))
 	if err != nil {
 		return err
@@ -28,8 +44,15 @@ func Gen(_infos *parse.Symbols, conf *config.ComplileConfig) error {
 	genStatement(te)
 	genPackage(te)
 	genImports(te)
+	genEnums(te)
+	genConsts(te)
+	genTypedefs(te)
 	genMessages(te)
+	genStreams(te)
 	genServiceInterfaces(te)
+	genServiceValidators(te)
+	genServiceAdapters(te)
+	genServiceUTC(te)
 	genServiceRegisterFunc(te)
 	genInit(te)
 	genClientStruct(te)
@@ -57,28 +80,63 @@ func genClientMethods(te *utils.TmplExec) {
 	for _, s := range infos.Services {
 		for _, method := range s.Methods {
 			data := &struct {
+				Doc         string
 				ServiceName string
+				WireName    string
 				MethodName  string
 				RequestArg  string
 				ResponseArg string
 				Return      string
 				CallArgs    []*CallArg
+				Throws      []string
+				Oneway      bool
+				Timeout     string
 			}{
+				Doc:         utils.LineComment(utils.DocLines(method.Doc, method.Annos), ""),
 				ServiceName: s.Name,
+				WireName:    infos.Qualify(s.Name),
 				MethodName:  method.Name,
-				RequestArg:  buildRequestArgs(method.ReqTypes),
+				RequestArg:  buildRequestArgs(method),
 				ResponseArg: buildResponseArg(method.RetType),
 				Return:      buildReturn(method.RetType),
-				CallArgs:    buildCallArgs(method.ReqTypes),
+				CallArgs:    buildCallArgs(method),
+				Oneway:      method.Oneway,
+			}
+			if d := clientTimeout(method); d != 0 {
+				data.Timeout = buildDuration(d)
+			}
+			for _, e := range method.Throws {
+				data.Throws = append(data.Throws, e.Name)
 			}
 			te.Execute(clientMethodTmpl, data)
 		}
 	}
 }
 
+// 流在调用返回后仍需读写，客户端不为有流参数或返回值的方法设置超时
+func clientTimeout(method *parse.Method) time.Duration {
+	for _, t := range append(method.ReqTypes, method.RetType) {
+		if t.Kind == parse.TypeKindStream {
+			return 0
+		}
+	}
+	return method.Timeout()
+}
+
 func genClientStruct(te *utils.TmplExec) {
 	for _, s := range infos.Services {
-		te.Execute(clientStructTmpl, s.Name)
+		data := &struct {
+			Name       string
+			Timeout    bool
+			Idempotent []string
+		}{Name: s.Name}
+		for _, method := range s.Methods {
+			data.Timeout = data.Timeout || clientTimeout(method) != 0
+			if method.Idempotent {
+				data.Idempotent = append(data.Idempotent, method.Name)
+			}
+		}
+		te.Execute(clientStructTmpl, data)
 	}
 }
 
@@ -102,7 +160,7 @@ func genServiceRegisterFunc(te *utils.TmplExec) {
 	for _, s := range infos.Services {
 		var descs []*MethodDesc
 		for _, method := range s.Methods {
-			tn := method.RetType.Name
+			tn := method.RetType.WireName()
 			if tn == "void" {
 				tn = ""
 			}
@@ -110,54 +168,496 @@ func genServiceRegisterFunc(te *utils.TmplExec) {
 		}
 		data := &struct {
 			Name        string
+			WireName    string
 			MethodDescs []*MethodDesc
+			UTC         bool
+			Validated   bool
+			Adapted     bool
+			Impl        string
 		}{
 			Name:        s.Name,
+			WireName:    infos.Qualify(s.Name),
 			MethodDescs: descs,
+			UTC:         serviceReturnsTimestamp(s),
+			Validated:   serviceNeedsValidate(s),
+			Adapted:     serviceNeedsAdapter(s),
+			Impl:        "impl",
+		}
+		if data.Adapted {
+			data.Impl = "adapted"
 		}
 		te.Execute(serviceRegisterTmpl, data)
 	}
 }
 
+// 为参数需要校验的方法生成校验函数，并生成覆盖这些方法的包装服务
+func genServiceValidators(te *utils.TmplExec) {
+	type Method struct {
+		Name     string
+		Def      string
+		Args     string
+		CallArgs string
+		Body     string
+	}
+	for _, s := range infos.Services {
+		if !serviceNeedsValidate(s) {
+			continue
+		}
+		b := new(validateBuilder)
+		var methods []*Method
+		for _, method := range s.Methods {
+			if !utils.ArgsNeedValidate(method, allMessages) {
+				continue
+			}
+			var args, callArgs []string
+			body := new(validateBuilder)
+			for i, t := range method.ReqTypes {
+				name := method.ArgName(i)
+				args = append(args, fmt.Sprintf("%s %s", name, toGolangType(t, false)))
+				callArgs = append(callArgs, name)
+				body.check(1, name, t, false, method.ReqConstraints[i], s.Name+"."+method.Name+"."+name,
+					fmt.Sprintf("pattern%s_%s_%s", s.Name, method.Name, name))
+			}
+			b.Patterns = append(b.Patterns, body.Patterns...)
+			methods = append(methods, &Method{
+				Name:     method.Name,
+				Def:      buildValidatedMethod(method),
+				Args:     strings.Join(args, ", "),
+				CallArgs: strings.Join(callArgs, ", "),
+				Body:     body.String(),
+			})
+		}
+		te.Execute(serviceValidateTmpl, &struct {
+			Name     string
+			Patterns []string
+			Methods  []*Method
+		}{Name: s.Name, Patterns: b.Patterns, Methods: methods})
+	}
+}
+
+func collectStreamTypes() map[*parse.Type]string {
+	m := make(map[*parse.Type]string)
+	for _, s := range infos.Services {
+		for _, method := range s.Methods {
+			// 继承的方法与定义它的方法共用参数和返回值的类型
+			origin := method
+			if method.Origin != nil {
+				origin = method.Origin
+			}
+			for _, t := range append([]*parse.Type{method.RetType}, method.ReqTypes...) {
+				if t.IsTypedStream() {
+					m[t] = origin.Service.Name + origin.Name + "Stream"
+				}
+			}
+		}
+	}
+	return m
+}
+
+func methodUsesTypedStream(method *parse.Method) bool {
+	for _, t := range append([]*parse.Type{method.RetType}, method.ReqTypes...) {
+		if t.IsTypedStream() {
+			return true
+		}
+	}
+	return false
+}
+
+func serviceUsesTypedStream(s *parse.Service) bool {
+	for _, method := range s.Methods {
+		if methodUsesTypedStream(method) {
+			return true
+		}
+	}
+	return false
+}
+
+// 为当前文件中定义的使用stream<Msg>的方法生成流类型，继承的方法使用基服务所在文件中生成的类型
+func genStreams(te *utils.TmplExec) {
+	for _, s := range infos.Services {
+		for _, method := range s.Methods {
+			if method.Origin != nil {
+				continue
+			}
+			for _, t := range append([]*parse.Type{method.RetType}, method.ReqTypes...) {
+				if !t.IsTypedStream() {
+					continue
+				}
+				te.Execute(streamTmpl, &struct {
+					Name    string
+					Service string
+					Method  string
+					Elem    string
+				}{streamTypes[t], s.Name, method.Name, t.Elem.Name})
+			}
+		}
+	}
+}
+
+// 参数或返回值的类型与rpch传输时使用的类型不同，需要在包装服务中转换
+func needsAdapter(t *parse.Type) bool {
+	return t.IsTypedStream() || t.Kind == parse.TypeKindEnum || t.Alias != ""
+}
+
+func methodNeedsAdapter(method *parse.Method) bool {
+	for _, t := range append([]*parse.Type{method.RetType}, method.ReqTypes...) {
+		if needsAdapter(t) {
+			return true
+		}
+	}
+	return false
+}
+
+func serviceNeedsAdapter(s *parse.Service) bool {
+	for _, method := range s.Methods {
+		if methodNeedsAdapter(method) {
+			return true
+		}
+	}
+	return false
+}
+
+// rpch通过反射调用服务的方法，以传输时使用的类型传入参数并读取返回值，
+// stream<Msg>需要转换为io.Reader，enum转换为int32，typedef转换为底层类型
+func genServiceAdapters(te *utils.TmplExec) {
+	type Method struct {
+		Name     string
+		Def      string
+		CallArgs string
+		Stream   bool
+		Conv     string
+	}
+	for _, s := range infos.Services {
+		if !serviceNeedsAdapter(s) {
+			continue
+		}
+		var methods []*Method
+		for _, method := range s.Methods {
+			if !methodNeedsAdapter(method) {
+				continue
+			}
+			var callArgs []string
+			for i, t := range method.ReqTypes {
+				arg := method.ArgName(i)
+				if t.IsTypedStream() {
+					arg = fmt.Sprintf("&%s{r: %s}", streamTypes[t], arg)
+				} else if needsAdapter(t) {
+					arg = fmt.Sprintf("%s(%s)", toGolangType(t, false), arg)
+				}
+				callArgs = append(callArgs, arg)
+			}
+			ret := method.RetType
+			m := &Method{
+				Name:     method.Name,
+				Def:      buildAdaptedMethod(method),
+				CallArgs: strings.Join(callArgs, ", "),
+				Stream:   ret.IsTypedStream(),
+			}
+			if !m.Stream && needsAdapter(ret) {
+				m.Conv = toGolangWireType(ret)
+			}
+			methods = append(methods, m)
+		}
+		te.Execute(serviceAdapterTmpl, &struct {
+			Name    string
+			Methods []*Method
+		}{s.Name, methods})
+	}
+}
+
+// rpch直接序列化服务返回的值，返回值中的timestamp需要在包装服务中转换为UTC时间
+func genServiceUTC(te *utils.TmplExec) {
+	type Method struct {
+		Name     string
+		Def      string
+		CallArgs string
+		Ret      string
+		UTC      string
+	}
+	for _, s := range infos.Services {
+		var methods []*Method
+		for _, method := range s.Methods {
+			if !hasTimestamp(method.RetType) {
+				continue
+			}
+			var callArgs []string
+			for i := range method.ReqTypes {
+				callArgs = append(callArgs, method.ArgName(i))
+			}
+			methods = append(methods, &Method{
+				Name:     method.Name,
+				Def:      buildValidatedMethod(method),
+				CallArgs: strings.Join(callArgs, ", "),
+				Ret:      toGolangType(method.RetType, false),
+				UTC:      buildUTC("v", method.RetType, "    "),
+			})
+		}
+		if len(methods) == 0 {
+			continue
+		}
+		te.Execute(serviceUTCTmpl, &struct {
+			Name    string
+			Methods []*Method
+		}{s.Name, methods})
+	}
+}
+
+func serviceReturnsTimestamp(s *parse.Service) bool {
+	for _, method := range s.Methods {
+		if hasTimestamp(method.RetType) {
+			return true
+		}
+	}
+	return false
+}
+
+func serviceNeedsValidate(s *parse.Service) bool {
+	for _, method := range s.Methods {
+		if utils.ArgsNeedValidate(method, allMessages) {
+			return true
+		}
+	}
+	return false
+}
+
+// 带有注释的声明，Doc为已经格式化好的注释行
+type declaration struct {
+	Doc string
+	Def string
+}
+
 func genServiceInterfaces(te *utils.TmplExec) {
 	for _, s := range infos.Services {
-		var methods []string
+		var methods []*declaration
 		for _, method := range s.Methods {
-			methods = append(methods, toGolangMethod(method))
+			// 继承的方法通过内嵌基服务的接口获得
+			if method.Origin != nil {
+				continue
+			}
+			methods = append(methods, &declaration{
+				Doc: utils.LineComment(utils.DocLines(method.Doc, method.Annos), "\t"),
+				Def: toGolangMethod(method),
+			})
 		}
 		data := &struct {
+			Doc     string
 			Name    string
-			Methods []string
+			Bases   []string
+			Methods []*declaration
 		}{
+			Doc:     utils.LineComment(utils.DocLines(s.Doc, s.Annos), ""),
 			Name:    s.Name,
+			Bases:   s.BaseNames,
 			Methods: methods,
 		}
 		te.Execute(serviceInterfaceTmpl, data)
 	}
 }
 
+// 包名取IDL中package声明的最后一段，未声明时取输出目录名
 func genPackage(te *utils.TmplExec) {
 	packageName := path.Base(te.Conf.OutDir)
-	if packageName == "/" {
+	if infos.Package != "" {
+		packageName = infos.Package[strings.LastIndex(infos.Package, ".")+1:]
+	} else if packageName == "/" {
 		te.Err = errors.New("outDir can not be /")
 	}
 	io.WriteString(te.W, fmt.Sprintf("package %s\n", packageName))
 }
 
+func genEnums(te *utils.TmplExec) {
+	for _, enum := range infos.Enums {
+		te.Execute(enumTmpl, enum)
+	}
+}
+
+func genConsts(te *utils.TmplExec) {
+	if len(infos.Consts) == 0 {
+		return
+	}
+	var consts []*declaration
+	for _, c := range infos.Consts {
+		consts = append(consts, &declaration{
+			Doc: utils.LineComment(c.Doc, "    "),
+			Def: fmt.Sprintf("%s %s = %s", c.Name, golangNormal(c.Type), buildLiteral(c.Value)),
+		})
+	}
+	te.Execute(constTmpl, consts)
+}
+
+// typedef生成为以底层类型定义的新类型，如type UserID string
+func genTypedefs(te *utils.TmplExec) {
+	for _, def := range infos.Typedefs {
+		te.Execute(typedefTmpl, &declaration{
+			Doc: utils.LineComment(def.Doc, ""),
+			Def: fmt.Sprintf("%s %s", def.Name, golangNormal(def.Type)),
+		})
+	}
+}
+
 func genMessages(te *utils.TmplExec) {
 	for _, message := range infos.Messages {
-		te.Execute(structTmpl, message)
+		s := &struct {
+			Doc     string
+			Name    string
+			Members []*declaration
+		}{Doc: utils.LineComment(utils.DocLines(message.Doc, message.Annos), ""), Name: message.Name}
+		for _, mem := range message.Mems {
+			s.Members = append(s.Members, &declaration{
+				Doc: utils.LineComment(utils.DocLines(mem.Doc, mem.Annos), "    "),
+				Def: buildMember(mem),
+			})
+		}
+		for _, oneof := range message.Oneofs {
+			s.Members = append(s.Members, &declaration{
+				Doc: utils.LineComment(oneof.Doc, "    "),
+				Def: fmt.Sprintf("%s is%s_%s `json:\"%s,omitempty\"`", oneof.Name, message.Name, oneof.Name, oneof.Name),
+			})
+		}
+		te.Execute(structTmpl, s)
+		for _, oneof := range message.Oneofs {
+			genOneof(te, message, oneof)
+		}
+		defaults := utils.HasDefaults(message, allMessages)
+		if defaults {
+			te.Execute(constructorTmpl, &struct {
+				Name   string
+				Fields []string
+			}{Name: message.Name, Fields: buildDefaults(message)})
+		}
+		if defaults || len(message.Oneofs) != 0 {
+			te.Execute(unmarshalTmpl, &struct {
+				Name     string
+				Defaults bool
+				Oneofs   []*parse.Oneof
+			}{Name: message.Name, Defaults: defaults, Oneofs: message.Oneofs})
+		}
+		if fields := buildMarshalUTC(message); len(fields) != 0 {
+			te.Execute(marshalTmpl, &struct {
+				Name   string
+				Fields []string
+			}{Name: message.Name, Fields: fields})
+		}
+		if utils.NeedsValidate(message, allMessages) {
+			genValidate(te, message)
+		}
+		if e, ok := infos.Errors[message.Name]; ok {
+			te.Execute(errorTmpl, &struct {
+				Name     string
+				WireName string
+				Code     int32
+			}{Name: e.Name, WireName: infos.Qualify(e.Name), Code: e.Code})
+		}
 	}
 }
 
+func genValidate(te *utils.TmplExec, message *parse.Message) {
+	b := new(validateBuilder)
+	for _, mem := range message.Mems {
+		b.check(1, "x."+mem.Name, mem.Type, mem.Optional, mem.Constraints, message.QualName()+"."+mem.Name,
+			fmt.Sprintf("pattern%s_%s", message.Name, mem.Name))
+	}
+	for _, oneof := range message.Oneofs {
+		var variants []*parse.Member
+		for _, mem := range oneof.Mems {
+			if utils.TypeNeedsValidate(mem.Type, allMessages) {
+				variants = append(variants, mem)
+			}
+		}
+		if len(variants) == 0 {
+			continue
+		}
+		b.line(1, "switch v := x.%s.(type) {", oneof.Name)
+		for _, mem := range variants {
+			b.line(1, "case *%s_%s:", message.Name, mem.Name)
+			b.elem(2, "v."+mem.Name, mem.Type, 1)
+		}
+		b.line(1, "}")
+	}
+	te.Execute(validateTmpl, &struct {
+		Name     string
+		Patterns []string
+		Body     string
+	}{Name: message.Name, Patterns: b.Patterns, Body: b.String()})
+}
+
+func genOneof(te *utils.TmplExec, message *parse.Message, oneof *parse.Oneof) {
+	type Variant struct {
+		Name string
+		Doc  string
+		Def  string
+	}
+	data := &struct {
+		Message  string
+		Name     string
+		Variants []*Variant
+	}{Message: message.Name, Name: oneof.Name}
+	for _, mem := range oneof.Mems {
+		data.Variants = append(data.Variants, &Variant{
+			Name: mem.Name,
+			Doc:  utils.LineComment(utils.DocLines(mem.Doc, mem.Annos), ""),
+			Def:  buildMember(mem),
+		})
+	}
+	te.Execute(oneofTmpl, data)
+}
+
 func genImports(te *utils.TmplExec) {
+	// 有默认值或oneof的message需要实现UnmarshalJSON，oneof反序列化失败时需要fmt构造错误。
+	// 有timestamp成员的message需要实现MarshalJSON，error需要以json编码错误信息，并通过errors匹配
+	var addJson, addFmt bool
+	for _, msg := range infos.Messages {
+		addJson = addJson || utils.HasDefaults(msg, allMessages) || len(msg.Oneofs) != 0
+		addFmt = addFmt || len(msg.Oneofs) != 0
+		addJson = addJson || len(buildMarshalUTC(msg)) != 0
+	}
+	addErrors := len(infos.Errors) != 0
+	addJson = addJson || addErrors
+	addTime := useTime()
+	// 有超时时间的方法需要time以及os.ErrDeadlineExceeded
+	var addOS bool
+	utils.TraverseMethod(infos, func(method *parse.Method) bool {
+		addOS = clientTimeout(method) != 0
+		return addOS
+	})
+	// 校验失败时通过errors构造错误，pattern约束需要regexp
+	addErrors = addErrors || useValidate()
+	addRegexp := usePattern()
 	if len(infos.Services) == 0 {
+		// 注册message时同样需要rpch
+		if len(infos.Messages) == 0 {
+			return
+		}
+		var imports []string
+		if addJson {
+			imports = append(imports, JSON)
+		}
+		if addFmt {
+			imports = append(imports, FMT)
+		}
+		if addErrors {
+			imports = append(imports, ERRS)
+		}
+		if addRegexp {
+			imports = append(imports, RE)
+		}
+		if addTime {
+			imports = append(imports, TIME)
+		}
+		te.Execute(importTmpl, append(imports, RPCH))
 		return
 	}
+	// 定义流类型时需要以json编码消息，并以binary编码长度前缀
+	var addBinary bool
+	for _, s := range infos.Services {
+		for _, method := range s.Methods {
+			addBinary = addBinary || method.Origin == nil && methodUsesTypedStream(method)
+		}
+	}
+	addJson = addJson || addBinary
 	var addIO bool
-	var addJson bool
 	utils.TraverseMethod(infos, func(method *parse.Method) bool {
-		if method.RetType.Kind == parse.TypeKindMessage {
+		if method.RetType.WireKind() == parse.TypeKindMessage {
 			addJson = true
 		}
 		for _, t := range append(method.ReqTypes, method.RetType) {
@@ -174,6 +674,80 @@ func genImports(te *utils.TmplExec) {
 	if addJson {
 		imports = append(imports, JSON)
 	}
+	if addBinary {
+		imports = append(imports, BIN)
+	}
+	if addFmt {
+		imports = append(imports, FMT)
+	}
+	if addErrors {
+		imports = append(imports, ERRS)
+	}
+	if addRegexp {
+		imports = append(imports, RE)
+	}
+	if addOS {
+		imports = append(imports, OS)
+	}
+	if addTime || addOS {
+		imports = append(imports, TIME)
+	}
 	imports = append(imports, RPCH)
 	te.Execute(importTmpl, imports)
 }
+
+// 当前文件的message成员以及方法参数、返回值中是否使用了timestamp或duration
+func useTime() bool {
+	var use bool
+	check := func(t *parse.Type) {
+		for ; t.Kind == parse.TypeKindList || t.Kind == parse.TypeKindMap; t = t.Elem {
+		}
+		use = use || utils.IsTime(t)
+	}
+	for _, msg := range infos.Messages {
+		for _, mem := range msg.Mems {
+			check(mem.Type)
+		}
+	}
+	utils.TraverseMethod(infos, func(method *parse.Method) bool {
+		for _, t := range append(method.ReqTypes, method.RetType) {
+			check(t)
+		}
+		return use
+	})
+	return use
+}
+
+// 当前文件中是否有需要校验的message或方法
+func useValidate() bool {
+	for _, msg := range infos.Messages {
+		if utils.NeedsValidate(msg, allMessages) {
+			return true
+		}
+	}
+	for _, s := range infos.Services {
+		if serviceNeedsValidate(s) {
+			return true
+		}
+	}
+	return false
+}
+
+// 当前文件的message成员以及方法参数是否使用了pattern约束
+func usePattern() bool {
+	for _, msg := range infos.Messages {
+		for _, mem := range msg.Mems {
+			if mem.Constraints.Get("pattern") != nil {
+				return true
+			}
+		}
+	}
+	var use bool
+	utils.TraverseMethod(infos, func(method *parse.Method) bool {
+		for _, cs := range method.ReqConstraints {
+			use = use || cs.Get("pattern") != nil
+		}
+		return use
+	})
+	return use
+}
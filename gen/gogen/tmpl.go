@@ -7,8 +7,21 @@ import (
 var (
 	statementTmpl        = must(_statementTmpl)
 	structTmpl           = must(_structTmpl)
+	constructorTmpl      = must(_constructorTmpl)
+	unmarshalTmpl        = must(_unmarshalTmpl)
+	marshalTmpl          = must(_marshalTmpl)
+	oneofTmpl            = must(_oneofTmpl)
+	errorTmpl            = must(_errorTmpl)
+	validateTmpl         = must(_validateTmpl)
+	enumTmpl             = must(_enumTmpl)
+	constTmpl            = must(_constTmpl)
+	typedefTmpl          = must(_typedefTmpl)
 	importTmpl           = must(_importTmpl)
 	serviceInterfaceTmpl = must(_serviceInterfaceTmpl)
+	serviceValidateTmpl  = must(_serviceValidateTmpl)
+	serviceAdapterTmpl   = must(_serviceAdapterTmpl)
+	serviceUTCTmpl       = must(_serviceUTCTmpl)
+	streamTmpl           = must(_streamTmpl)
 	serviceRegisterTmpl  = must(_serviceRegisterTmpl)
 	initTmpl             = must(_initTmpl)
 	clientStructTmpl     = must(_clientStructTmpl)
@@ -26,12 +39,189 @@ const _statementTmpl = `// This is code generated by hgen. DO NOT EDIT!!!
 `
 
 const _structTmpl = `
-type {{.Name}} struct{ 
-{{- range $k,$v:=.Mems }} 
-    {{.Name}} {{.Type.Name}}
+{{.Doc}}type {{.Name}} struct{ 
+{{- range .Members }} 
+{{.Doc}}    {{.Def}}
 {{- end }}
 }
 `
+
+const _constructorTmpl = `
+func New{{.Name}}() *{{.Name}} {
+    return &{{.Name}}{
+    {{- range .Fields }}
+        {{.}},
+    {{- end }}
+    }
+}
+`
+
+// 有默认值时先以默认值初始化，json中缺少的成员保持默认值。oneof先以原始json接收，再根据其中唯一的键确定变体
+const _unmarshalTmpl = `
+func (x *{{.Name}}) UnmarshalJSON(data []byte) error {
+    type plain {{.Name}}
+{{- if .Defaults }}
+    *x = *New{{.Name}}()
+{{- end }}
+{{- if not .Oneofs }}
+    return json.Unmarshal(data, (*plain)(x))
+{{- else }}
+    v := &struct {
+        *plain
+    {{- range .Oneofs }}
+        {{.Name}} json.RawMessage
+    {{- end }}
+    }{plain: (*plain)(x)}
+    if err := json.Unmarshal(data, v); err != nil {
+        return err
+    }
+    {{- range .Oneofs }}
+    if err := x.unmarshal{{.Name}}(v.{{.Name}}); err != nil {
+        return err
+    }
+    {{- end }}
+    return nil
+{{- end }}
+}
+{{- range .Oneofs }}
+
+func (x *{{$.Name}}) unmarshal{{.Name}}(data json.RawMessage) error {
+    x.{{.Name}} = nil
+    if len(data) == 0 {
+        return nil
+    }
+    var variants map[string]json.RawMessage
+    if err := json.Unmarshal(data, &variants); err != nil {
+        return err
+    }
+    if len(variants) > 1 {
+        return fmt.Errorf("oneof {{.Name}} of message {{$.Name}} has more than one member")
+    }
+    for key, value := range variants {
+        switch key {
+        {{- $oneof := . }}
+        {{- range .Mems }}
+        case "{{.JSONName}}":
+            variant := new({{$.Name}}_{{.Name}})
+            x.{{$oneof.Name}} = variant
+            return json.Unmarshal(value, &variant.{{.Name}})
+        {{- end }}
+        default:
+            return fmt.Errorf("unknown member %q of oneof {{.Name}} in message {{$.Name}}", key)
+        }
+    }
+    return nil
+}
+{{- end }}
+`
+
+// time.Time序列化时保留本地时区，timestamp成员需先转换为UTC时间
+const _marshalTmpl = `
+func (x {{.Name}}) MarshalJSON() ([]byte, error) {
+    type plain {{.Name}}
+    v := plain(x)
+{{- range .Fields }}
+    {{.}}
+{{- end }}
+    return json.Marshal(v)
+}
+`
+
+// oneof在Go中为接口，每个变体为实现了该接口的结构体，序列化时结构体仅包含变体一个键
+const _oneofTmpl = `
+type is{{.Message}}_{{.Name}} interface {
+    is{{.Message}}_{{.Name}}()
+}
+{{- range .Variants }}
+
+{{.Doc}}type {{$.Message}}_{{.Name}} struct {
+    {{.Def}}
+}
+
+func (*{{$.Message}}_{{.Name}}) is{{$.Message}}_{{$.Name}}() {}
+{{- end }}
+`
+
+const _errorTmpl = `
+func (*{{.Name}}) ErrorCode() int32 {
+    return {{.Code}}
+}
+
+// 错误信息以json编码，客户端据此还原为*{{.Name}}
+func (x *{{.Name}}) Error() string {
+    data, _ := json.Marshal(x)
+    return ` + "`" + `{"code":{{.Code}},"error":"{{.WireName}}","data":` + "`" + ` + string(data) + "}"
+}
+
+func Is{{.Name}}(err error) bool {
+    var e *{{.Name}}
+    return errors.As(err, &e)
+}
+
+// 将服务端返回的错误还原为*{{.Name}}，不是{{.Name}}时返回nil
+func decode{{.Name}}(err error) *{{.Name}} {
+    if err == nil {
+        return nil
+    }
+    var v struct {
+        Code  int32           ` + "`" + `json:"code"` + "`" + `
+        Error string          ` + "`" + `json:"error"` + "`" + `
+        Data  json.RawMessage ` + "`" + `json:"data"` + "`" + `
+    }
+    if json.Unmarshal([]byte(err.Error()), &v) != nil || v.Code != {{.Code}} || v.Error != "{{.WireName}}" {
+        return nil
+    }
+    x := new({{.Name}})
+    if json.Unmarshal(v.Data, x) != nil {
+        return nil
+    }
+    return x
+}
+`
+
+const _validateTmpl = `{{ if .Patterns }}
+var (
+{{- range .Patterns }}
+    {{.}}
+{{- end }}
+)
+{{ end }}
+// 检查成员是否满足IDL中声明的约束，服务端在调用用户实现之前自动进行检查
+func (x *{{.Name}}) Validate() error {
+{{.Body}}    return nil
+}
+`
+
+const _enumTmpl = `
+type {{.Name}} int32
+
+const (
+{{- range .Mems }}
+    {{$.Name}}_{{.Name}} {{$.Name}} = {{.Value}}
+{{- end }}
+)
+
+func (x {{.Name}}) IsValid() bool {
+    switch x {
+    case {{ range $k,$v:=.Mems }}{{ if ne $k 0 }}, {{ end }}{{$.Name}}_{{.Name}}{{ end }}:
+        return true
+    }
+    return false
+}
+`
+
+const _constTmpl = `
+const (
+{{- range . }}
+{{.Doc}}    {{.Def}}
+{{- end }}
+)
+`
+
+const _typedefTmpl = `
+{{.Doc}}type {{.Def}}
+`
+
 const _importTmpl = `
 import (
 {{- range . }}
@@ -41,23 +231,162 @@ import (
 `
 
 const _serviceInterfaceTmpl = `
-type {{.Name}}Service interface{
+{{.Doc}}type {{.Name}}Service interface{
+{{- range .Bases}}
+	{{.}}Service
+{{- end}}
 {{- range .Methods}}
-	{{ . }}
+{{.Doc}}	{{ .Def }}
  {{- end}}
 }
 `
 
+// 注册服务时以该类型包装用户实现，在调用实现之前检查参数
+const _serviceValidateTmpl = `{{ if .Patterns }}
+var (
+{{- range .Patterns }}
+    {{.}}
+{{- end }}
+)
+{{ end }}
+type validated{{.Name}}Service struct {
+    {{.Name}}Service
+}
+{{- range .Methods }}
+
+func validate{{$.Name}}{{.Name}}({{.Args}}) error {
+{{.Body}}    return nil
+}
+
+func (impl validated{{$.Name}}Service) {{.Def}} {
+    if err = validate{{$.Name}}{{.Name}}({{.CallArgs}}); err != nil {
+        return
+    }
+    return impl.{{$.Name}}Service.{{.Name}}({{.CallArgs}})
+}
+{{- end }}
+`
+
+// 以rpch传输时使用的类型实现方法的包装服务：stream<Msg>为io.Reader，enum为int32，typedef为底层类型
+const _serviceAdapterTmpl = `
+type adapted{{.Name}}Service struct {
+    {{.Name}}Service
+}
+{{- range .Methods }}
+
+func (impl adapted{{$.Name}}Service) {{.Def}} {
+{{- if .Stream }}
+    stream, onFinish, err := impl.{{$.Name}}Service.{{.Name}}({{.CallArgs}})
+    if stream == nil {
+        return nil, onFinish, err
+    }
+    return stream.r, onFinish, err
+{{- else if .Conv }}
+    res, err := impl.{{$.Name}}Service.{{.Name}}({{.CallArgs}})
+    return {{.Conv}}(res), err
+{{- else }}
+    return impl.{{$.Name}}Service.{{.Name}}({{.CallArgs}})
+{{- end }}
+}
+{{- end }}
+`
+
+// 注册服务时以该类型包装用户实现，返回值中的timestamp转换为UTC时间后再由rpch序列化
+const _serviceUTCTmpl = `
+type utc{{.Name}}Service struct {
+    {{.Name}}Service
+}
+{{- range .Methods }}
+
+func (impl utc{{$.Name}}Service) {{.Def}} {
+    return utc{{$.Name}}{{.Name}}(impl.{{$.Name}}Service.{{.Name}}({{.CallArgs}}))
+}
+
+func utc{{$.Name}}{{.Name}}(v {{.Ret}}, err error) ({{.Ret}}, error) {
+    return {{.UTC}}, err
+}
+{{- end }}
+`
+
+const _streamTmpl = `
+// {{.Name}}为{{.Service}}.{{.Method}}中传输的{{.Elem}}流，每条消息编码为4字节小端长度前缀加json
+type {{.Name}} struct {
+    r io.Reader
+    w io.WriteCloser
+}
+
+// 创建流，Send写入的消息可以依次通过Recv读出，发送完毕后需要调用Close
+func New{{.Name}}() *{{.Name}} {
+    r, w := io.Pipe()
+    return &{{.Name}}{r: r, w: w}
+}
+
+// 写入一条消息，阻塞至消息被读出
+func (s *{{.Name}}) Send(v *{{.Elem}}) error {
+    if s.w == nil {
+        return io.ErrClosedPipe
+    }
+    data, err := json.Marshal(v)
+    if err != nil {
+        return err
+    }
+    var head [4]byte
+    binary.LittleEndian.PutUint32(head[:], uint32(len(data)))
+    if _, err = s.w.Write(head[:]); err != nil {
+        return err
+    }
+    _, err = s.w.Write(data)
+    return err
+}
+
+// 读取下一条消息，流结束时返回io.EOF
+func (s *{{.Name}}) Recv() (*{{.Elem}}, error) {
+    var head [4]byte
+    if _, err := io.ReadFull(s.r, head[:]); err != nil {
+        return nil, err
+    }
+    data := make([]byte, binary.LittleEndian.Uint32(head[:]))
+    if _, err := io.ReadFull(s.r, data); err != nil {
+        if err == io.EOF {
+            err = io.ErrUnexpectedEOF
+        }
+        return nil, err
+    }
+    v := new({{.Elem}})
+    return v, json.Unmarshal(data, v)
+}
+
+// 发送方结束发送，或者接收方不再读取剩余的消息
+func (s *{{.Name}}) Close() error {
+    if s.w != nil {
+        return s.w.Close()
+    }
+    if c, ok := s.r.(io.Closer); ok {
+        return c.Close()
+    }
+    return nil
+}
+`
+
 const _serviceRegisterTmpl = `
 func Register{{.Name}}Service(impl {{.Name}}Service, svr *rpch.Server) {
+{{- if .UTC }}
+	impl = utc{{.Name}}Service{impl}
+{{- end }}
+{{- if .Validated }}
+	impl = validated{{.Name}}Service{impl}
+{{- end }}
+{{- if .Adapted }}
+	adapted := adapted{{.Name}}Service{impl}
+{{- end }}
 	methods := map[string]*rpch.MethodDesc {
     {{- range .MethodDescs }}
-        "{{ .MethodName }}": rpch.BuildMethodDesc(impl, "{{ .MethodName }}", "{{.RetTypeName}}"),
+        "{{ .MethodName }}": rpch.BuildMethodDesc({{$.Impl}}, "{{ .MethodName }}", "{{.RetTypeName}}"),
     {{- end }}
 	}
 	service := &rpch.Service{
-		Impl:    impl,
-        Name:    "{{ .Name }}",
+		Impl:    {{.Impl}},
+        Name:    "{{ .WireName }}",
 		Methods: methods,
 	}
 	svr.Register(service)
@@ -73,19 +402,59 @@ func init() {
 `
 
 const _clientStructTmpl = `
-type {{ . }}ServiceClient struct{
+type {{ .Name }}ServiceClient struct{
     conn *rpch.Conn
 }
 
-func New{{ . }}ServiceClient(conn *rpch.Conn) *{{ . }}ServiceClient {
-    return &{{ . }}ServiceClient{
+func New{{ .Name }}ServiceClient(conn *rpch.Conn) *{{ .Name }}ServiceClient {
+    return &{{ .Name }}ServiceClient{
 		conn: conn,
 	}
 }
+{{- if .Timeout }}
+
+// 超时后返回os.ErrDeadlineExceeded，不再等待服务端的响应。
+// ch带有缓冲，超时后发送请求的goroutine仍能写入迟到的响应并退出，迟到的响应取出后丢弃，可关闭的响应先关闭
+func (c *{{ .Name }}ServiceClient) callTimeout(timeout time.Duration, call func() (interface{}, error)) (interface{}, error) {
+	type result struct {
+		resp interface{}
+		err  error
+	}
+	ch := make(chan result, 1)
+	go func() {
+		resp, err := call()
+		ch <- result{resp, err}
+	}()
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+	select {
+	case r := <-ch:
+		return r.resp, r.err
+	case <-timer.C:
+		go func() {
+			if closer, ok := (<-ch).resp.(interface{ Close() error }); ok {
+				closer.Close()
+			}
+		}()
+		return nil, os.ErrDeadlineExceeded
+	}
+}
+{{- end }}
+{{- if .Idempotent }}
+
+// 方法是否为idempotent，调用失败时可以安全地重试
+func Is{{ .Name }}Idempotent(method string) bool {
+	switch method {
+	case {{ range $i, $m := .Idempotent }}{{ if ne $i 0 }}, {{ end }}"{{ $m }}"{{ end }}:
+		return true
+	}
+	return false
+}
+{{- end }}
 `
 const _clientMethodTmpl = `
-func (c *{{.ServiceName}}ServiceClient) {{ .MethodName }}({{.RequestArg}}) ({{.ResponseArg}}) {
-    resp, err := c.conn.Call("{{.ServiceName}}", "{{.MethodName}}"{{ if ne (len .CallArgs) 0}},{{ end }}
+{{- define "call" -}}
+    c.conn.Call("{{.WireName}}", "{{.MethodName}}"{{ if ne (len .CallArgs) 0}},{{ end }}
     {{- range $k,$v:=.CallArgs -}}
         {{- if ne $k 0 -}},{{ end }}
 		&rpch.RequestArg{
@@ -94,9 +463,31 @@ func (c *{{.ServiceName}}ServiceClient) {{ .MethodName }}({{.RequestArg}}) ({{.R
             Data:     {{.Data}},
 		}
     {{- end -}})
+{{- end }}
+{{.Doc}}func (c *{{.ServiceName}}ServiceClient) {{ .MethodName }}({{.RequestArg}}) ({{.ResponseArg}}) {
+	{{- if .Oneway }}
+	// oneway的方法不等待服务端的响应
+	go {{ template "call" . }}
+	return
+}
+{{- else }}
+	{{- if .Timeout }}
+    resp, err := c.callTimeout({{ .Timeout }}, func() (interface{}, error) {
+		return {{ template "call" . }}
+	})
+	{{- else }}
+    resp, err := {{ template "call" . }}
+	{{- end }}
+	{{- range .Throws }}
+	if e := decode{{.}}(err); e != nil {
+		err = e
+		return
+	}
+	{{- end }}
 	if resp == nil {
 		return
 	}
 	{{ .Return }}
 }
+{{- end }}
 `
@@ -2,8 +2,10 @@ package gogen
 
 import (
 	"fmt"
+	"gufeijun/hustgen/gen/utils"
 	"gufeijun/hustgen/parse"
 	"strings"
+	"time"
 )
 
 var toGlangMap1 = map[string]string{
@@ -18,26 +20,150 @@ var toGlangMap2 = map[string]string{
 	"stream":  "io.ReadWriteCloser",
 }
 
-func buildCallArgs(reqTypes []*parse.Type) (callArgs []*CallArg) {
-	for i, t := range reqTypes {
+// 与IDL中名称不同的内置类型
+var toGlangBuiltin = map[string]string{
+	"bytes":     "[]byte",
+	"timestamp": "time.Time",
+	"duration":  "time.Duration",
+}
+
+func golangBuiltin(name string) string {
+	if t, ok := toGlangBuiltin[name]; ok {
+		return t
+	}
+	return name
+}
+
+// 数值、bool、string以及bytes类型对应的Go类型，typedef使用别名
+func golangNormal(t *parse.Type) string {
+	if t.Alias != "" {
+		return t.Alias
+	}
+	return golangBuiltin(t.Name)
+}
+
+// 构造函数中需要初始化的成员，包括有默认值的成员以及有默认值的message成员
+func buildDefaults(msg *parse.Message) []string {
+	var fields []string
+	for _, mem := range msg.Mems {
+		switch {
+		case mem.Default != nil && mem.Type.Kind == parse.TypeKindEnum:
+			fields = append(fields, fmt.Sprintf("%s: %s_%s", mem.Name, mem.Type.Name, mem.Default.Value))
+		case mem.Default != nil:
+			fields = append(fields, fmt.Sprintf("%s: %s", mem.Name, buildLiteral(mem.Default)))
+		case mem.Type.Kind == parse.TypeKindMessage && !mem.Optional && utils.HasDefaults(allMessages[mem.Type.Name], allMessages):
+			fields = append(fields, fmt.Sprintf("%s: *New%s()", mem.Name, mem.Type.Name))
+		}
+	}
+	return fields
+}
+
+func buildLiteral(v *parse.Literal) string {
+	if v.Kind == parse.LiteralString {
+		return utils.Quote(v.Value)
+	}
+	return v.Value
+}
+
+func buildCallArgs(method *parse.Method) (callArgs []*CallArg) {
+	for i, t := range method.ReqTypes {
+		data := method.ArgName(i)
+		if t.Kind == parse.TypeKindEnum {
+			data = fmt.Sprintf("int32(%s)", data)
+		} else if t.IsTypedStream() {
+			data += ".r"
+		} else if t.Alias != "" {
+			data = fmt.Sprintf("%s(%s)", golangBuiltin(t.Name), data)
+		} else {
+			data = buildUTC(data, t, "            ")
+		}
 		callArgs = append(callArgs, &CallArg{
-			TypeKind: t.Kind,
-			TypeName: t.Name,
-			Data:     fmt.Sprintf("arg%d", i+1),
+			TypeKind: t.WireKind(),
+			TypeName: t.WireName(),
+			Data:     data,
 		})
 	}
 	return
 }
 
+// 以能整除的最大单位表示超时时间，如2 * time.Second
+func buildDuration(d time.Duration) string {
+	units := []struct {
+		unit time.Duration
+		name string
+	}{
+		{time.Hour, "Hour"}, {time.Minute, "Minute"}, {time.Second, "Second"},
+		{time.Millisecond, "Millisecond"}, {time.Microsecond, "Microsecond"},
+	}
+	for _, u := range units {
+		if d%u.unit != 0 {
+			continue
+		}
+		if n := d / u.unit; n != 1 {
+			return fmt.Sprintf("%d * time.%s", n, u.name)
+		}
+		return "time." + u.name
+	}
+	return fmt.Sprintf("time.Duration(%d)", d)
+}
+
+// 类型中是否包含timestamp，list和map检查其元素类型
+func hasTimestamp(t *parse.Type) bool {
+	for ; t.Kind == parse.TypeKindList || t.Kind == parse.TypeKindMap; t = t.Elem {
+	}
+	return t.Name == "timestamp"
+}
+
+// 将expr中的timestamp转换为UTC时间的表达式，使得json中与C、Node一样以Z结尾。
+// list和map复制后逐个转换元素，不修改原值，生成的代码换行后以indent缩进
+func buildUTC(expr string, t *parse.Type, indent string) string {
+	if !hasTimestamp(t) {
+		return expr
+	}
+	if t.Kind == parse.TypeKindNormal {
+		return expr + ".UTC()"
+	}
+	typ := toGolangValueType(t)
+	elem := buildUTC("v", t.Elem, indent+"        ")
+	key := "i"
+	if t.Kind == parse.TypeKindMap {
+		key = "k"
+	}
+	lines := []string{
+		"    if s == nil {",
+		"        return nil",
+		"    }",
+		fmt.Sprintf("    r := make(%s, len(s))", typ),
+		fmt.Sprintf("    for %s, v := range s {", key),
+		fmt.Sprintf("        r[%s] = %s", key, elem),
+		"    }",
+		"    return r",
+		fmt.Sprintf("}(%s)", expr),
+	}
+	return fmt.Sprintf("func(s %s) %s {\n%s%s", typ, typ, indent, strings.Join(lines, "\n"+indent))
+}
+
 func buildReturn(retType *parse.Type) string {
 	if retType.Name == "void" {
 		return "return err"
 	}
+	if retType.IsTypedStream() {
+		return fmt.Sprintf("return &%s{r: resp.(io.ReadCloser)}, err", streamTypes[retType])
+	}
 	if retType.Kind == parse.TypeKindMessage {
 		return fmt.Sprintf(`res = new(%s)
 	return res, json.Unmarshal(resp.([]byte), res)
 `, retType.Name)
 	}
+	if retType.Kind == parse.TypeKindList || retType.Kind == parse.TypeKindMap || utils.IsTime(retType) {
+		return "return res, json.Unmarshal(resp.([]byte), &res)"
+	}
+	if retType.Kind == parse.TypeKindEnum {
+		return fmt.Sprintf("return %s(resp.(int32)),err", retType.Name)
+	}
+	if retType.Alias != "" {
+		return fmt.Sprintf("return %s(resp.(%s)),err", retType.Alias, golangBuiltin(retType.Name))
+	}
 	return fmt.Sprintf("return resp.(%s),err", toGolangType(retType, true))
 }
 
@@ -48,14 +174,14 @@ func buildResponseArg(retType *parse.Type) string {
 	return fmt.Sprintf("res %s, err error", toGolangType(retType, true))
 }
 
-func buildRequestArgs(reqTypes []*parse.Type) string {
+func buildRequestArgs(method *parse.Method) string {
 	var builder strings.Builder
-	types := toGolangTypes(reqTypes, false)
+	types := toGolangTypes(method.ReqTypes, false)
 	for i, t := range types {
 		if i != 0 {
 			builder.WriteString(", ")
 		}
-		fmt.Fprintf(&builder, "arg%d %s", i+1, t)
+		fmt.Fprintf(&builder, "%s %s", method.ArgName(i), t)
 	}
 	return builder.String()
 }
@@ -69,6 +195,10 @@ func toGolangMethod(m *parse.Method) (method string) {
 			if i != 1 {
 				builder.WriteString(", ")
 			}
+			// 存在命名参数时，所有参数都带上参数名
+			if m.NamedArgs() {
+				fmt.Fprintf(&builder, "%s ", m.ArgName(i-1))
+			}
 			builder.WriteString(types[i])
 		}
 	}
@@ -94,10 +224,17 @@ func toGolangTypes(ts []*parse.Type, closer bool) []string {
 func toGolangType(t *parse.Type, closer bool) string {
 	switch t.Kind {
 	case parse.TypeKindNormal:
+		return golangNormal(t)
+	case parse.TypeKindEnum:
 		return t.Name
 	case parse.TypeKindMessage:
 		return "*" + t.Name
+	case parse.TypeKindList, parse.TypeKindMap:
+		return toGolangValueType(t)
 	case parse.TypeKindStream:
+		if t.IsTypedStream() {
+			return "*" + streamTypes[t]
+		}
 		if closer {
 			return toGlangMap2[t.Name]
 		}
@@ -106,3 +243,171 @@ func toGolangType(t *parse.Type, closer bool) string {
 		return ""
 	}
 }
+
+// 可选成员以指针表示，未设置时不进行序列化。list、map和bytes本身可为nil，无需指针。
+// 通过@json指定了键名的成员使用对应的结构体标签
+func buildMember(mem *parse.Member) string {
+	t := toGolangValueType(mem.Type)
+	if !mem.Optional {
+		if mem.JSONName() != mem.Name {
+			return fmt.Sprintf("%s %s `json:\"%s\"`", mem.Name, t, mem.JSONName())
+		}
+		return fmt.Sprintf("%s %s", mem.Name, t)
+	}
+	if mem.Type.Kind != parse.TypeKindList && mem.Type.Kind != parse.TypeKindMap && mem.Type.Name != "bytes" {
+		t = "*" + t
+	}
+	return fmt.Sprintf("%s %s `json:\"%s,omitempty\"`", mem.Name, t, mem.JSONName())
+}
+
+// message成员以及list、map元素的类型，其中message以值而非指针的形式存放
+func toGolangValueType(t *parse.Type) string {
+	switch t.Kind {
+	case parse.TypeKindList:
+		return "[]" + toGolangValueType(t.Elem)
+	case parse.TypeKindMap:
+		return fmt.Sprintf("map[%s]%s", toGolangValueType(t.Key), toGolangValueType(t.Elem))
+	case parse.TypeKindArray:
+		return fmt.Sprintf("[%d]%s", t.Len, toGolangValueType(t.Elem))
+	case parse.TypeKindNormal:
+		return golangNormal(t)
+	default:
+		return t.Name
+	}
+}
+
+// 生成校验函数的函数体，Patterns为需要预先编译的正则表达式变量的定义
+type validateBuilder struct {
+	strings.Builder
+	Patterns []string
+}
+
+func (b *validateBuilder) line(depth int, format string, args ...interface{}) {
+	b.WriteString(strings.Repeat("    ", depth))
+	fmt.Fprintf(b, format, args...)
+	b.WriteByte('\n')
+}
+
+// 检查v是否满足约束cs，可选成员的v为指针。label为错误信息中的名称，pattern为正则表达式的变量名
+func (b *validateBuilder) check(depth int, v string, t *parse.Type, optional bool, cs parse.Constraints, label, pattern string) {
+	if len(cs) == 0 && !utils.TypeNeedsValidate(t, allMessages) {
+		return
+	}
+	// list、map以及bytes的可选成员不是指针
+	if optional && t.Kind != parse.TypeKindList && t.Kind != parse.TypeKindMap && t.Name != "bytes" {
+		b.line(depth, "if %s != nil {", v)
+		defer b.line(depth, "}")
+		depth++
+		if t.Kind != parse.TypeKindMessage {
+			v = "*" + v
+		}
+	}
+	for _, c := range cs {
+		var cond string
+		switch c.Name {
+		case "min":
+			cond = fmt.Sprintf("%s < %s", v, c.Value.Value)
+		case "max":
+			cond = fmt.Sprintf("%s > %s", v, c.Value.Value)
+		case "minlen":
+			cond = fmt.Sprintf("len(%s) < %s", v, c.Value.Value)
+		case "maxlen":
+			cond = fmt.Sprintf("len(%s) > %s", v, c.Value.Value)
+		case "pattern":
+			b.Patterns = append(b.Patterns, fmt.Sprintf("%s = regexp.MustCompile(%s)", pattern, utils.Quote(c.Value.Value)))
+			cond = fmt.Sprintf("!%s.MatchString(string(%s))", pattern, v)
+		}
+		b.line(depth, "if %s {", cond)
+		b.line(depth+1, "return errors.New(%s)", utils.Quote(utils.ConstraintError(label, c)))
+		b.line(depth, "}")
+	}
+	b.elem(depth, v, t, 1)
+}
+
+// 递归检查message以及list、map中的message
+func (b *validateBuilder) elem(depth int, v string, t *parse.Type, level int) {
+	if !utils.TypeNeedsValidate(t, allMessages) {
+		return
+	}
+	if t.Kind == parse.TypeKindMessage {
+		b.line(depth, "if err := %s.Validate(); err != nil {", v)
+		b.line(depth+1, "return err")
+		b.line(depth, "}")
+		return
+	}
+	e := fmt.Sprintf("v%d", level)
+	b.line(depth, "for _, %s := range %s {", e, v)
+	b.elem(depth+1, e, t.Elem, level+1)
+	b.line(depth, "}")
+}
+
+// rpch传输时使用的Go类型，stream<Msg>为io.Reader，enum为int32，typedef为底层类型
+func toGolangWireType(t *parse.Type) string {
+	switch {
+	case t.IsTypedStream():
+		return toGlangMap1[t.WireName()]
+	case t.Kind == parse.TypeKindEnum:
+		return t.WireName()
+	case t.Alias != "":
+		return golangBuiltin(t.Name)
+	}
+	return toGolangType(t, false)
+}
+
+// 包装服务中的方法签名，参数和返回值均使用rpch传输时使用的类型
+func buildAdaptedMethod(m *parse.Method) string {
+	var args []string
+	for i, t := range m.ReqTypes {
+		args = append(args, fmt.Sprintf("%s %s", m.ArgName(i), toGolangWireType(t)))
+	}
+	ret := toGolangWireType(m.RetType)
+	switch {
+	case m.RetType.Name == "void":
+		ret = "error"
+	case m.RetType.IsTypedStream():
+		ret = fmt.Sprintf("(%s, func(), error)", ret)
+	case m.RetType.Kind == parse.TypeKindStream:
+		ret = fmt.Sprintf("(%s, func(), error)", ret)
+	default:
+		ret = fmt.Sprintf("(%s, error)", ret)
+	}
+	return fmt.Sprintf("%s(%s) %s", m.Name, strings.Join(args, ", "), ret)
+}
+
+// 校验参数的包装服务中的方法签名，返回值均具名以便校验失败时直接返回
+func buildValidatedMethod(m *parse.Method) string {
+	var args []string
+	for i, t := range toGolangTypes(m.ReqTypes, false) {
+		args = append(args, fmt.Sprintf("%s %s", m.ArgName(i), t))
+	}
+	ret := toGolangType(m.RetType, false)
+	switch {
+	case m.RetType.Name == "void":
+		ret = "err error"
+	case m.RetType.Kind == parse.TypeKindStream:
+		ret = fmt.Sprintf("_ %s, _ func(), err error", ret)
+	default:
+		ret = fmt.Sprintf("_ %s, err error", ret)
+	}
+	return fmt.Sprintf("%s(%s) (%s)", m.Name, strings.Join(args, ", "), ret)
+}
+
+// MarshalJSON中将timestamp成员转换为UTC时间的语句，可选的timestamp成员为指针
+func buildMarshalUTC(msg *parse.Message) []string {
+	var fields []string
+	for _, mem := range msg.Mems {
+		if !hasTimestamp(mem.Type) {
+			continue
+		}
+		field := "v." + mem.Name
+		if mem.Optional && mem.Type.Kind == parse.TypeKindNormal {
+			fields = append(fields, fmt.Sprintf(`if %s != nil {
+        t := %s.UTC()
+        %s = &t
+    }`, field, field, field))
+			continue
+		}
+		fields = append(fields, fmt.Sprintf("%s = %s", field, buildUTC(field, mem.Type, "    ")))
+	}
+	return fields
+}
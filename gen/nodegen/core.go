@@ -6,12 +6,18 @@ import (
 	"gufeijun/hustgen/gen/utils"
 	"gufeijun/hustgen/parse"
 	"path"
+	"sort"
+	"strings"
 )
 
 var infos *parse.Symbols
 
+// 当前文件以及导入的文件中定义的所有message
+var allMessages map[string]*parse.Message
+
 func Gen(_infos *parse.Symbols, conf *config.ComplileConfig) error {
 	infos = _infos
+	allMessages = infos.AllMessages()
 	te, err := utils.NewTmplExec(conf, utils.GenFilePath(conf.SrcIDL, conf.OutDir, ".rpch.js"))
 	if err != nil {
 		return err
@@ -19,6 +25,17 @@ func Gen(_infos *parse.Symbols, conf *config.ComplileConfig) error {
 	defer te.Close()
 	genStatement(te)
 	genUseStrict(te)
+	genRequires(te)
+	genReplacer(te)
+	genEnums(te)
+	genConsts(te)
+	genTypedefs(te)
+	genFactories(te)
+	genMessageDecoders(te)
+	genMessageEncoders(te)
+	genMessageValidators(te)
+	genStreamHelpers(te)
+	genErrorClasses(te)
 	genServiceInterfaces(te)
 	genHandlers(te)
 	genCheckImplementsFunc(te)
@@ -36,39 +53,308 @@ type clientMethod struct {
 	MashalArgs   []string
 	RespCheck    string
 	UnmashalResp string
+	Reject       string
+	Oneway       bool
+	Timeout      int64 // 超时时间的毫秒数，为0时一直等待响应
 }
 
 func genClientClass(te *utils.TmplExec) {
 	type Data struct {
-		Service string
-		Methods []*clientMethod
+		Doc        string
+		Service    string
+		Base       string
+		WireName   string
+		Methods    []*clientMethod
+		Idempotent []string
 	}
-	for _, s := range infos.Services {
+	for _, s := range orderedServices() {
 		data := &Data{
-			Service: s.Name,
+			Doc:      jsDoc("", docLines(s.Doc, s.Annos)...),
+			Service:  s.Name,
+			Base:     baseClass(s),
+			WireName: infos.Qualify(s.Name),
 		}
-		for _, method := range s.Methods {
+		for _, method := range classMethods(s) {
 			data.Methods = append(data.Methods, buildClientMethod(method))
 		}
+		// 包括经由第一个基服务继承的方法
+		for _, method := range s.Methods {
+			if method.Idempotent {
+				data.Idempotent = append(data.Idempotent, fmt.Sprintf("%q", method.Name))
+			}
+		}
 		te.Execute(clientClassTmpl, data)
 	}
 }
 
+// 声明了package时，导出的对象按package逐层嵌套，如foo.bar对应{ foo: { bar: {...} } }
 func genExports(te *utils.TmplExec) {
-	services := make([]string, 0, len(infos.Services))
+	data := &struct {
+		Namespace []string
+		Services  []string
+		Enums     []string
+		Consts    []string
+		Factories []string
+		Errors    []string
+		Decoders  []string
+	}{}
+	if infos.Package != "" {
+		data.Namespace = strings.Split(infos.Package, ".")
+	}
 	for _, s := range infos.Services {
-		services = append(services, s.Name)
+		data.Services = append(data.Services, s.Name)
+	}
+	for _, e := range infos.Enums {
+		data.Enums = append(data.Enums, e.Name)
+	}
+	for _, c := range infos.Consts {
+		data.Consts = append(data.Consts, c.Name)
+	}
+	for _, msg := range infos.Messages {
+		if utils.HasDefaults(msg, allMessages) {
+			data.Factories = append(data.Factories, "new"+msg.Name)
+		}
+		data.Decoders = append(data.Decoders, codecNames(msg)...)
+	}
+	for _, e := range infos.Errors {
+		data.Errors = append(data.Errors, e.Name)
+	}
+	te.Execute(moduleExportsTmpl, data)
+}
+
+// message的decode函数以及需要时的encode函数名，供导入该文件的模块引用
+func codecNames(msg *parse.Message) []string {
+	names := []string{"decode" + msg.Name}
+	if needsEncode(&parse.Type{Kind: parse.TypeKindMessage, Name: msg.Name}) {
+		names = append(names, "encode"+msg.Name)
+	}
+	return names
+}
+
+func genEnums(te *utils.TmplExec) {
+	for _, enum := range infos.Enums {
+		te.Execute(enumTmpl, enum)
+	}
+}
+
+func genConsts(te *utils.TmplExec) {
+	if len(infos.Consts) == 0 {
+		return
+	}
+	type Data struct {
+		Doc   string
+		Name  string
+		Value string
+	}
+	var consts []*Data
+	for _, c := range infos.Consts {
+		value := c.Value.Value
+		if c.Value.Kind == parse.LiteralString {
+			value = utils.Quote(value)
+		}
+		consts = append(consts, &Data{
+			Doc:   jsDoc("", append(append([]string{}, c.Doc...), fmt.Sprintf("@type {%s}", jsType(c.Type)))...),
+			Name:  c.Name,
+			Value: value,
+		})
+	}
+	te.Execute(constTmpl, consts)
+}
+
+// 以JSDoc的形式描述当前文件中定义的typedef以及message，属性名为序列化时的键名。嵌套的message作为外层message的属性，如Response.Item
+func genTypedefs(te *utils.TmplExec) {
+	for _, def := range infos.Typedefs {
+		lines := append(append([]string{}, def.Doc...), fmt.Sprintf("@typedef {%s} %s", jsType(def.Type), def.Name))
+		fmt.Fprint(te.W, "\n"+jsDoc("", lines...))
+	}
+	for _, msg := range infos.Messages {
+		// error的成员在error类的注释中描述
+		if _, ok := infos.Errors[msg.Name]; ok {
+			continue
+		}
+		lines := append(docLines(msg.Doc, msg.Annos), "@typedef {Object} "+msg.QualName())
+		lines = append(lines, propertyLines(msg, "")...)
+		fmt.Fprint(te.W, "\n"+jsDoc("", lines...))
+	}
+}
+
+// message成员对应的@property注释，prefix为属性名的前缀
+func propertyLines(msg *parse.Message, prefix string) []string {
+	var lines []string
+	for _, mem := range msg.Mems {
+		name := prefix + mem.JSONName()
+		if mem.Optional {
+			name = "[" + name + "]"
+		}
+		property := fmt.Sprintf("@property {%s} %s", jsType(mem.Type), name)
+		if desc := utils.DocLines(mem.Doc, mem.Annos); len(desc) != 0 {
+			property += " " + strings.Join(removeEmpty(desc), " ")
+		}
+		lines = append(lines, property)
+	}
+	// oneof为仅包含一个变体的对象，如{Circle: Circle}|{Rect: Rect}
+	for _, oneof := range msg.Oneofs {
+		var variants []string
+		for _, mem := range oneof.Mems {
+			variants = append(variants, fmt.Sprintf("{%s: %s}", jsKey(mem.JSONName()), jsType(mem.Type)))
+		}
+		property := fmt.Sprintf("@property {%s} [%s]", strings.Join(variants, "|"), prefix+oneof.Name)
+		if len(oneof.Doc) != 0 {
+			property += " " + strings.Join(oneof.Doc, " ")
+		}
+		lines = append(lines, property)
+	}
+	return lines
+}
+
+// error生成为Error的子类，错误信息为json编码的{code, error, data}，成员位于data中。
+// 存在throws声明的方法时生成decodeError，用于在客户端还原error
+func genErrorClasses(te *utils.TmplExec) {
+	for _, e := range infos.Errors {
+		lines := append(docLines(e.Doc, e.Annos), "@property {Object} data")
+		lines = append(lines, propertyLines(e.Message, "data.")...)
+		te.Execute(errorClassTmpl, &struct {
+			Doc      string
+			Name     string
+			WireName string
+			Code     int32
+			Message  string
+		}{
+			Doc:      jsDoc("", lines...),
+			Name:     e.Name,
+			WireName: infos.Qualify(e.Name),
+			Code:     e.Code,
+			Message:  stringify(fmt.Sprintf(`{ code: %d, error: "%s", data: %s }`, e.Code, infos.Qualify(e.Name), buildValueEncode(&parse.Type{Kind: parse.TypeKindMessage, Name: e.Name}, "this.data", 0))),
+		})
+	}
+	var throws bool
+	utils.TraverseMethod(infos, func(method *parse.Method) bool {
+		throws = len(method.Throws) != 0
+		return throws
+	})
+	if throws {
+		te.Execute(decodeErrorTmpl, nil)
+	}
+}
+
+// 为有默认值的message生成new<Message>工厂函数，返回的对象中只包含有默认值的成员
+func genFactories(te *utils.TmplExec) {
+	for _, msg := range infos.Messages {
+		if !utils.HasDefaults(msg, allMessages) {
+			continue
+		}
+		te.Execute(factoryTmpl, &struct {
+			Name   string
+			Fields []string
+		}{Name: msg.Name, Fields: buildDefaults(msg)})
+	}
+}
+
+// 反序列化message后检查必需成员是否存在(optional成员可以为undefined)，并将bytes成员转换为Buffer。
+// 导入的message的decode函数从被导入的文件生成的模块中引入
+func genMessageDecoders(te *utils.TmplExec) {
+	for _, msg := range infos.Messages {
+		data := &struct {
+			Name   string
+			Checks []string
+		}{Name: msg.Name}
+		for _, mem := range msg.Mems {
+			v := jsProperty("v", mem.JSONName())
+			if mem.Default != nil {
+				data.Checks = append(data.Checks, fmt.Sprintf("if (%s === undefined) %s = %s;", v, v, buildDefault(mem)))
+			} else if !mem.Optional {
+				data.Checks = append(data.Checks, fmt.Sprintf(`if (%s === undefined) throw "missing member %s of message %s";`,
+					v, mem.JSONName(), msg.Name))
+			}
+			// 定长数组的长度必须一致
+			if mem.Type.Kind == parse.TypeKindArray {
+				data.Checks = append(data.Checks, fmt.Sprintf(`if (!Array.isArray(%s) || %s.length !== %d) throw "member %s of message %s must be an array of length %d";`,
+					v, v, mem.Type.Len, mem.JSONName(), msg.Name, mem.Type.Len))
+			}
+			if decode := buildValueDecode(mem.Type, v, 0); decode != "" {
+				data.Checks = append(data.Checks, decode)
+			}
+		}
+		for _, oneof := range msg.Oneofs {
+			data.Checks = append(data.Checks, buildOneofDecode(oneof, msg.Name)...)
+		}
+		te.Execute(messageDecodeTmpl, data)
+	}
+}
+
+// 为包含duration的message生成encode<Message>函数，序列化前将毫秒数转换为纳秒数
+func genMessageEncoders(te *utils.TmplExec) {
+	if !useType(func(t *parse.Type) bool { return t.Name == "duration" }) {
+		return
+	}
+	te.Execute(encodeHelperTmpl, struct {
+		List bool
+		Map  bool
+	}{
+		List: useType(func(t *parse.Type) bool { return t.Kind == parse.TypeKindList && needsEncode(t) }),
+		Map:  useType(func(t *parse.Type) bool { return t.Kind == parse.TypeKindMap && needsEncode(t) }),
+	})
+	for _, msg := range infos.Messages {
+		data := &struct {
+			Name   string
+			Fields []string
+		}{Name: msg.Name}
+		for _, mem := range msg.Mems {
+			if !needsEncode(mem.Type) {
+				continue
+			}
+			v := jsProperty("v", mem.JSONName())
+			data.Fields = append(data.Fields, fmt.Sprintf("%s = %s;", v, buildValueEncode(mem.Type, v, 0)))
+		}
+		if len(data.Fields) != 0 {
+			te.Execute(messageEncodeTmpl, data)
+		}
+	}
+}
+
+// 为需要校验的message生成validate<Message>函数，服务端在调用用户实现之前对参数进行校验
+func genMessageValidators(te *utils.TmplExec) {
+	if len(infos.Services) == 0 {
+		return
+	}
+	for _, msg := range infos.AllMessages() {
+		if !utils.NeedsValidate(msg, allMessages) {
+			continue
+		}
+		data := &struct {
+			Name   string
+			Checks []string
+		}{Name: msg.Name}
+		for _, mem := range msg.Mems {
+			data.Checks = append(data.Checks, buildValidate(jsProperty("v", mem.JSONName()), mem.Type, mem.Optional,
+				mem.Constraints, msg.QualName()+"."+mem.Name)...)
+		}
+		for _, oneof := range msg.Oneofs {
+			v := jsProperty("v", oneof.Name)
+			for _, mem := range oneof.Mems {
+				if validate := buildElemValidate(jsProperty(v, mem.JSONName()), mem.Type, 0); validate != "" {
+					data.Checks = append(data.Checks, fmt.Sprintf("if (%s) %s", v, validate))
+				}
+			}
+		}
+		te.Execute(messageValidateTmpl, data)
+	}
+}
+
+func genStreamHelpers(te *utils.TmplExec) {
+	if useType(func(t *parse.Type) bool { return t.IsTypedStream() }) {
+		fmt.Fprint(te.W, streamHelperTmpl)
 	}
-	te.Execute(moduleExportsTmpl, services)
 }
 
 func genRegisterFunc(te *utils.TmplExec) {
 	for _, s := range infos.Services {
 		data := &struct {
 			Name        string
+			WireName    string
 			MethodsName string
 			Methods     []string
-		}{Name: s.Name}
+		}{Name: s.Name, WireName: infos.Qualify(s.Name)}
 		data.MethodsName, data.Methods = buildMethodsName(s)
 		te.Execute(registerServiceTmpl, data)
 	}
@@ -91,6 +377,7 @@ func genHandlers(te *utils.TmplExec) {
 		ArgCnt        int
 		Checks        []string
 		UnmarshalArgs []string
+		Validates     []string
 		CallHandler   string
 		Resp          *respDesc
 	}
@@ -100,6 +387,7 @@ func genHandlers(te *utils.TmplExec) {
 			ArgCnt:        len(method.ReqTypes),
 			Checks:        buildChecks(method),
 			UnmarshalArgs: buildUnmarshalArgs(method),
+			Validates:     buildArgValidates(method),
 			CallHandler:   buildCallHandler(method),
 			Resp:          buildRespDesc(method),
 		}
@@ -114,18 +402,176 @@ type methodDesc struct {
 }
 
 func genServiceInterfaces(te *utils.TmplExec) {
-	for _, s := range infos.Services {
+	for _, s := range orderedServices() {
 		data := &struct {
+			Doc     string
 			Name    string
+			Base    string
 			Methods []*methodDesc
-		}{Name: s.Name}
-		for _, method := range s.Methods {
+		}{Doc: jsDoc("", docLines(s.Doc, s.Annos)...), Name: s.Name, Base: baseClass(s)}
+		for _, method := range classMethods(s) {
 			data.Methods = append(data.Methods, buildNodeMethod(method))
 		}
 		te.Execute(serviceInterfaceTmpl, data)
 	}
 }
 
+// 类的声明不会提升，被继承的服务需要排在前面
+func orderedServices() []*parse.Service {
+	var names []string
+	for name := range infos.Services {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	var services []*parse.Service
+	visited := make(map[*parse.Service]bool)
+	var visit func(s *parse.Service)
+	visit = func(s *parse.Service) {
+		if visited[s] || infos.Services[s.Name] != s {
+			return
+		}
+		visited[s] = true
+		if len(s.Bases) != 0 {
+			visit(s.Bases[0])
+		}
+		services = append(services, s)
+	}
+	for _, name := range names {
+		visit(infos.Services[name])
+	}
+	return services
+}
+
+// JavaScript只支持单继承，服务对应的类继承第一个基服务的类
+func baseClass(s *parse.Service) string {
+	if len(s.Bases) == 0 {
+		return ""
+	}
+	return s.Bases[0].Name
+}
+
+// 服务对应的类中需要定义的方法，即除去从第一个基服务的类中继承的方法
+func classMethods(s *parse.Service) []*parse.Method {
+	if len(s.Bases) == 0 {
+		return s.Methods
+	}
+	inherited := make(map[*parse.Method]bool)
+	for _, method := range s.Bases[0].Methods {
+		if method.Origin != nil {
+			method = method.Origin
+		}
+		inherited[method] = true
+	}
+	var methods []*parse.Method
+	for _, method := range s.Methods {
+		if method.Origin == nil || !inherited[method.Origin] {
+			methods = append(methods, method)
+		}
+	}
+	return methods
+}
+
+// 使用了map类型时，允许以Map对象传参，序列化时将其转换为普通对象。
+// 使用了bytes类型时，序列化时将Buffer转换为base64字符串
+func genReplacer(te *utils.TmplExec) {
+	if !useReplacer() {
+		return
+	}
+	te.Execute(replacerTmpl, struct {
+		Map   bool
+		Bytes bool
+	}{
+		Map:   useMap(),
+		Bytes: useBytes(),
+	})
+}
+
+func useReplacer() bool {
+	return useMap() || useBytes()
+}
+
+func useMap() bool {
+	return useType(func(t *parse.Type) bool { return t.Kind == parse.TypeKindMap })
+}
+
+func useBytes() bool {
+	return useType(func(t *parse.Type) bool { return t.Name == "bytes" })
+}
+
+// 遍历所有message成员以及方法参数、返回值的类型(包括list和map的元素)，判断是否存在满足match的类型
+func useType(match func(t *parse.Type) bool) bool {
+	var use bool
+	check := func(t *parse.Type) {
+		for ; ; t = t.Elem {
+			use = use || match(t)
+			if t.Kind != parse.TypeKindList && t.Kind != parse.TypeKindMap {
+				break
+			}
+		}
+	}
+	for _, msg := range infos.AllMessages() {
+		for _, mem := range msg.Mems {
+			check(mem.Type)
+		}
+	}
+	utils.TraverseMethod(infos, func(method *parse.Method) bool {
+		for _, t := range append(method.ReqTypes, method.RetType) {
+			check(t)
+		}
+		return use
+	})
+	return use
+}
+
+// 从导入的文件生成的模块中引入enum、message的工厂函数和decode、encode函数以及被继承的服务的类
+func genRequires(te *utils.TmplExec) {
+	for _, imp := range infos.Imports {
+		data := &struct {
+			Module  string
+			Package string // 被导入的文件与当前文件属于同一package
+			Names   []string
+		}{Module: path.Base(utils.GenFilePath(imp.File, "", ".rpch.js"))}
+		if infos.Package != "" {
+			data.Package = "." + infos.Package
+		}
+		for _, enum := range imp.Infos.Enums {
+			data.Names = append(data.Names, enum.Name)
+		}
+		for _, msg := range imp.Infos.Messages {
+			if utils.HasDefaults(msg, allMessages) {
+				data.Names = append(data.Names, "new"+msg.Name)
+			}
+			data.Names = append(data.Names, codecNames(msg)...)
+		}
+		for _, e := range imp.Infos.Errors {
+			data.Names = append(data.Names, e.Name)
+		}
+		for _, base := range importedBases(imp.Infos) {
+			data.Names = append(data.Names, base+"Interface", base+"Client")
+		}
+		if len(data.Names) == 0 {
+			continue
+		}
+		sort.Strings(data.Names)
+		te.Execute(requireTmpl, data)
+	}
+}
+
+// 当前文件中的服务所继承的、定义在imported中的服务
+func importedBases(imported *parse.Symbols) []string {
+	var bases []string
+	seen := make(map[string]bool)
+	for _, s := range infos.Services {
+		base := baseClass(s)
+		if base == "" || imported.Services[base] != s.Bases[0] || seen[base] {
+			continue
+		}
+		seen[base] = true
+		bases = append(bases, base)
+	}
+	return bases
+}
+
 func genUseStrict(te *utils.TmplExec) {
 	fmt.Fprintln(te.W, `'use strict';`)
 }
@@ -9,6 +9,17 @@ var (
 	moduleExportsTmpl    = must(_moduleExportsTmpl)
 	handlerTmpl          = must(_handlerTmpl)
 	clientClassTmpl      = must(_clientClassTmpl)
+	enumTmpl             = must(_enumTmpl)
+	constTmpl            = must(_constTmpl)
+	messageDecodeTmpl    = must(_messageDecodeTmpl)
+	factoryTmpl          = must(_factoryTmpl)
+	replacerTmpl         = must(_replacerTmpl)
+	requireTmpl          = must(_requireTmpl)
+	errorClassTmpl       = must(_errorClassTmpl)
+	decodeErrorTmpl      = must(_decodeErrorTmpl)
+	encodeHelperTmpl     = must(_encodeHelperTmpl)
+	messageEncodeTmpl    = must(_messageEncodeTmpl)
+	messageValidateTmpl  = must(_messageValidateTmpl)
 )
 
 func must(tmpl string) *template.Template {
@@ -22,7 +33,7 @@ const _statementTmpl = `// This is code generated by hgen. DO NOT EDIT!!!
 `
 
 const _serviceInterfaceTmpl = `
-class {{.Name}}Interface {
+{{.Doc}}class {{.Name}}Interface{{ if .Base }} extends {{.Base}}Interface{{ end }} {
 	{{- range .Methods -}}	
 	{{- .Desc }}
 	async {{.Signature}} {
@@ -40,12 +51,27 @@ function checkImplements(impl, service, methods) {
 }
 `
 
+const _requireTmpl = `const { {{- range $i, $v := .Names }}{{ if $i }},{{ end }} {{ $v }}{{ end }} } = require("./{{.Module}}"){{.Package}};
+`
+
+const _replacerTmpl = `
+function replacer(key, value) {
+	{{- if .Map }}
+	if (value instanceof Map) return Object.fromEntries(value);
+	{{- end }}
+	{{- if .Bytes }}
+	if (Buffer.isBuffer(this[key])) return this[key].toString("base64");
+	{{- end }}
+	return value;
+}
+`
+
 const _registerServiceTmpl = `
 function register{{.Name}}Service(svr, impl) {
 	{{- $name:= .Name }}
 	checkImplements(impl, "{{.Name}}", [{{.MethodsName}}]);
 	svr.register({
-		name: "{{.Name}}",
+		name: "{{.WireName}}",
 		methods: {
 			{{- range .Methods}}
 			{{.}}: {{$name}}{{.}}Handler(impl),
@@ -56,12 +82,169 @@ function register{{.Name}}Service(svr, impl) {
 `
 
 const _moduleExportsTmpl = `
-module.exports = {
-{{- range . }}
+module.exports = {{ range .Namespace }}{ {{.}}: {{ end }}{
+{{- range .Services }}
 	register{{.}}Service,
 	{{.}}Interface,
 	{{.}}Client,
 {{- end }}
+{{- range .Enums }}
+	{{.}},
+{{- end }}
+{{- range .Consts }}
+	{{.}},
+{{- end }}
+{{- range .Factories }}
+	{{.}},
+{{- end }}
+{{- range .Errors }}
+	{{.}},
+{{- end }}
+{{- range .Decoders }}
+	{{.}},
+{{- end }}
+}{{ range .Namespace }} }{{ end }}
+`
+
+const _errorClassTmpl = `
+{{.Doc}}class {{.Name}} extends Error {
+	constructor(data) {
+		super();
+		this.name = "{{.Name}}";
+		this.code = {{.Code}};
+		this.data = data || {};
+		this.message = {{.Message}};
+	}
+
+	toString() {
+		return this.message;
+	}
+}
+{{.Name}}.code = {{.Code}};
+{{.Name}}.error = "{{.WireName}}";
+{{.Name}}.decode = decode{{.Name}};
+`
+
+const _decodeErrorTmpl = `
+function decodeError(err, errors) {
+	let v;
+	try {
+		v = JSON.parse(typeof err === "string" ? err : err.message);
+	} catch (e) {
+		return err;
+	}
+	if (v === null || typeof v !== "object") return err;
+	for (const E of errors) {
+		if (v.code !== E.code || v.error !== E.error) continue;
+		try {
+			E.decode(v.data);
+		} catch (e) {
+			return err;
+		}
+		return new E(v.data);
+	}
+	return err;
+}
+`
+
+const _enumTmpl = `
+const {{.Name}} = Object.freeze({
+{{- range .Mems }}
+	{{.Name}}: {{.Value}},
+{{- end }}
+});
+`
+
+const _constTmpl = `
+{{ range . }}{{.Doc}}const {{.Name}} = {{.Value}};
+{{ end }}`
+
+const _factoryTmpl = `
+function new{{.Name}}() {
+	return {
+	{{- range .Fields }}
+		{{.}},
+	{{- end }}
+	};
+}
+`
+
+const _messageDecodeTmpl = `
+function decode{{.Name}}(v) {
+	if (v === null || typeof v !== "object") throw "invalid message {{.Name}}";
+	{{- range .Checks }}
+	{{.}}
+	{{- end }}
+}
+`
+
+// duration在Node中为毫秒数，传输时为纳秒数
+const _encodeHelperTmpl = `
+function encodeDuration(v) {
+	return typeof v === "number" ? Math.round(v * 1e6) : v;
+}
+{{- if .List }}
+
+function encodeList(v, encode) {
+	return Array.isArray(v) ? v.map(e => encode(e)) : v;
+}
+{{- end }}
+{{- if .Map }}
+
+function encodeMap(v, encode) {
+	if (v === undefined || v === null) return v;
+	const entries = v instanceof Map ? [...v] : Object.entries(v);
+	return Object.fromEntries(entries.map(([k, e]) => [k, encode(e)]));
+}
+{{- end }}
+`
+
+// stream<Msg>整体以一个Buffer传输，每条消息编码为4字节小端长度前缀加json
+const streamHelperTmpl = `
+async function encodeStream(iter, encode) {
+	const bufs = [];
+	for await (const v of iter) {
+		const data = Buffer.from(encode(v));
+		const head = Buffer.alloc(4);
+		head.writeUInt32LE(data.length);
+		bufs.push(head, data);
+	}
+	return Buffer.concat(bufs);
+}
+
+async function* decodeStream(buf, decode) {
+	let off = 0;
+	while (off < buf.length) {
+		if (buf.length - off < 4) throw new Error("truncated stream");
+		const end = off + 4 + buf.readUInt32LE(off);
+		if (end > buf.length) throw new Error("truncated stream");
+		const v = JSON.parse(buf.toString("utf8", off + 4, end));
+		decode(v);
+		off = end;
+		yield v;
+	}
+}
+`
+
+// 返回转换了duration成员的副本，不修改原对象
+const _messageEncodeTmpl = `
+function encode{{.Name}}(v) {
+	if (v === undefined || v === null) return v;
+	v = Object.assign({}, v);
+	{{- range .Fields }}
+	{{.}}
+	{{- end }}
+	return v;
+}
+`
+
+// 不满足IDL中声明的约束时抛出错误信息
+const _messageValidateTmpl = `
+function validate{{.Name}}(v) {
+	if (v === undefined || v === null) return;
+	{{- range .Checks }}
+	{{.}}
+	{{- end }}
 }
 `
 
@@ -75,6 +258,9 @@ function {{.FuncName}}(impl) {
 		{{- range .UnmarshalArgs }}
 		{{.}}
 		{{- end }}
+		{{- range .Validates }}
+		{{.}}
+		{{- end }}
 		{{.CallHandler}}
 		{{.Resp.Prepare}}
 		let resp = {
@@ -88,10 +274,13 @@ function {{.FuncName}}(impl) {
 `
 
 const _clientClassTmpl = `
-class {{.Service}}Client {
+{{.Doc}}class {{.Service}}Client{{ if .Base }} extends {{.Base}}Client{{ end }} {
 	constructor(conn) {
+		{{- if .Base }}
+		super(conn);
+		{{- end }}
 		this.conn = conn;
-		this.service = "{{.Service}}";
+		this.service = "{{.WireName}}";
 	}
 	{{- range .Methods }}
 	{{.MethodDesc.Desc}}
@@ -105,10 +294,20 @@ class {{.Service}}Client {
 		{{- range .MashalArgs }}
 		{{.}}
 		{{- end}}
+		{{- if .Oneway }}
+		// oneway的方法不等待服务端的响应
+		this.conn.call(req, () => {});
+		{{- else }}
         return new Promise((resolve, reject) => {
+			{{- if .Timeout }}
+			const timer = setTimeout(() => reject(new Error("call {{.Service}}.{{.Name}} timed out after {{.Timeout}}ms")), {{.Timeout}});
+			{{- end }}
             this.conn.call(req, (resp, err) => {
+				{{- if .Timeout }}
+				clearTimeout(timer);
+				{{- end }}
                 if (err != null) {
-                    reject(err);
+                    reject({{.Reject}});
                     return;
                 }
 				if ({{.RespCheck}}){
@@ -118,7 +317,13 @@ class {{.Service}}Client {
 				{{.UnmashalResp}}
             })
         })
+		{{- end }}
 	}
 	{{- end }}
 }
+{{- if .Idempotent }}
+
+// 调用失败时可以安全重试的方法
+{{.Service}}Client.idempotentMethods = new Set([{{ range $i, $m := .Idempotent }}{{ if ne $i 0 }}, {{ end }}{{ $m }}{{ end }}]);
+{{- end }}
 `
@@ -5,6 +5,7 @@ import (
 	"gufeijun/hustgen/gen/utils"
 	"gufeijun/hustgen/parse"
 	"strings"
+	"time"
 )
 
 var unmarshalMap = map[string]string{
@@ -18,6 +19,7 @@ var unmarshalMap = map[string]string{
 	"uint64":  "readBigUInt64LE",
 	"float32": "readFloatLE",
 	"float64": "readDoubleLE",
+	"bool":    "readUInt8",
 }
 
 var marshalMap = map[string]string{
@@ -31,32 +33,157 @@ var marshalMap = map[string]string{
 	"uint64":  "writeBigUInt64LE",
 	"float32": "writeFloatLE",
 	"float64": "writeDoubleLE",
+	"bool":    "writeUInt8",
+}
+
+func stringify(v string) string {
+	if useReplacer() {
+		return fmt.Sprintf("JSON.stringify(%s, replacer)", v)
+	}
+	return fmt.Sprintf("JSON.stringify(%s)", v)
 }
 
 func buildNodeMethod(method *parse.Method) *methodDesc {
-	var desc strings.Builder
 	var signature strings.Builder
+	lines := docLines(method.Doc, method.Annos)
 	fmt.Fprintf(&signature, "%s(", method.Name)
 	for i, t := range method.ReqTypes {
 		if t.Name == "void" {
 			break
 		}
-		fmt.Fprintf(&signature, "arg%d", i+1)
+		signature.WriteString(method.ArgName(i))
 		if i != len(method.ReqTypes)-1 {
 			signature.WriteString(", ")
 		}
-		fmt.Fprintf(&desc, "\n\t// arg%d: %s", i+1, t.Name)
+		lines = append(lines, fmt.Sprintf("@param {%s} %s", jsType(t), method.ArgName(i)))
 	}
 	signature.WriteByte(')')
-	if name := method.RetType.Name; name != "void" {
-		fmt.Fprintf(&desc, "\n\t// ret:  %s", name)
+	if method.RetType.Name != "void" {
+		lines = append(lines, fmt.Sprintf("@returns {%s}", jsType(method.RetType)))
+	}
+	for _, e := range method.Throws {
+		lines = append(lines, fmt.Sprintf("@throws {%s}", e.Name))
+	}
+	var desc string
+	if len(lines) != 0 {
+		desc = "\n" + strings.TrimSuffix(jsDoc("\t", lines...), "\n")
 	}
 	return &methodDesc{
-		Desc:      desc.String(),
+		Desc:      desc,
 		Signature: signature.String(),
 	}
 }
 
+// JSDoc中的类型名，嵌套的message使用Response.Item的形式，typedef使用别名
+func jsType(t *parse.Type) string {
+	if t.Alias != "" {
+		return t.Alias
+	}
+	switch t.Kind {
+	case parse.TypeKindList:
+		return "[]" + jsType(t.Elem)
+	case parse.TypeKindMap:
+		return fmt.Sprintf("map<%s,%s>", jsType(t.Key), jsType(t.Elem))
+	case parse.TypeKindArray:
+		return fmt.Sprintf("%s[%d]", jsType(t.Elem), t.Len)
+	case parse.TypeKindMessage:
+		if msg, ok := allMessages[t.Name]; ok {
+			return msg.QualName()
+		}
+	case parse.TypeKindStream:
+		if t.IsTypedStream() {
+			return fmt.Sprintf("AsyncIterable<%s>", jsType(t.Elem))
+		}
+	case parse.TypeKindNormal:
+		// duration为毫秒数
+		if t.Name == "timestamp" {
+			return "Date"
+		} else if t.Name == "duration" {
+			return "number"
+		}
+	}
+	return t.Name
+}
+
+// 生成JSDoc注释块，每行以indent缩进并以换行结尾，lines为空时返回空串
+func jsDoc(indent string, lines ...string) string {
+	if len(lines) == 0 {
+		return ""
+	}
+	var builder strings.Builder
+	fmt.Fprintf(&builder, "%s/**\n", indent)
+	for _, line := range lines {
+		if line == "" {
+			fmt.Fprintf(&builder, "%s *\n", indent)
+		} else {
+			fmt.Fprintf(&builder, "%s * %s\n", indent, line)
+		}
+	}
+	fmt.Fprintf(&builder, "%s */\n", indent)
+	return builder.String()
+}
+
+// 注释以及@deprecated对应的JSDoc标签
+func docLines(doc []string, annos parse.Annotations) []string {
+	lines := append([]string{}, doc...)
+	if reason, ok := annos.Deprecated(); ok {
+		lines = append(lines, strings.TrimSpace("@deprecated "+reason))
+	}
+	return lines
+}
+
+func removeEmpty(lines []string) []string {
+	var res []string
+	for _, line := range lines {
+		if line != "" {
+			res = append(res, line)
+		}
+	}
+	return res
+}
+
+// 工厂函数中初始化的成员，包括有默认值的成员以及有默认值的message成员
+func buildDefaults(msg *parse.Message) []string {
+	var fields []string
+	for _, mem := range msg.Mems {
+		if mem.Default != nil {
+			fields = append(fields, fmt.Sprintf("%s: %s", jsKey(mem.JSONName()), buildDefault(mem)))
+		} else if mem.Type.Kind == parse.TypeKindMessage && !mem.Optional && utils.HasDefaults(allMessages[mem.Type.Name], allMessages) {
+			fields = append(fields, fmt.Sprintf("%s: new%s()", jsKey(mem.JSONName()), mem.Type.Name))
+		}
+	}
+	return fields
+}
+
+func buildDefault(mem *parse.Member) string {
+	switch {
+	case mem.Type.Kind == parse.TypeKindEnum:
+		return fmt.Sprintf("%s.%s", mem.Type.Name, mem.Default.Value)
+	case mem.Default.Kind == parse.LiteralString:
+		return utils.Quote(mem.Default.Value)
+	}
+	return mem.Default.Value
+}
+
+// 对象字面量中的键，name不是合法标识符时加上引号
+func jsKey(name string) string {
+	if jsProperty("", name) == "."+name {
+		return name
+	}
+	return utils.Quote(name)
+}
+
+// 访问对象v的属性name，name不是合法标识符时使用下标形式
+func jsProperty(v, name string) string {
+	for i := 0; i < len(name); i++ {
+		ch := name[i]
+		if !(ch >= 'a' && ch <= 'z' || ch >= 'A' && ch <= 'Z' || ch == '_' || i != 0 && ch >= '0' && ch <= '9') {
+			return fmt.Sprintf(`%s["%s"]`, v, name)
+		}
+	}
+	return v + "." + name
+}
+
 func buildMethodsName(s *parse.Service) (string, []string) {
 	var builder strings.Builder
 	var methods []string
@@ -74,9 +201,9 @@ func buildChecks(method *parse.Method) []string {
 	var builder strings.Builder
 	var checks []string
 	for i, t := range method.ReqTypes {
-		fmt.Fprintf(&builder, `if (args[%d].name != "%s"`, i, t.Name)
-		if t.Kind == parse.TypeKindNormal && t.Name != "string" {
-			fmt.Fprintf(&builder, ` || args[%d].data.length != %d`, i, utils.TypeLength[t.Name])
+		fmt.Fprintf(&builder, `if (args[%d].name != "%s"`, i, t.WireName())
+		if t.WireKind() == parse.TypeKindNormal && !utils.IsVarLen(t) {
+			fmt.Fprintf(&builder, ` || args[%d].data.length != %d`, i, utils.TypeLength[t.WireName()])
 		}
 		fmt.Fprintf(&builder, `) throw "invalid type";`)
 		checks = append(checks, builder.String())
@@ -89,12 +216,24 @@ func buildUnmarshalArgs(method *parse.Method) []string {
 	var data []string
 	var builder strings.Builder
 	for i, t := range method.ReqTypes {
-		if t.Name == "string" {
+		if t.IsTypedStream() {
+			fmt.Fprintf(&builder, `let arg%d = decodeStream(args[%d].data, decode%s);`, i, i, t.Elem.Name)
+		} else if t.Name == "string" {
 			fmt.Fprintf(&builder, `let arg%d = args[%d].data.toString();`, i, i)
-		} else if t.Kind == parse.TypeKindMessage {
+		} else if t.Name == "bytes" {
+			fmt.Fprintf(&builder, `let arg%d = args[%d].data;`, i, i)
+		} else if t.Name == "bool" {
+			fmt.Fprintf(&builder, `let arg%d = args[%d].data.readUInt8() !== 0;`, i, i)
+		} else if t.WireKind() == parse.TypeKindMessage {
 			fmt.Fprintf(&builder, `let arg%d = JSON.parse(args[%d].data.toString());`, i, i)
+			if decode := buildValueDecode(t, fmt.Sprintf("arg%d", i), 0); decode != "" {
+				fmt.Fprintf(&builder, "\n\t\t%s", decode)
+			}
 		} else {
-			fmt.Fprintf(&builder, `let arg%d = Number(args[%d].data.%s());`, i, i, unmarshalMap[t.Name])
+			fmt.Fprintf(&builder, `let arg%d = Number(args[%d].data.%s());`, i, i, unmarshalMap[t.WireName()])
+		}
+		if t.Kind == parse.TypeKindEnum {
+			fmt.Fprintf(&builder, "\n\t\t"+`if (!Object.values(%s).includes(arg%d)) throw "invalid value for enum %s";`, t.Name, i, t.Name)
 		}
 		data = append(data, builder.String())
 		builder.Reset()
@@ -102,6 +241,15 @@ func buildUnmarshalArgs(method *parse.Method) []string {
 	return data
 }
 
+func buildArgValidates(method *parse.Method) []string {
+	var validates []string
+	for i, t := range method.ReqTypes {
+		label := method.Service.Name + "." + method.Name + "." + method.ArgName(i)
+		validates = append(validates, buildValidate(fmt.Sprintf("arg%d", i), t, false, method.ReqConstraints[i], label)...)
+	}
+	return validates
+}
+
 func buildCallHandler(method *parse.Method) string {
 	var args string
 	for i, _ := range method.ReqTypes {
@@ -125,55 +273,75 @@ func buildRespDesc(method *parse.Method) *respDesc {
 			Data:     `""`,
 		}
 	}
-	if t.Name == "string" {
+	if t.IsTypedStream() {
+		return &respDesc{
+			Prepare:  fmt.Sprintf("let data = await encodeStream(res, %s);", buildStreamEncode(t)),
+			TypeKind: parse.TypeKindStream,
+			Name:     t.WireName(),
+			Data:     "data",
+		}
+	}
+	if utils.IsVarLen(t) {
 		return &respDesc{
 			TypeKind: parse.TypeKindNormal,
 			Name:     t.Name,
 			Data:     "res",
 		}
 	}
-	if t.Kind == parse.TypeKindMessage {
+	if t.WireKind() == parse.TypeKindMessage {
 		return &respDesc{
 			TypeKind: parse.TypeKindMessage,
 			Name:     t.Name,
-			Data:     "JSON.stringify(res)",
+			Data:     stringify(buildValueEncode(t, "res", 0)),
 		}
 	}
 	var builder strings.Builder
-	fmt.Fprintf(&builder, "let data = Buffer.alloc(%d);", utils.TypeLength[t.Name])
+	fmt.Fprintf(&builder, "let data = Buffer.alloc(%d);", utils.TypeLength[t.WireName()])
 	src := "res"
 	if t.Name == "int64" || t.Name == "uint64" {
 		src = "BigInt(res)"
+	} else if t.Name == "bool" {
+		src = "res ? 1 : 0"
 	}
-	fmt.Fprintf(&builder, "\n\t\tdata.%s(%s);", marshalMap[t.Name], src)
+	fmt.Fprintf(&builder, "\n\t\tdata.%s(%s);", marshalMap[t.WireName()], src)
 	return &respDesc{
 		Prepare:  builder.String(),
 		TypeKind: parse.TypeKindNormal,
-		Name:     t.Name,
+		Name:     t.WireName(),
 		Data:     "data",
 	}
 }
 
-func buildMarshalArg(i int, t *parse.Type) string {
+// stream<Msg>中单条消息的序列化函数
+func buildStreamEncode(t *parse.Type) string {
+	return "v => " + stringify(buildValueEncode(t.Elem, "v", 0))
+}
+
+func buildMarshalArg(i int, name string, t *parse.Type) string {
 	const format = `req.args.push({
             typeKind: %d,
             name: '%s',
             data: %s,
         })`
-	if t.Name == "string" {
-		return fmt.Sprintf(format, t.Kind, t.Name, fmt.Sprintf("arg%d", i))
+	if t.IsTypedStream() {
+		return fmt.Sprintf(format, t.WireKind(), t.WireName(), fmt.Sprintf("await encodeStream(%s, %s)", name, buildStreamEncode(t)))
+	}
+	if utils.IsVarLen(t) {
+		return fmt.Sprintf(format, t.Kind, t.Name, name)
 	}
-	if t.Kind == parse.TypeKindMessage {
-		return fmt.Sprintf(format, t.Kind, t.Name, fmt.Sprintf("JSON.stringify(arg%d)", i))
+	if t.WireKind() == parse.TypeKindMessage {
+		return fmt.Sprintf(format, t.WireKind(), t.Name, stringify(buildValueEncode(t, name, 0)))
 	}
 	var builder strings.Builder
-	fmt.Fprintf(&builder, "let buf%d = Buffer.alloc(%d)\n", i, utils.TypeLength[t.Name])
-	src := fmt.Sprintf("arg%d", i)
+	fmt.Fprintf(&builder, "let buf%d = Buffer.alloc(%d)\n", i, utils.TypeLength[t.WireName()])
+	src := name
 	if t.Name == "uint64" || t.Name == "int64" {
 		src = fmt.Sprintf("BigInt(%s)", src)
+	} else if t.Name == "bool" {
+		src = fmt.Sprintf("%s ? 1 : 0", src)
 	}
-	fmt.Fprintf(&builder, "\t\tbuf%d.%s(%s)\n\t\t", i, marshalMap[t.Name], src)
-	fmt.Fprintf(&builder, format, t.Kind, t.Name, fmt.Sprintf("buf%d", i))
+	fmt.Fprintf(&builder, "\t\tbuf%d.%s(%s)\n\t\t", i, marshalMap[t.WireName()], src)
+	fmt.Fprintf(&builder, format, t.WireKind(), t.WireName(), fmt.Sprintf("buf%d", i))
 	return builder.String()
 }
 
@@ -181,28 +349,186 @@ func buildRespCheck(method *parse.Method) string {
 	var builder strings.Builder
 	ret := method.RetType
 	if ret.Name != "void" {
-		fmt.Fprintf(&builder, `resp.name != "%s"`, ret.Name)
+		fmt.Fprintf(&builder, `resp.name != "%s"`, ret.WireName())
 	}
-	if ret.Kind == parse.TypeKindNormal && ret.Name != "string" {
+	if ret.WireKind() == parse.TypeKindNormal && !utils.IsVarLen(ret) {
 		if ret.Name != "void" {
 			fmt.Fprintf(&builder, " || ")
 		}
-		fmt.Fprintf(&builder, `resp.dataLen != %d`, utils.TypeLength[ret.Name])
+		fmt.Fprintf(&builder, `resp.dataLen != %d`, utils.TypeLength[ret.WireName()])
 	}
 	return builder.String()
 }
 
 func buildUnmashalResp(t *parse.Type) string {
+	if t.IsTypedStream() {
+		return fmt.Sprintf("resolve(decodeStream(resp.data, decode%s));", t.Elem.Name)
+	}
 	if t.Name == "string" {
 		return "resolve(resp.data.toString());"
 	}
 	if t.Name == "void" {
 		return "resolve();"
 	}
-	if t.Kind == parse.TypeKindMessage {
-		return "resolve(JSON.parse(resp.data.toString()));"
+	if t.Name == "bytes" {
+		return "resolve(resp.data);"
+	}
+	if t.Name == "bool" {
+		return "resolve(resp.data.readUInt8() !== 0);"
+	}
+	if t.WireKind() == parse.TypeKindMessage {
+		decode := buildValueDecode(t, "res", 0)
+		if decode == "" {
+			return "resolve(JSON.parse(resp.data.toString()));"
+		}
+		return fmt.Sprintf(`let res;
+				try {
+					res = JSON.parse(resp.data.toString());
+					%s
+				} catch (e) {
+					reject(new Error(e));
+					return;
+				}
+				resolve(res);`, decode)
+	}
+	return fmt.Sprintf(`resolve(Number(resp.data.%s()));`, unmarshalMap[t.WireName()])
+}
+
+// 生成对值v中所有message进行检查、将bytes转换为Buffer的语句，无需处理时返回空串。
+// message、list和map可能被序列化为null，depth用于区分嵌套容器的循环变量
+func buildValueDecode(t *parse.Type, v string, depth int) string {
+	switch {
+	case t.Kind == parse.TypeKindMessage:
+		return fmt.Sprintf("if (%s !== undefined && %s !== null) decode%s(%s);", v, v, t.Name, v)
+	case t.Name == "bytes":
+		return fmt.Sprintf(`if (typeof %s === "string") %s = Buffer.from(%s, "base64");`, v, v, v)
+	case t.Name == "timestamp":
+		return fmt.Sprintf(`if (typeof %s === "string") %s = new Date(%s);`, v, v, v)
+	case t.Name == "duration":
+		return fmt.Sprintf(`if (typeof %s === "number") %s = %s / 1e6;`, v, v, v)
+	case t.Kind == parse.TypeKindList:
+		i, a := fmt.Sprintf("i%d", depth), fmt.Sprintf("a%d", depth)
+		if decode := buildValueDecode(t.Elem, fmt.Sprintf("%s[%s]", a, i), depth+1); decode != "" {
+			return fmt.Sprintf("(%s || []).forEach((_, %s, %s) => { %s });", v, i, a, decode)
+		}
+	case t.Kind == parse.TypeKindMap:
+		k := fmt.Sprintf("k%d", depth)
+		if decode := buildValueDecode(t.Elem, fmt.Sprintf("%s[%s]", v, k), depth+1); decode != "" {
+			return fmt.Sprintf("Object.keys(%s || {}).forEach(%s => { %s });", v, k, decode)
+		}
+	}
+	return ""
+}
+
+// 生成将值v中的duration由毫秒数转换为纳秒数的表达式，无需转换时返回v本身
+func buildValueEncode(t *parse.Type, v string, depth int) string {
+	if !needsEncode(t) {
+		return v
+	}
+	switch t.Kind {
+	case parse.TypeKindMessage:
+		return fmt.Sprintf("encode%s(%s)", t.Name, v)
+	case parse.TypeKindList:
+		e := fmt.Sprintf("e%d", depth)
+		return fmt.Sprintf("encodeList(%s, %s => %s)", v, e, buildValueEncode(t.Elem, e, depth+1))
+	case parse.TypeKindMap:
+		e := fmt.Sprintf("e%d", depth)
+		return fmt.Sprintf("encodeMap(%s, %s => %s)", v, e, buildValueEncode(t.Elem, e, depth+1))
+	}
+	return fmt.Sprintf("encodeDuration(%s)", v)
+}
+
+// 序列化前是否需要转换duration
+func needsEncode(t *parse.Type) bool {
+	return typeNeedsEncode(t, make(map[string]bool))
+}
+
+func typeNeedsEncode(t *parse.Type, visited map[string]bool) bool {
+	switch t.Kind {
+	case parse.TypeKindList, parse.TypeKindMap:
+		return typeNeedsEncode(t.Elem, visited)
+	case parse.TypeKindMessage:
+		msg, ok := allMessages[t.Name]
+		if !ok || visited[t.Name] {
+			return false
+		}
+		visited[t.Name] = true
+		for _, mem := range msg.Mems {
+			if typeNeedsEncode(mem.Type, visited) {
+				return true
+			}
+		}
+		return false
+	}
+	return t.Name == "duration"
+}
+
+// 生成检查值v是否满足约束cs的语句，不满足时抛出错误信息，label为错误信息中的名称
+func buildValidate(v string, t *parse.Type, optional bool, cs parse.Constraints, label string) []string {
+	var checks []string
+	var guard string
+	if optional {
+		guard = fmt.Sprintf("%s !== undefined && %s !== null && ", v, v)
+	}
+	// 与其他语言一致，字符串长度为UTF-8编码的字节数。Go中为nil的list、map和bytes序列化为null
+	length := fmt.Sprintf("(%s || []).length", v)
+	if t.Name == "string" {
+		length = fmt.Sprintf("Buffer.byteLength(%s)", v)
+	} else if t.Kind == parse.TypeKindMap {
+		length = fmt.Sprintf("Object.keys(%s || {}).length", v)
+	}
+	for _, c := range cs {
+		var cond string
+		switch c.Name {
+		case "min":
+			cond = fmt.Sprintf("%s < %s", v, c.Value.Value)
+		case "max":
+			cond = fmt.Sprintf("%s > %s", v, c.Value.Value)
+		case "minlen":
+			cond = fmt.Sprintf("%s < %s", length, c.Value.Value)
+		case "maxlen":
+			cond = fmt.Sprintf("%s > %s", length, c.Value.Value)
+		case "pattern":
+			cond = fmt.Sprintf("!new RegExp(%s).test(%s)", utils.Quote(c.Value.Value), v)
+		}
+		checks = append(checks, fmt.Sprintf("if (%s%s) throw %s;", guard, cond, utils.Quote(utils.ConstraintError(label, c))))
+	}
+	if validate := buildElemValidate(v, t, 0); validate != "" {
+		checks = append(checks, validate)
+	}
+	return checks
+}
+
+// 校验message以及list、map中的message，validate<Message>会忽略undefined和null
+func buildElemValidate(v string, t *parse.Type, depth int) string {
+	if !utils.TypeNeedsValidate(t, allMessages) {
+		return ""
+	}
+	e := fmt.Sprintf("e%d", depth)
+	switch t.Kind {
+	case parse.TypeKindList:
+		return fmt.Sprintf("(%s || []).forEach(%s => { %s });", v, e, buildElemValidate(e, t.Elem, depth+1))
+	case parse.TypeKindMap:
+		return fmt.Sprintf("Object.values(%s || {}).forEach(%s => { %s });", v, e, buildElemValidate(e, t.Elem, depth+1))
+	}
+	return fmt.Sprintf("validate%s(%s);", t.Name, v)
+}
+
+// oneof至多只能有一个变体，且必须为已知的变体
+func buildOneofDecode(oneof *parse.Oneof, message string) []string {
+	v := jsProperty("v", oneof.Name)
+	var keys []string
+	for _, mem := range oneof.Mems {
+		keys = append(keys, utils.Quote(mem.JSONName()))
+	}
+	checks := []string{fmt.Sprintf(`if (%s !== undefined && %s !== null && (typeof %s !== "object" || Object.keys(%s).length > 1 || Object.keys(%s).some(k => ![%s].includes(k)))) throw "invalid oneof %s of message %s";`,
+		v, v, v, v, v, strings.Join(keys, ", "), oneof.Name, message)}
+	for _, mem := range oneof.Mems {
+		if decode := buildValueDecode(mem.Type, jsProperty(v, mem.JSONName()), 0); decode != "" {
+			checks = append(checks, fmt.Sprintf("if (%s) %s", v, decode))
+		}
 	}
-	return fmt.Sprintf(`resolve(Number(resp.data.%s()));`, unmarshalMap[t.Name])
+	return checks
 }
 
 func buildClientMethod(method *parse.Method) *clientMethod {
@@ -212,10 +538,24 @@ func buildClientMethod(method *parse.Method) *clientMethod {
 	data.MethodDesc = buildNodeMethod(method)
 	data.ArgCnt = len(method.ReqTypes)
 	for i, t := range method.ReqTypes {
-		data.MashalArgs = append(data.MashalArgs, buildMarshalArg(i+1, t))
+		data.MashalArgs = append(data.MashalArgs, buildMarshalArg(i+1, method.ArgName(i), t))
 	}
 	data.RespCheck = buildRespCheck(method)
 	data.UnmashalResp = buildUnmashalResp(method.RetType)
+	// 将服务端返回的错误还原为throws声明的error
+	data.Reject = "err"
+	if len(method.Throws) != 0 {
+		var names []string
+		for _, e := range method.Throws {
+			names = append(names, e.Name)
+		}
+		data.Reject = fmt.Sprintf("decodeError(err, [%s])", strings.Join(names, ", "))
+	}
+	data.Oneway = method.Oneway
+	if d := method.Timeout(); d != 0 {
+		// 不足1ms的按1ms计算
+		data.Timeout = int64((d + time.Millisecond - 1) / time.Millisecond)
+	}
 
 	return data
 }
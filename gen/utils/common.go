@@ -1,6 +1,10 @@
 package utils
 
-import "gufeijun/hustgen/parse"
+import (
+	"fmt"
+	"gufeijun/hustgen/parse"
+	"strings"
+)
 
 func TraverseMethod(infos *parse.Symbols, callback func(method *parse.Method) (end bool)) {
 	for _, s := range infos.Services {
@@ -46,4 +50,132 @@ var TypeLength = map[string]int{
 	"uint64":  8,
 	"float32": 4,
 	"float64": 8,
+	"bool":    1,
+}
+
+// string和bytes以原始字节传输，长度不固定
+func IsVarLen(t *parse.Type) bool {
+	return t.Name == "string" || t.Name == "bytes"
+}
+
+// timestamp和duration在json中分别为RFC3339格式的字符串以及纳秒数
+func IsTime(t *parse.Type) bool {
+	return t.Name == "timestamp" || t.Name == "duration"
+}
+
+// 将IDL中的注释转换为以//开头的注释行，每行以indent缩进并以换行结尾
+func LineComment(doc []string, indent string) string {
+	var builder strings.Builder
+	for _, line := range doc {
+		if line == "" {
+			fmt.Fprintf(&builder, "%s//\n", indent)
+		} else {
+			fmt.Fprintf(&builder, "%s// %s\n", indent, line)
+		}
+	}
+	return builder.String()
+}
+
+// 注释以及@deprecated对应的说明，弃用说明作为单独的段落以"Deprecated: "开头
+func DocLines(doc []string, annos parse.Annotations) []string {
+	reason, ok := annos.Deprecated()
+	if !ok {
+		return doc
+	}
+	if reason == "" {
+		reason = "do not use."
+	}
+	lines := append([]string{}, doc...)
+	if len(lines) != 0 {
+		lines = append(lines, "")
+	}
+	return append(lines, "Deprecated: "+reason)
+}
+
+// 双引号包围的字符串字面量，只需转义"和\，可直接用于Go、C和JavaScript代码中
+func Quote(s string) string {
+	return `"` + strings.NewReplacer(`\`, `\\`, `"`, `\"`).Replace(s) + `"`
+}
+
+// message的成员是否有默认值，非optional的message成员有默认值时同样视为有默认值。
+// 有默认值的message需要生成构造函数，msgs为所有可见的message
+func HasDefaults(msg *parse.Message, msgs map[string]*parse.Message) bool {
+	return hasDefaults(msg, msgs, make(map[*parse.Message]bool))
+}
+
+func hasDefaults(msg *parse.Message, msgs map[string]*parse.Message, visited map[*parse.Message]bool) bool {
+	if visited[msg] {
+		return false
+	}
+	visited[msg] = true
+	for _, mem := range msg.Mems {
+		if mem.Default != nil {
+			return true
+		}
+		if mem.Type.Kind == parse.TypeKindMessage && !mem.Optional && hasDefaults(msgs[mem.Type.Name], msgs, visited) {
+			return true
+		}
+	}
+	return false
+}
+
+// message的成员或其中的message是否有校验约束，需要校验的message需要生成校验函数，msgs为所有可见的message
+func NeedsValidate(msg *parse.Message, msgs map[string]*parse.Message) bool {
+	return needsValidate(msg, msgs, make(map[*parse.Message]bool))
+}
+
+func needsValidate(msg *parse.Message, msgs map[string]*parse.Message, visited map[*parse.Message]bool) bool {
+	if visited[msg] {
+		return false
+	}
+	visited[msg] = true
+	for _, mem := range msg.Mems {
+		if len(mem.Constraints) != 0 || typeNeedsValidate(mem.Type, msgs, visited) {
+			return true
+		}
+	}
+	for _, oneof := range msg.Oneofs {
+		for _, mem := range oneof.Mems {
+			if typeNeedsValidate(mem.Type, msgs, visited) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// 类型为t的值是否需要校验，即其本身或list、map中的元素为需要校验的message
+func TypeNeedsValidate(t *parse.Type, msgs map[string]*parse.Message) bool {
+	return typeNeedsValidate(t, msgs, make(map[*parse.Message]bool))
+}
+
+func typeNeedsValidate(t *parse.Type, msgs map[string]*parse.Message, visited map[*parse.Message]bool) bool {
+	for ; t.Kind == parse.TypeKindList || t.Kind == parse.TypeKindMap; t = t.Elem {
+	}
+	return t.Kind == parse.TypeKindMessage && needsValidate(msgs[t.Name], msgs, visited)
+}
+
+// 方法的参数是否需要校验
+func ArgsNeedValidate(method *parse.Method, msgs map[string]*parse.Message) bool {
+	for i, t := range method.ReqTypes {
+		if len(method.ReqConstraints[i]) != 0 || TypeNeedsValidate(t, msgs) {
+			return true
+		}
+	}
+	return false
+}
+
+// 不满足约束时的错误信息，各语言生成的代码使用相同的错误信息
+func ConstraintError(label string, c *parse.Constraint) string {
+	switch c.Name {
+	case "min":
+		return fmt.Sprintf("%s must be >= %s", label, c.Value.Value)
+	case "max":
+		return fmt.Sprintf("%s must be <= %s", label, c.Value.Value)
+	case "minlen":
+		return fmt.Sprintf("length of %s must be >= %s", label, c.Value.Value)
+	case "maxlen":
+		return fmt.Sprintf("length of %s must be <= %s", label, c.Value.Value)
+	}
+	return fmt.Sprintf("%s must match pattern \"%s\"", label, c.Value.Value)
 }
@@ -7,15 +7,30 @@ import (
 	"gufeijun/hustgen/gen"
 	"gufeijun/hustgen/parse"
 	"os"
+	"strings"
 )
 
 var (
 	printVersion = flag.Bool("version", false, "print program build version")
 	lang         = flag.String("lang", "c", "the target languege the IDL will be compliled to. c, go or node.")
 	dir          = flag.String("dir", "gfj", "the dirpath where the generated source code files will be placed")
+	includeDirs  dirList
 )
 
+// 可多次指定的目录参数
+type dirList []string
+
+func (d *dirList) String() string {
+	return strings.Join(*d, ",")
+}
+
+func (d *dirList) Set(dir string) error {
+	*d = append(*d, dir)
+	return nil
+}
+
 func init() {
+	flag.Var(&includeDirs, "I", "the directory to search for imported IDL files, can be specified multiple times")
 	flag.Parse()
 }
 
@@ -37,7 +52,7 @@ func main() {
 	args := flag.Args()
 	var err error
 	for _, srcIDL := range args {
-		parser := parse.NewParser(srcIDL)
+		parser := parse.NewParser(srcIDL, includeDirs)
 		if err = parser.Parse(); err != nil {
 			break
 		}
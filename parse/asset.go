@@ -1,61 +1,444 @@
 package parse
 
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
 const (
 	TypeKindNormal = iota
 	TypeKindStream
 	TypeKindMessage
 	TypeKindErr
 	TypeKindNoRTN
+	TypeKindList
+	TypeKindMap
+	TypeKindEnum
+	TypeKindArray
 )
 
 var BuiltinTypes = map[string]struct{}{
-	"int8":    struct{}{},
-	"uint8":   struct{}{},
-	"int16":   struct{}{},
-	"uint16":  struct{}{},
-	"int32":   struct{}{},
-	"uint32":  struct{}{},
-	"int64":   struct{}{},
-	"uint64":  struct{}{},
-	"float32": struct{}{},
-	"float64": struct{}{},
-	"string":  struct{}{},
-	"stream":  struct{}{},
-	"istream": struct{}{},
-	"ostream": struct{}{},
-	"void":    struct{}{},
+	"int8":      struct{}{},
+	"uint8":     struct{}{},
+	"int16":     struct{}{},
+	"uint16":    struct{}{},
+	"int32":     struct{}{},
+	"uint32":    struct{}{},
+	"int64":     struct{}{},
+	"uint64":    struct{}{},
+	"float32":   struct{}{},
+	"float64":   struct{}{},
+	"bool":      struct{}{},
+	"string":    struct{}{},
+	"bytes":     struct{}{},
+	"timestamp": struct{}{},
+	"duration":  struct{}{},
+	"stream":    struct{}{},
+	"istream":   struct{}{},
+	"ostream":   struct{}{},
+	"void":      struct{}{},
 }
 
 type Symbols struct {
+	Package  string // package声明，如foo.bar，未声明时为空
 	Services map[string]*Service
 	Messages map[string]*Message
+	Enums    map[string]*Enum
+	Consts   map[string]*Const
+	Typedefs map[string]*Typedef
+	Errors   map[string]*Error
+	Imports  []*Import // 直接导入的文件
+	// 泛型message，如Page<T>，不直接生成代码，实例化后的Page_User等作为普通message加入Messages
+	Generics map[string]*Message
+}
+
+// 加上package前缀的名称，用于在传输时区分不同package中的同名服务
+func (s *Symbols) Qualify(name string) string {
+	if s.Package == "" {
+		return name
+	}
+	return s.Package + "." + name
+}
+
+type Import struct {
+	Path  string   // import语句中的路径
+	File  string   // 实际找到的文件路径
+	Infos *Symbols // 被导入文件的语法树
+}
+
+func newSymbols() *Symbols {
+	return &Symbols{
+		Services: make(map[string]*Service),
+		Messages: make(map[string]*Message),
+		Enums:    make(map[string]*Enum),
+		Consts:   make(map[string]*Const),
+		Typedefs: make(map[string]*Typedef),
+		Errors:   make(map[string]*Error),
+		Generics: make(map[string]*Message),
+	}
+}
+
+// 遍历当前文件以及直接或间接导入的所有文件，每个文件只访问一次
+func (s *Symbols) walk(visit func(syms *Symbols)) {
+	visited := make(map[*Symbols]bool)
+	var walk func(syms *Symbols)
+	walk = func(syms *Symbols) {
+		if visited[syms] {
+			return
+		}
+		visited[syms] = true
+		visit(syms)
+		for _, imp := range syms.Imports {
+			walk(imp.Infos)
+		}
+	}
+	walk(s)
+}
+
+// 当前文件以及所有导入的文件中定义的message
+func (s *Symbols) AllMessages() map[string]*Message {
+	msgs := make(map[string]*Message)
+	s.walk(func(syms *Symbols) {
+		for name, msg := range syms.Messages {
+			msgs[name] = msg
+		}
+	})
+	return msgs
+}
+
+// 当前文件以及所有导入的文件中定义的enum
+func (s *Symbols) AllEnums() map[string]*Enum {
+	enums := make(map[string]*Enum)
+	s.walk(func(syms *Symbols) {
+		for name, enum := range syms.Enums {
+			enums[name] = enum
+		}
+	})
+	return enums
+}
+
+// 当前文件以及所有导入的文件中定义的常量
+func (s *Symbols) AllConsts() map[string]*Const {
+	consts := make(map[string]*Const)
+	s.walk(func(syms *Symbols) {
+		for name, c := range syms.Consts {
+			consts[name] = c
+		}
+	})
+	return consts
+}
+
+// 当前文件以及所有导入的文件中定义的类型别名
+func (s *Symbols) AllTypedefs() map[string]*Typedef {
+	defs := make(map[string]*Typedef)
+	s.walk(func(syms *Symbols) {
+		for name, def := range syms.Typedefs {
+			defs[name] = def
+		}
+	})
+	return defs
+}
+
+// 当前文件以及所有导入的文件中定义的泛型message
+func (s *Symbols) AllGenerics() map[string]*Message {
+	generics := make(map[string]*Message)
+	s.walk(func(syms *Symbols) {
+		for name, msg := range syms.Generics {
+			generics[name] = msg
+		}
+	})
+	return generics
+}
+
+// 当前文件以及所有导入的文件中定义的error
+func (s *Symbols) AllErrors() map[string]*Error {
+	errs := make(map[string]*Error)
+	s.walk(func(syms *Symbols) {
+		for name, e := range syms.Errors {
+			errs[name] = e
+		}
+	})
+	return errs
 }
 
 type Service struct {
-	Name    string    // 服务名
-	Methods []*Method // 这个服务下的所有方法
+	Name      string      // 服务名
+	Methods   []*Method   // 这个服务下的所有方法，包括继承的方法
+	Doc       []string    // IDL中的注释，每个元素为一行
+	Annos     Annotations // 注解
+	BaseNames []string    // extends的服务名
+	Bases     []*Service  // 继承的服务，与BaseNames一一对应
 }
 
 type Message struct {
-	Name string    // Message名
-	Mems []*Member // 包含的成员
+	Name   string      // Message名，嵌套的message以外层message名为前缀，如Response_Item
+	Mems   []*Member   // 包含的成员，不包括oneof中的成员
+	Oneofs []*Oneof    // 包含的oneof
+	Doc    []string    // IDL中的注释
+	Annos  Annotations // 注解
+	Parent *Message    // 外层message，未嵌套时为nil
+	// reserved声明的已废弃的成员编号和成员名，不能再被成员使用
+	ReservedTags  []int32
+	ReservedNames []string
+	TypeParams    []string // 泛型message的类型形参，如Page<T>中的T
+	// 由泛型message实例化得到时为对应的泛型message以及类型实参，否则为nil
+	Generic  *Message
+	TypeArgs []*Type
+}
+
+// IDL中以.分隔的完整名称，如Response.Item
+func (m *Message) QualName() string {
+	if m.Parent == nil {
+		return m.Name
+	}
+	return m.Parent.QualName() + "." + strings.TrimPrefix(m.Name, m.Parent.Name+"_")
+}
+
+// message中的oneof，同一时刻至多有一个成员(变体)有值。
+// 序列化时以oneof名为键，值为仅包含一个键值对的对象，如"Shape": {"Circle": {...}}，没有变体有值时不进行序列化
+type Oneof struct {
+	Name string    // oneof名
+	Mems []*Member // 变体，只能为message、enum、string、bool或数值类型，不能为optional也不能有默认值
+	Doc  []string  // IDL中的注释
+}
+
+type Enum struct {
+	Name string        // 枚举名
+	Mems []*EnumMember // 枚举成员
+}
+
+// 获取指定名称的枚举成员，不存在时返回nil
+func (e *Enum) Member(name string) *EnumMember {
+	for _, mem := range e.Mems {
+		if mem.Name == name {
+			return mem
+		}
+	}
+	return nil
+}
+
+type EnumMember struct {
+	Name  string // 成员名
+	Value int32  // 成员值
+}
+
+// 形如const uint32 MaxPageSize = 100的常量
+type Const struct {
+	Name  string   // 常量名
+	Type  *Type    // 常量类型，只能为数值、bool或string
+	Value *Literal // 常量值
+	Doc   []string // IDL中的注释
+}
+
+// 形如typedef string UserID的类型别名，传输时与底层类型相同
+type Typedef struct {
+	Name string   // 别名
+	Type *Type    // 底层类型，只能为数值、bool、string、bytes或其他别名。别名的别名Alias为被引用的别名
+	Doc  []string // IDL中的注释
+}
+
+// 形如error NotFound = 404 { string Resource }的错误，成员的定义与message相同。
+// 传输时编码为错误信息{"code":404,"error":"NotFound","data":{"Resource":"..."}}，其中error为加上package前缀的名称
+type Error struct {
+	*Message       // 错误携带的数据，同时记录在Symbols.Messages中
+	Code     int32 // 错误码，在当前文件以及导入的文件中唯一
+}
+
+// 字面量的类型
+const (
+	LiteralInt    = iota // 整数
+	LiteralFloat         // 小数
+	LiteralString        // 双引号包围的字符串
+	LiteralBool          // true或false
+	LiteralIdent         // 其他标识符
+)
+
+type Literal struct {
+	Kind  int    // 字面量的类型
+	Value string // 字面量的值，字符串为去除引号以及转义后的值
 }
 
 type Method struct {
-	Service  *Service // 这是属于哪个服务的方法
-	RetType  *Type    // 方法返回值
-	ReqTypes []*Type  // 方法请求参数
-	Name     string   // 方法名
+	Service  *Service    // 这是属于哪个服务的方法
+	RetType  *Type       // 方法返回值
+	ReqTypes []*Type     // 方法请求参数
+	ReqNames []string    // 请求参数名，与ReqTypes一一对应，未命名的参数为空串
+	Name     string      // 方法名
+	Doc      []string    // IDL中的注释
+	Annos    Annotations // 注解
+	Origin   *Method     // 继承的方法为基服务中最初定义的方法，否则为nil
+	// throws声明的error名
+	ThrowNames []string
+	// 方法可能返回的error，与ThrowNames一一对应
+	Throws []*Error
+	// 请求参数的校验约束，与ReqTypes一一对应
+	ReqConstraints []Constraints
+	// oneway的方法客户端只发送请求而不等待响应，idempotent的方法调用失败时可以安全地重试
+	Oneway     bool
+	Idempotent bool
+	// timeout修饰符指定的超时时间，未指定时为0，通过Timeout获取
+	timeout time.Duration
+}
+
+// 第i个请求参数的参数名，未命名时为arg<i+1>
+func (m *Method) ArgName(i int) string {
+	if m.ReqNames[i] != "" {
+		return m.ReqNames[i]
+	}
+	return fmt.Sprintf("arg%d", i+1)
+}
+
+// 方法的超时时间，由方法的timeout修饰符或者方法、所属服务的@timeout指定，未指定时为0。
+// 继承的方法以定义它的服务为准，oneway的方法不等待响应，超时时间总是0
+func (m *Method) Timeout() time.Duration {
+	if m.Origin != nil {
+		return m.Origin.Timeout()
+	}
+	if m.Oneway {
+		return 0
+	}
+	if m.timeout != 0 {
+		return m.timeout
+	}
+	if anno := m.Annos.Get("timeout"); anno != nil {
+		return anno.Duration
+	}
+	if anno := m.Service.Annos.Get("timeout"); anno != nil {
+		return anno.Duration
+	}
+	return 0
+}
+
+// 是否存在命名的请求参数
+func (m *Method) NamedArgs() bool {
+	for _, name := range m.ReqNames {
+		if name != "" {
+			return true
+		}
+	}
+	return false
 }
 
 type Member struct {
-	Type *Type  // 成员的类型信息
-	Name string // 成员名
+	Type     *Type       // 成员的类型信息
+	Name     string      // 成员名
+	Optional bool        // 是否为可选成员
+	Default  *Literal    // 成员的默认值，未指定时为nil
+	Doc      []string    // IDL中的注释
+	Annos    Annotations // 注解
+	// 校验约束，如[min=0, max=150]
+	Constraints Constraints
+	// 成员编号，由@tag(1)指定，未指定时为0
+	Tag int32
+}
+
+// 序列化时使用的键名，由@json指定，未指定时为成员名
+func (m *Member) JSONName() string {
+	if anno := m.Annos.Get("json"); anno != nil {
+		return anno.Value
+	}
+	return m.Name
+}
+
+// 形如name=value的校验约束，服务端在调用用户实现之前进行检查
+type Constraint struct {
+	Name  string   // 约束名，min、max、minlen、maxlen或pattern
+	Value *Literal // 约束的值
+}
+
+type Constraints []*Constraint
+
+// 获取指定名称的约束，不存在时返回nil
+func (cs Constraints) Get(name string) *Constraint {
+	for _, c := range cs {
+		if c.Name == name {
+			return c
+		}
+	}
+	return nil
+}
+
+// 注解参数的类型
+const (
+	AnnoValueNone     = iota // 无参数，如@deprecated
+	AnnoValueString          // 字符串，如@json("num_a")
+	AnnoValueNumber          // 整数，如@version(2)
+	AnnoValueDuration        // 时间间隔，如@timeout(500ms)
+	AnnoValueIdent           // 标识符，如@level(high)
+)
+
+// 形如@name或@name(value)的注解，未知的注解不做检查，原样保留给生成器使用
+type Annotation struct {
+	Name     string        // 注解名，不包括@
+	Kind     int           // 参数类型
+	Value    string        // 参数的原始值，字符串参数为去除引号后的值
+	Number   int64         // 整数参数的值
+	Duration time.Duration // 时间间隔参数的值
+}
+
+type Annotations []*Annotation
+
+// 获取指定名称的注解，不存在时返回nil
+func (as Annotations) Get(name string) *Annotation {
+	for _, anno := range as {
+		if anno.Name == name {
+			return anno
+		}
+	}
+	return nil
+}
+
+// 是否标记了@deprecated，reason为其中的说明，可以为空
+func (as Annotations) Deprecated() (reason string, ok bool) {
+	anno := as.Get("deprecated")
+	if anno == nil {
+		return "", false
+	}
+	return anno.Value, true
 }
 
 type Type struct {
-	Kind uint16 // 0 normal, 1 stream, 2 message
+	Kind uint16 // 0 normal, 1 stream, 2 message, 5 list, 6 map, 7 enum, 8 array
 	Name string // 类型名
+	Elem *Type  // list、定长数组的元素类型、map的值类型或者stream<Msg>的元素类型
+	Len  int    // 定长数组的长度
+	Key  *Type  // map的键类型
+	// 通过typedef引用的类型为别名，此时Kind和Name为底层类型的信息
+	Alias string
+	Args  []*Type // 泛型message的类型实参，如Page<User>中的User，实例化后Name为实例名，Args置为nil
+}
+
+// 传输时使用的类型种类，list和map同message一样以json序列化传输，enum以int32传输
+func (t *Type) WireKind() uint16 {
+	switch t.Kind {
+	case TypeKindList, TypeKindMap, TypeKindArray:
+		return TypeKindMessage
+	case TypeKindEnum:
+		return TypeKindNormal
+	}
+	// timestamp和duration作为参数或返回值时与message一样以json传输
+	if isTime(t.Name) {
+		return TypeKindMessage
+	}
+	return t.Kind
+}
+
+// 传输时使用的类型名
+func (t *Type) WireName() string {
+	if t.Kind == TypeKindEnum {
+		return "int32"
+	}
+	if t.IsTypedStream() {
+		return "istream"
+	}
+	return t.Name
+}
+
+// 是否为stream<Msg>
+func (t *Type) IsTypedStream() bool {
+	return t.Kind == TypeKindStream && t.Elem != nil
 }
 
 func newType(name string) *Type {
@@ -70,8 +453,78 @@ func newType(name string) *Type {
 	return t
 }
 
+// stream<Msg>，以长度前缀分帧依次传输message，传输时与istream相同
+func newStreamType(elem *Type) *Type {
+	return &Type{
+		Kind: TypeKindStream,
+		Name: "stream<" + elem.Name + ">",
+		Elem: elem,
+	}
+}
+
+// 泛型message的实例，如Page<User>，语义检查时替换为实例化后的message
+func newGenericType(name string, args []*Type) *Type {
+	return &Type{
+		Kind: TypeKindMessage,
+		Name: name,
+		Args: args,
+	}
+}
+
+func newListType(elem *Type) *Type {
+	return &Type{
+		Kind: TypeKindList,
+		Name: "[]" + elem.Name,
+		Elem: elem,
+	}
+}
+
+// 定长数组，如uint8[16]，json中为长度固定的数组
+func newArrayType(elem *Type, n int) *Type {
+	return &Type{
+		Kind: TypeKindArray,
+		Name: elem.Name + "[" + strconv.Itoa(n) + "]",
+		Elem: elem,
+		Len:  n,
+	}
+}
+
+func newMapType(key, value *Type) *Type {
+	return &Type{
+		Kind: TypeKindMap,
+		Name: "map<" + key.Name + "," + value.Name + ">",
+		Elem: value,
+		Key:  key,
+	}
+}
+
+// 去除list、map、定长数组以及stream<Msg>的包装，获取最内层的元素类型
+func baseType(t *Type) *Type {
+	for t.Kind == TypeKindList || t.Kind == TypeKindMap || t.Kind == TypeKindArray || t.IsTypedStream() {
+		t = t.Elem
+	}
+	return t
+}
+
+// map的键只能为string或整数类型
+func isMapKey(t *Type) bool {
+	if t.Kind != TypeKindNormal {
+		return false
+	}
+	switch t.Name {
+	case "float32", "float64", "bool", "bytes", "void", "timestamp", "duration":
+		return false
+	}
+	return true
+}
+
 func isStream(name string) bool {
-	return name == "stream" || name == "istream" || name == "ostream"
+	return name == "stream" || name == "istream" || name == "ostream" || strings.HasPrefix(name, "stream<")
+}
+
+// timestamp在json中为RFC3339格式的字符串，duration为纳秒数
+func isTime(name string) bool {
+	return name == "timestamp" || name == "duration"
 }
 
 func isBuiltin(name string) bool {
@@ -2,9 +2,30 @@ package parse
 
 import (
 	"fmt"
+	"math"
+	"math/big"
 	"os"
+	"regexp"
+	"strconv"
+	"strings"
 )
 
+// 生成的代码中会直接使用参数名，因此参数名不能与生成代码中的局部变量以及Go、C、JavaScript的关键字相同
+var reservedArgNames = make(map[string]struct{})
+
+func init() {
+	names := `c client req resp res err v data root free_data resolve reject impl svr conn onFinish
+	break case chan const continue default defer else fallthrough for func go goto if import interface
+	map package range return select struct switch type var nil true false iota
+	auto char do double enum extern float int long register short signed sizeof static typedef union
+	unsigned volatile while inline restrict
+	async await catch class delete export extends finally function in instanceof let new null super
+	this throw try typeof with yield arguments eval undefined`
+	for _, name := range strings.Fields(names) {
+		reservedArgNames[name] = struct{}{}
+	}
+}
+
 // 检查以下错误：
 // 1. 同一个message不能有相同的成员				√
 // 2. 同一个service不能有相同的method			√
@@ -13,46 +34,1032 @@ import (
 // 5. 一个方法的请求参数只能有一个stream		√
 // 6. message成员不能是stream类型				√
 // 7. 是否使用未定义的message类型				√
+// 8. list和map的元素不能是stream或void类型	√
+// 9. map的键只能为string或整数类型			√
+// 10. 同一个enum不能有相同的成员以及相同的值	√
+// 11. enum不能与message同名					√
+// 12. 不能与导入的文件中定义的类型同名		√
+// 13. 不能循环导入(saveImport时检查)			√
+// 14. 导入的文件必须与当前文件属于同一package	√
+// 15. 同一个方法的参数不能同名，且不能使用保留的名称	√
+// 16. 已知注解的修饰对象和参数必须合法，且不能重复	√
+// 17. 常量只能为数值、bool或string类型，值必须与类型匹配，且不能与类型同名	√
+// 18. 只有非optional的数值、bool、string和enum成员可以有默认值，且值必须与类型匹配	√
+// 19. 服务只能继承已定义的服务，不能循环继承，继承的方法不能与自身或其他继承的方法同名	√
+// 20. oneof的变体只能为非optional且没有默认值的message、enum、string、bool或数值类型，oneof以及变体不能与message成员同名	√
+// 21. 嵌套message中使用的类型名由内向外查找，嵌套message不能与外层message中oneof的变体同名	√
+// 22. typedef只能为数值、bool、string、bytes或其他typedef的别名，不能循环定义，且不能与其他类型同名	√
+// 23. error码不能重复，error不能作为类型使用，方法只能throws已定义的error且不能重复	√
+// 24. timestamp和duration不能作为常量、typedef、map的键以及oneof的变体，也不能有默认值	√
+// 25. 校验约束只能为已知约束且不能重复，约束的值必须与成员或参数的类型匹配，默认值需满足约束	√
+// 26. oneway的方法只能返回void，不能throws，不能有stream参数以及超时时间；timeout修饰符不能与@timeout同时使用	√
+// 27. stream<Msg>的元素只能为message类型	√
+// 28. 成员编号不能重复，要么全部指定要么都不指定；reserved的编号和名称不能重复，也不能被成员使用	√
+// 29. 泛型message的类型形参不能重复，使用时必须给出数量一致的类型实参，实例名不能与其他message冲突	√
+// 30. 定长数组只能作为非optional的message成员，元素只能为数值、bool或enum	√
 
 func fixSymbols(syms *Symbols) {
+	checkImportPackage(syms)
+	checkImportConflict(syms)
+	for _, generic := range syms.Generics {
+		checkGeneric(generic, syms)
+	}
+	resolveTypes(syms)
+	for _, enum := range syms.Enums {
+		checkEnum(enum, syms)
+	}
 	for _, msg := range syms.Messages {
 		checkMessage(msg, syms)
 	}
 	for _, svr := range syms.Services {
 		checkService(svr, syms)
 	}
+	// 先检查各服务自身的方法，再合并继承的方法
+	for _, svr := range syms.Services {
+		checkExtends(svr, syms, nil)
+	}
+	for _, c := range syms.Consts {
+		checkConst(c, syms)
+	}
+	for _, def := range syms.Typedefs {
+		checkTypedef(def, syms)
+	}
+	for _, e := range syms.Errors {
+		checkError(e, syms)
+	}
+}
+
+// 解析时无法区分message、enum和typedef，在此处修正类型种类，将嵌套message的名称替换为加上前缀后的名称，
+// 并将typedef替换为底层类型
+func resolveTypes(syms *Symbols) {
+	for _, def := range syms.Typedefs {
+		resolveTypedef(def, syms, nil)
+	}
+	var pending []instance
+	for _, msg := range syms.Messages {
+		resolveMembers(msg, msg, syms, &pending, 0)
+	}
+	for _, srv := range syms.Services {
+		for _, method := range srv.Methods {
+			resolveType(method.RetType, nil, syms, &pending, 0)
+			for _, t := range method.ReqTypes {
+				resolveType(t, nil, syms, &pending, 0)
+			}
+		}
+	}
+	for _, c := range syms.Consts {
+		resolveType(c.Type, nil, syms, &pending, 0)
+	}
+	// 遍历syms.Messages时不能向其中加入实例，新的实例在遍历结束后加入符号表并解析成员类型，
+	// 解析时可能产生新的实例，直到不再产生为止
+	for len(pending) != 0 {
+		insts := pending
+		pending = nil
+		for _, inst := range insts {
+			syms.Messages[inst.msg.Name] = inst.msg
+		}
+		for _, inst := range insts {
+			resolveMembers(inst.msg, nil, syms, &pending, inst.depth)
+		}
+	}
+}
+
+func resolveMembers(msg *Message, scope *Message, syms *Symbols, pending *[]instance, depth int) {
+	for _, mem := range msg.Mems {
+		resolveType(mem.Type, scope, syms, pending, depth)
+	}
+	for _, oneof := range msg.Oneofs {
+		for _, mem := range oneof.Mems {
+			resolveType(mem.Type, scope, syms, pending, depth)
+		}
+	}
+}
+
+// 将typedef的类型替换为底层类型，path为正在解析的typedef链，用于发现循环定义
+func resolveTypedef(def *Typedef, syms *Symbols, path []string) {
+	t := def.Type
+	if t.Kind != TypeKindMessage || t.Alias != "" {
+		return
+	}
+	ref, ok := lookupTypedef(syms, t.Name)
+	if !ok {
+		// 交由checkTypedef报错
+		return
+	}
+	path = append(path, def.Name)
+	if containsString(path, ref.Name) {
+		fmt.Printf("circular typedef: %s -> %s\n", strings.Join(path, " -> "), ref.Name)
+		os.Exit(0)
+	}
+	resolveTypedef(ref, syms, path)
+	t.Kind, t.Name, t.Alias = ref.Type.Kind, ref.Type.Name, ref.Name
+}
+
+// scope为使用该类型的message，list和map的名称随元素类型一同更新。
+// 新产生的泛型实例加入pending，depth为当前所在实例的嵌套层数
+func resolveType(t *Type, scope *Message, syms *Symbols, pending *[]instance, depth int) {
+	switch t.Kind {
+	case TypeKindList:
+		resolveType(t.Elem, scope, syms, pending, depth)
+		t.Name = "[]" + t.Elem.Name
+	case TypeKindMap:
+		resolveType(t.Key, scope, syms, pending, depth)
+		resolveType(t.Elem, scope, syms, pending, depth)
+		t.Name = "map<" + t.Key.Name + "," + t.Elem.Name + ">"
+	case TypeKindStream:
+		if t.Elem != nil {
+			resolveType(t.Elem, scope, syms, pending, depth)
+			t.Name = "stream<" + t.Elem.Name + ">"
+		}
+	case TypeKindArray:
+		resolveType(t.Elem, scope, syms, pending, depth)
+		t.Name = t.Elem.Name + "[" + strconv.Itoa(t.Len) + "]"
+	case TypeKindMessage:
+		if t.Args != nil {
+			instantiate(t, scope, syms, pending, depth)
+			return
+		}
+		if _, ok := lookupGeneric(syms, t.Name); ok {
+			fmt.Printf("generic message \"%s\" can not be used without type arguments\n", t.Name)
+			os.Exit(0)
+		}
+		t.Name = resolveName(t.Name, scope, syms)
+		if _, ok := lookupEnum(syms, t.Name); ok {
+			t.Kind = TypeKindEnum
+		} else if def, ok := lookupTypedef(syms, t.Name); ok {
+			t.Kind, t.Name, t.Alias = def.Type.Kind, def.Type.Name, def.Name
+		}
+	}
+}
+
+// 类型名由内向外依次在scope以及其外层message中查找嵌套的message，最后在全局查找。
+// Response.Item形式的名称对应Response_Item，找不到时保持原样，交由后续检查报错
+func resolveName(name string, scope *Message, syms *Symbols) string {
+	mangled := strings.ReplaceAll(name, ".", "_")
+	for ; scope != nil; scope = scope.Parent {
+		if _, ok := lookupMessage(syms, scope.Name+"_"+mangled); ok {
+			return scope.Name + "_" + mangled
+		}
+	}
+	if _, ok := lookupMessage(syms, mangled); ok {
+		return mangled
+	}
+	return name
+}
+
+// 在当前文件以及直接导入的文件中查找message
+func lookupMessage(syms *Symbols, name string) (*Message, bool) {
+	if msg, ok := syms.Messages[name]; ok {
+		return msg, true
+	}
+	for _, imp := range syms.Imports {
+		if msg, ok := imp.Infos.Messages[name]; ok {
+			return msg, true
+		}
+	}
+	return nil, false
+}
+
+// 在当前文件以及直接导入的文件中查找泛型message
+func lookupGeneric(syms *Symbols, name string) (*Message, bool) {
+	if generic, ok := syms.Generics[name]; ok {
+		return generic, true
+	}
+	for _, imp := range syms.Imports {
+		if generic, ok := imp.Infos.Generics[name]; ok {
+			return generic, true
+		}
+	}
+	return nil, false
+}
+
+// 泛型message的实例，depth为实例的嵌套层数，用于发现Node<T>中使用Node<[]T>这类无限展开的定义
+type instance struct {
+	msg   *Message
+	depth int
+}
+
+// 实例化泛型message，实例名由泛型message名与类型实参依次以_拼接，如Page<User>为Page_User，
+// Pair<[]int32,map<string,User>>为Pair_List_int32_Map_string_User。
+// 实例作为普通message加入pending，直接导入的文件中或pending中已有相同实例时直接使用
+func instantiate(t *Type, scope *Message, syms *Symbols, pending *[]instance, depth int) {
+	generic, ok := lookupGeneric(syms, t.Name)
+	if !ok {
+		if _, ok := lookupMessage(syms, resolveName(t.Name, scope, syms)); ok {
+			fmt.Printf("message \"%s\" is not a generic message\n", t.Name)
+		} else {
+			fmt.Printf("undefined generic message \"%s\"\n", t.Name)
+		}
+		os.Exit(0)
+	}
+	if len(t.Args) != len(generic.TypeParams) {
+		fmt.Printf("generic message \"%s\" requires %d type arguments, but got %d\n", generic.Name, len(generic.TypeParams), len(t.Args))
+		os.Exit(0)
+	}
+	if depth > 16 {
+		fmt.Printf("generic message \"%s\" is instantiated recursively\n", generic.Name)
+		os.Exit(0)
+	}
+	parts := []string{generic.Name}
+	for _, arg := range t.Args {
+		resolveType(arg, scope, syms, pending, depth)
+		base := baseType(arg)
+		if isStream(base.Name) || base.Name == "void" {
+			fmt.Printf("invalid type argument \"%s\" of generic message \"%s\"\n", arg.Name, generic.Name)
+			os.Exit(0)
+		}
+		// 类型实参本身为实例时，实例可能尚未加入符号表
+		if _, ok := lookupInstance(syms, *pending, base.Name); !ok {
+			checkUndefine(syms, base.Name, "generic message", generic.Name)
+		}
+		parts = append(parts, mangleType(arg))
+	}
+	args := t.Args
+	t.Name, t.Args = strings.Join(parts, "_"), nil
+	if msg, ok := lookupInstance(syms, *pending, t.Name); ok {
+		if msg.Generic != generic {
+			fmt.Printf("instance \"%s\" of generic message \"%s\" conflicts with message of the same name\n", t.Name, generic.Name)
+			os.Exit(0)
+		}
+		return
+	}
+	params := make(map[string]*Type)
+	for i, param := range generic.TypeParams {
+		params[param] = args[i]
+	}
+	msg := &Message{
+		Name:          t.Name,
+		Doc:           generic.Doc,
+		Annos:         generic.Annos,
+		ReservedTags:  generic.ReservedTags,
+		ReservedNames: generic.ReservedNames,
+		Generic:       generic,
+		TypeArgs:      args,
+	}
+	for _, mem := range generic.Mems {
+		msg.Mems = append(msg.Mems, substituteMember(mem, params))
+	}
+	for _, oneof := range generic.Oneofs {
+		o := &Oneof{Name: oneof.Name, Doc: oneof.Doc}
+		for _, mem := range oneof.Mems {
+			o.Mems = append(o.Mems, substituteMember(mem, params))
+		}
+		msg.Oneofs = append(msg.Oneofs, o)
+	}
+	// 成员类型在实例加入符号表后由resolveTypes解析，因此成员可以引用自身，如Tree<T>中的[]Tree<T>
+	*pending = append(*pending, instance{msg, depth + 1})
+}
+
+// 在符号表以及尚未加入符号表的实例中查找message
+func lookupInstance(syms *Symbols, pending []instance, name string) (*Message, bool) {
+	if msg, ok := lookupMessage(syms, name); ok {
+		return msg, true
+	}
+	for _, inst := range pending {
+		if inst.msg.Name == name {
+			return inst.msg, true
+		}
+	}
+	return nil, false
+}
+
+// 类型实参在实例名中的表示，typedef使用别名
+func mangleType(t *Type) string {
+	switch {
+	case t.Alias != "":
+		return t.Alias
+	case t.Kind == TypeKindList:
+		return "List_" + mangleType(t.Elem)
+	case t.Kind == TypeKindMap:
+		return "Map_" + mangleType(t.Key) + "_" + mangleType(t.Elem)
+	case t.Kind == TypeKindArray:
+		return "Array" + strconv.Itoa(t.Len) + "_" + mangleType(t.Elem)
+	}
+	return t.Name
+}
+
+func substituteMember(mem *Member, params map[string]*Type) *Member {
+	m := *mem
+	m.Type = substituteType(mem.Type, params)
+	return &m
+}
+
+// 将泛型message成员类型中的类型形参替换为类型实参，返回新的类型
+func substituteType(t *Type, params map[string]*Type) *Type {
+	if arg, ok := params[t.Name]; ok && t.Kind == TypeKindMessage && t.Args == nil {
+		return substituteType(arg, nil)
+	}
+	c := *t
+	if t.Elem != nil {
+		c.Elem = substituteType(t.Elem, params)
+	}
+	if t.Key != nil {
+		c.Key = substituteType(t.Key, params)
+	}
+	c.Args = nil
+	for _, arg := range t.Args {
+		c.Args = append(c.Args, substituteType(arg, params))
+	}
+	return &c
+}
+
+// 在当前文件以及直接导入的文件中查找service
+func lookupService(syms *Symbols, name string) (*Service, bool) {
+	if srv, ok := syms.Services[name]; ok {
+		return srv, true
+	}
+	for _, imp := range syms.Imports {
+		if srv, ok := imp.Infos.Services[name]; ok {
+			return srv, true
+		}
+	}
+	return nil, false
+}
+
+// 在当前文件以及直接导入的文件中查找enum
+func lookupEnum(syms *Symbols, name string) (*Enum, bool) {
+	if enum, ok := syms.Enums[name]; ok {
+		return enum, true
+	}
+	for _, imp := range syms.Imports {
+		if enum, ok := imp.Infos.Enums[name]; ok {
+			return enum, true
+		}
+	}
+	return nil, false
+}
+
+// 在当前文件以及直接导入的文件中查找error
+func lookupError(syms *Symbols, name string) (*Error, bool) {
+	if e, ok := syms.Errors[name]; ok {
+		return e, true
+	}
+	for _, imp := range syms.Imports {
+		if e, ok := imp.Infos.Errors[name]; ok {
+			return e, true
+		}
+	}
+	return nil, false
+}
+
+// 在当前文件以及直接导入的文件中查找typedef
+func lookupTypedef(syms *Symbols, name string) (*Typedef, bool) {
+	if def, ok := syms.Typedefs[name]; ok {
+		return def, true
+	}
+	for _, imp := range syms.Imports {
+		if def, ok := imp.Infos.Typedefs[name]; ok {
+			return def, true
+		}
+	}
+	return nil, false
+}
+
+// 所有文件生成的代码位于同一目录，Go中属于同一个包，因此不允许导入其他package的文件
+func checkImportPackage(syms *Symbols) {
+	for _, imp := range syms.Imports {
+		if imp.Infos.Package == syms.Package {
+			continue
+		}
+		fmt.Printf("imported file \"%s\" belongs to package \"%s\", but current package is \"%s\"\n", imp.Path, imp.Infos.Package, syms.Package)
+		os.Exit(0)
+	}
+}
+
+// 生成的代码中所有文件的类型处于同一命名空间，导入的类型(包括间接导入)不能与当前文件或其他导入的类型同名
+func checkImportConflict(syms *Symbols) {
+	defined := make(map[string]interface{})
+	for name, msg := range syms.Messages {
+		defined[name] = msg
+	}
+	for name, enum := range syms.Enums {
+		defined[name] = enum
+	}
+	for name, c := range syms.Consts {
+		defined[name] = c
+	}
+	for name, def := range syms.Typedefs {
+		defined[name] = def
+	}
+	for name, generic := range syms.Generics {
+		defined[name] = generic
+	}
+	check := func(name string, def interface{}, file string) {
+		if d, ok := defined[name]; ok && d != def {
+			fmt.Printf("type \"%s\" imported from \"%s\" conflicts with type of the same name\n", name, file)
+			os.Exit(0)
+		}
+		defined[name] = def
+	}
+	for _, imp := range syms.Imports {
+		for name, msg := range imp.Infos.AllMessages() {
+			check(name, msg, imp.Path)
+		}
+		for name, enum := range imp.Infos.AllEnums() {
+			check(name, enum, imp.Path)
+		}
+		for name, c := range imp.Infos.AllConsts() {
+			check(name, c, imp.Path)
+		}
+		for name, def := range imp.Infos.AllTypedefs() {
+			check(name, def, imp.Path)
+		}
+		for name, generic := range imp.Infos.AllGenerics() {
+			check(name, generic, imp.Path)
+		}
+	}
+}
+
+// 泛型message的成员在实例化后作为普通message检查，此处只检查类型形参
+func checkGeneric(generic *Message, syms *Symbols) {
+	m := make(map[string]struct{})
+	for _, param := range generic.TypeParams {
+		checkRepeatedDefine(m, param, "type parameter", generic.Name, "generic message")
+		m[param] = struct{}{}
+		if isBuiltin(param) || param == generic.Name {
+			fmt.Printf("invalid type parameter \"%s\" of generic message \"%s\"\n", param, generic.Name)
+			os.Exit(0)
+		}
+	}
+}
+
+func checkEnum(enum *Enum, syms *Symbols) {
+	_, isGeneric := syms.Generics[enum.Name]
+	if _, ok := syms.Messages[enum.Name]; ok || isGeneric {
+		fmt.Printf("enum \"%s\" conflicts with message of the same name\n", enum.Name)
+		os.Exit(0)
+	}
+	m := make(map[string]struct{})
+	values := make(map[int32]string)
+	for _, mem := range enum.Mems {
+		checkRepeatedDefine(m, mem.Name, "member", enum.Name, "enum")
+		if name, ok := values[mem.Value]; ok {
+			fmt.Printf("member \"%s\" has the same value %d as \"%s\" in enum \"%s\"\n", mem.Name, mem.Value, name, enum.Name)
+			os.Exit(0)
+		}
+		m[mem.Name] = struct{}{}
+		values[mem.Value] = mem.Name
+	}
+}
+
+func checkConst(c *Const, syms *Symbols) {
+	_, isMsg := lookupMessage(syms, c.Name)
+	_, isEnum := lookupEnum(syms, c.Name)
+	_, isTypedef := lookupTypedef(syms, c.Name)
+	_, isGeneric := lookupGeneric(syms, c.Name)
+	if isMsg || isEnum || isTypedef || isGeneric {
+		fmt.Printf("const \"%s\" conflicts with type of the same name\n", c.Name)
+		os.Exit(0)
+	}
+	if c.Type.Kind != TypeKindNormal || c.Type.Name == "bytes" || c.Type.Name == "void" || isTime(c.Type.Name) {
+		fmt.Printf("invalid type \"%s\" of const \"%s\"\n", c.Type.Name, c.Name)
+		os.Exit(0)
+	}
+	if !assignable(c.Type, c.Value) {
+		fmt.Printf("cannot use %s as value of const \"%s\" with type \"%s\"\n", c.Value.Value, c.Name, c.Type.Name)
+		os.Exit(0)
+	}
+}
+
+func checkTypedef(def *Typedef, syms *Symbols) {
+	_, isMsg := lookupMessage(syms, def.Name)
+	_, isEnum := lookupEnum(syms, def.Name)
+	_, isGeneric := lookupGeneric(syms, def.Name)
+	if isMsg || isEnum || isGeneric || isBuiltin(def.Name) {
+		fmt.Printf("typedef \"%s\" conflicts with type of the same name\n", def.Name)
+		os.Exit(0)
+	}
+	if def.Type.Kind != TypeKindNormal || def.Type.Name == "void" || isTime(def.Type.Name) {
+		fmt.Printf("invalid type \"%s\" of typedef \"%s\"\n", def.Type.Name, def.Name)
+		os.Exit(0)
+	}
+}
+
+// error的成员已经作为message检查过，Go中为error生成Error和ErrorCode方法，成员不能与之同名
+func checkError(e *Error, syms *Symbols) {
+	for name, other := range syms.AllErrors() {
+		if other != e && other.Code == e.Code {
+			fmt.Printf("error \"%s\" has the same code %d as \"%s\"\n", e.Name, e.Code, name)
+			os.Exit(0)
+		}
+	}
+	for _, mem := range e.Mems {
+		if mem.Name == "Error" || mem.Name == "ErrorCode" {
+			fmt.Printf("invalid member name \"%s\" of error \"%s\"\n", mem.Name, e.Name)
+			os.Exit(0)
+		}
+	}
+}
+
+func checkDefault(mem *Member, message string, syms *Symbols) {
+	if mem.Default == nil {
+		return
+	}
+	var ok bool
+	switch {
+	case mem.Optional:
+		fmt.Printf("optional member \"%s\" of message \"%s\" cannot have default value\n", mem.Name, message)
+		os.Exit(0)
+	case mem.Type.Kind == TypeKindEnum:
+		// enum成员的默认值为枚举成员名
+		enum, _ := lookupEnum(syms, mem.Type.Name)
+		ok = mem.Default.Kind == LiteralIdent && enum.Member(mem.Default.Value) != nil
+	case mem.Type.Kind == TypeKindNormal && mem.Type.Name != "bytes" && !isTime(mem.Type.Name):
+		ok = assignable(mem.Type, mem.Default)
+	}
+	if !ok {
+		fmt.Printf("cannot use %s as default value of member \"%s\" in message \"%s\"\n", mem.Default.Value, mem.Name, message)
+		os.Exit(0)
+	}
+}
+
+// 字面量能否赋值给数值、bool或string类型，整数和小数不能超出类型的范围
+func assignable(t *Type, v *Literal) bool {
+	switch {
+	case v.Kind == LiteralString:
+		return t.Name == "string"
+	case v.Kind == LiteralBool:
+		return t.Name == "bool"
+	case v.Kind != LiteralInt && v.Kind != LiteralFloat:
+		return false
+	case t.Name == "float32" || t.Name == "float64":
+		bits, _ := strconv.Atoi(strings.TrimPrefix(t.Name, "float"))
+		_, err := strconv.ParseFloat(v.Value, bits)
+		return err == nil
+	case v.Kind == LiteralFloat || t.Name == "bool" || t.Name == "string":
+		return false
+	}
+	// 剩余的为整数类型
+	bits, _ := strconv.Atoi(strings.TrimPrefix(strings.TrimPrefix(t.Name, "u"), "int"))
+	var err error
+	if strings.HasPrefix(t.Name, "u") {
+		_, err = strconv.ParseUint(v.Value, 10, bits)
+	} else {
+		_, err = strconv.ParseInt(v.Value, 10, bits)
+	}
+	return err == nil
+}
+
+// 检查成员或参数的校验约束，def为成员的默认值，of用于错误信息
+func checkConstraints(cs Constraints, t *Type, def *Literal, of string) {
+	m := make(map[string]struct{})
+	for _, c := range cs {
+		if _, ok := m[c.Name]; ok {
+			fmt.Printf("repeated constraint \"%s\" of %s\n", c.Name, of)
+			os.Exit(0)
+		}
+		m[c.Name] = struct{}{}
+		var ok bool
+		switch c.Name {
+		case "min", "max":
+			ok = isNumeric(t) && (c.Value.Kind == LiteralInt || c.Value.Kind == LiteralFloat) && assignable(t, c.Value)
+		case "minlen", "maxlen":
+			ok = (t.Name == "string" || t.Name == "bytes" || t.Kind == TypeKindList || t.Kind == TypeKindMap) &&
+				c.Value.Kind == LiteralInt
+			if ok {
+				_, err := strconv.ParseUint(c.Value.Value, 10, 31)
+				ok = err == nil
+			}
+		case "pattern":
+			ok = t.Name == "string" && c.Value.Kind == LiteralString
+			if ok {
+				_, err := regexp.Compile(c.Value.Value)
+				ok = err == nil
+			}
+		default:
+			fmt.Printf("unknown constraint \"%s\" of %s\n", c.Name, of)
+			os.Exit(0)
+		}
+		if !ok {
+			fmt.Printf("cannot use %s=%s as constraint of %s\n", c.Name, c.Value.Value, of)
+			os.Exit(0)
+		}
+	}
+	if min, max := cs.Get("min"), cs.Get("max"); min != nil && max != nil && compareNumber(min.Value, max.Value) > 0 {
+		fmt.Printf("min is greater than max in constraints of %s\n", of)
+		os.Exit(0)
+	}
+	if min, max := cs.Get("minlen"), cs.Get("maxlen"); min != nil && max != nil && compareNumber(min.Value, max.Value) > 0 {
+		fmt.Printf("minlen is greater than maxlen in constraints of %s\n", of)
+		os.Exit(0)
+	}
+	if def != nil && !satisfies(def, cs) {
+		fmt.Printf("default value %s of %s does not satisfy its constraints\n", def.Value, of)
+		os.Exit(0)
+	}
+}
+
+// 默认值是否满足约束，只有数值与string成员的默认值会受约束的限制
+func satisfies(v *Literal, cs Constraints) bool {
+	for _, c := range cs {
+		switch c.Name {
+		case "min":
+			if compareNumber(v, c.Value) < 0 {
+				return false
+			}
+		case "max":
+			if compareNumber(v, c.Value) > 0 {
+				return false
+			}
+		case "minlen", "maxlen":
+			n, _ := strconv.Atoi(c.Value.Value)
+			if c.Name == "minlen" && len(v.Value) < n || c.Name == "maxlen" && len(v.Value) > n {
+				return false
+			}
+		case "pattern":
+			if !regexp.MustCompile(c.Value.Value).MatchString(v.Value) {
+				return false
+			}
+		}
+	}
+	return true
+}
+
+// 比较两个整数或小数字面量的大小
+func compareNumber(a, b *Literal) int {
+	x, _ := new(big.Rat).SetString(a.Value)
+	y, _ := new(big.Rat).SetString(b.Value)
+	return x.Cmp(y)
+}
+
+func isNumeric(t *Type) bool {
+	return t.Kind == TypeKindNormal && (strings.HasPrefix(t.Name, "int") || strings.HasPrefix(t.Name, "uint") ||
+		strings.HasPrefix(t.Name, "float"))
 }
 
 func checkMessage(msg *Message, syms *Symbols) {
+	checkAnnotations(msg.Annos, "message", msg.Name)
 	m := make(map[string]struct{})
+	keys := make(map[string]string)
 	for _, mem := range msg.Mems {
 		checkRepeatedDefine(m, mem.Name, "member", msg.Name, "message")
-		checkUndefine(syms.Messages, mem.Type.Name, "message", msg.Name)
+		checkUndefine(syms, baseType(mem.Type).Name, "message", msg.Name)
 		checkMemberType(mem.Type.Name, msg.Name)
+		checkContainer(mem.Type, "message", msg.Name)
+		checkArray(mem, msg.Name)
+		checkAnnotations(mem.Annos, "member", msg.Name+"."+mem.Name)
+		checkDefault(mem, msg.Name, syms)
+		checkConstraints(mem.Constraints, mem.Type, mem.Default, fmt.Sprintf("member \"%s\" of message \"%s\"", mem.Name, msg.Name))
+		// 序列化时的键名不能重复
+		if name, ok := keys[mem.JSONName()]; ok {
+			fmt.Printf("member \"%s\" has the same json name \"%s\" as \"%s\" in message \"%s\"\n", mem.Name, mem.JSONName(), name, msg.Name)
+			os.Exit(0)
+		}
 		m[mem.Name] = struct{}{}
+		keys[mem.JSONName()] = mem.Name
+	}
+	for _, oneof := range msg.Oneofs {
+		checkRepeatedDefine(m, oneof.Name, "member", msg.Name, "message")
+		if name, ok := keys[oneof.Name]; ok {
+			fmt.Printf("oneof \"%s\" has the same json name as \"%s\" in message \"%s\"\n", oneof.Name, name, msg.Name)
+			os.Exit(0)
+		}
+		m[oneof.Name] = struct{}{}
+		keys[oneof.Name] = oneof.Name
+	}
+	for _, oneof := range msg.Oneofs {
+		checkOneof(oneof, msg, m, syms)
+	}
+	checkTags(msg)
+	// Go中oneof的变体生成为<Message>_<变体名>结构体，不能与嵌套的message同名
+	if parent := msg.Parent; parent != nil {
+		for _, oneof := range parent.Oneofs {
+			for _, mem := range oneof.Mems {
+				if parent.Name+"_"+mem.Name == msg.Name {
+					fmt.Printf("nested message \"%s\" conflicts with member of oneof \"%s\" in message \"%s\"\n", msg.QualName(), oneof.Name, parent.QualName())
+					os.Exit(0)
+				}
+			}
+		}
+	}
+}
+
+// m为message中已定义的成员名，变体名同样不能与之重复
+func checkOneof(oneof *Oneof, msg *Message, m map[string]struct{}, syms *Symbols) {
+	keys := make(map[string]string)
+	for _, mem := range oneof.Mems {
+		checkRepeatedDefine(m, mem.Name, "member", msg.Name, "message")
+		checkAnnotations(mem.Annos, "member", msg.Name+"."+mem.Name)
+		switch {
+		case mem.Optional:
+			fmt.Printf("member \"%s\" of oneof \"%s\" in message \"%s\" can not be optional\n", mem.Name, oneof.Name, msg.Name)
+			os.Exit(0)
+		case mem.Default != nil:
+			fmt.Printf("member \"%s\" of oneof \"%s\" in message \"%s\" can not have default value\n", mem.Name, oneof.Name, msg.Name)
+			os.Exit(0)
+		case len(mem.Constraints) != 0:
+			fmt.Printf("member \"%s\" of oneof \"%s\" in message \"%s\" can not have constraints\n", mem.Name, oneof.Name, msg.Name)
+			os.Exit(0)
+		case mem.Type.Kind == TypeKindList || mem.Type.Kind == TypeKindMap || mem.Type.Kind == TypeKindStream || mem.Type.Kind == TypeKindArray ||
+			mem.Type.Name == "bytes" || mem.Type.Name == "void" || isTime(mem.Type.Name):
+			fmt.Printf("invalid type \"%s\" of member \"%s\" in oneof \"%s\" of message \"%s\"\n", mem.Type.Name, mem.Name, oneof.Name, msg.Name)
+			os.Exit(0)
+		}
+		checkUndefine(syms, mem.Type.Name, "message", msg.Name)
+		if name, ok := keys[mem.JSONName()]; ok {
+			fmt.Printf("member \"%s\" has the same json name \"%s\" as \"%s\" in oneof \"%s\"\n", mem.Name, mem.JSONName(), name, oneof.Name)
+			os.Exit(0)
+		}
+		m[mem.Name] = struct{}{}
+		keys[mem.JSONName()] = mem.Name
+	}
+}
+
+// 包括oneof变体在内的所有成员按@tag指定的编号和名称与reserved声明比对
+func checkTags(msg *Message) {
+	tags := make(map[int32]struct{})
+	for _, tag := range msg.ReservedTags {
+		if _, ok := tags[tag]; ok {
+			fmt.Printf("tag %d is reserved more than once in message \"%s\"\n", tag, msg.Name)
+			os.Exit(0)
+		}
+		tags[tag] = struct{}{}
+	}
+	names := make(map[string]struct{})
+	for _, name := range msg.ReservedNames {
+		if _, ok := names[name]; ok {
+			fmt.Printf("name \"%s\" is reserved more than once in message \"%s\"\n", name, msg.Name)
+			os.Exit(0)
+		}
+		names[name] = struct{}{}
+	}
+	mems := append([]*Member{}, msg.Mems...)
+	for _, oneof := range msg.Oneofs {
+		if _, ok := names[oneof.Name]; ok {
+			fmt.Printf("oneof \"%s\" uses reserved name in message \"%s\"\n", oneof.Name, msg.Name)
+			os.Exit(0)
+		}
+		mems = append(mems, oneof.Mems...)
+	}
+	used := make(map[int32]string)
+	for _, mem := range mems {
+		if anno := mem.Annos.Get("tag"); anno != nil {
+			mem.Tag = int32(anno.Number)
+		}
+		_, ok1 := names[mem.Name]
+		_, ok2 := names[mem.JSONName()]
+		if ok1 || ok2 {
+			fmt.Printf("member \"%s\" uses reserved name in message \"%s\"\n", mem.Name, msg.Name)
+			os.Exit(0)
+		}
+		if (mem.Tag == 0) != (mems[0].Tag == 0) {
+			fmt.Printf("either all or none of the members in message \"%s\" should have tag\n", msg.Name)
+			os.Exit(0)
+		}
+		if mem.Tag == 0 {
+			continue
+		}
+		if _, ok := tags[mem.Tag]; ok {
+			fmt.Printf("member \"%s\" uses reserved tag %d in message \"%s\"\n", mem.Name, mem.Tag, msg.Name)
+			os.Exit(0)
+		}
+		if name, ok := used[mem.Tag]; ok {
+			fmt.Printf("member \"%s\" has the same tag %d as \"%s\" in message \"%s\"\n", mem.Name, mem.Tag, name, msg.Name)
+			os.Exit(0)
+		}
+		used[mem.Tag] = mem.Name
 	}
 }
 
 func checkService(srv *Service, syms *Symbols) {
+	checkAnnotations(srv.Annos, "service", srv.Name)
 	m := make(map[string]struct{})
 	for _, method := range srv.Methods {
 		checkRepeatedDefine(m, method.Name, "method", srv.Name, "service")
-		checkUndefine(syms.Messages, method.RetType.Name, "service", srv.Name)
+		checkAnnotations(method.Annos, "method", srv.Name+"."+method.Name)
+		checkUndefine(syms, baseType(method.RetType).Name, "service", srv.Name)
+		checkContainer(method.RetType, "service", srv.Name)
+		checkStreamElem(method.RetType, srv.Name)
+		checkNotArray(method.RetType, "service", srv.Name)
 
 		occurStream := isStream(method.RetType.Name)
 		for _, t := range method.ReqTypes {
 			if t.Name == "void" {
 				method.ReqTypes = nil
-				return
+				method.ReqNames = nil
+				method.ReqConstraints = nil
+				break
 			}
-			checkUndefine(syms.Messages, t.Name, "service", srv.Name)
+			checkUndefine(syms, baseType(t).Name, "service", srv.Name)
+			checkContainer(t, "service", srv.Name)
+			checkStreamElem(t, srv.Name)
+			checkNotArray(t, "service", srv.Name)
 			occurStream = checkAtMostOneStream(occurStream, t.Name, srv.Name, method.Name)
 		}
+		checkArgNames(method, syms)
+		checkThrows(method, syms)
+		checkOptions(method)
+		for i, t := range method.ReqTypes {
+			checkConstraints(method.ReqConstraints[i], t, nil,
+				fmt.Sprintf("parameter \"%s\" of method \"%s.%s\"", method.ArgName(i), srv.Name, method.Name))
+		}
 
 		m[method.Name] = struct{}{}
 	}
 }
 
+func checkThrows(method *Method, syms *Symbols) {
+	m := make(map[string]struct{})
+	for _, name := range method.ThrowNames {
+		checkRepeatedDefine(m, name, "error", method.Service.Name+"."+method.Name, "method")
+		m[name] = struct{}{}
+		e, ok := lookupError(syms, name)
+		if !ok {
+			fmt.Printf("undefined error \"%s\" thrown by method \"%s.%s\"\n", name, method.Service.Name, method.Name)
+			os.Exit(0)
+		}
+		method.Throws = append(method.Throws, e)
+	}
+}
+
+func checkOptions(method *Method) {
+	name := method.Service.Name + "." + method.Name
+	hasTimeoutAnno := method.Annos.Get("timeout") != nil
+	if method.timeout != 0 && hasTimeoutAnno {
+		fmt.Printf("method \"%s\" can not have both timeout option and @timeout\n", name)
+		os.Exit(0)
+	}
+	if !method.Oneway {
+		return
+	}
+	if method.RetType.Name != "void" {
+		fmt.Printf("oneway method \"%s\" must return void\n", name)
+		os.Exit(0)
+	}
+	if len(method.ThrowNames) != 0 {
+		fmt.Printf("oneway method \"%s\" can not throw errors\n", name)
+		os.Exit(0)
+	}
+	for _, t := range method.ReqTypes {
+		if isStream(t.Name) {
+			fmt.Printf("oneway method \"%s\" can not have stream parameter\n", name)
+			os.Exit(0)
+		}
+	}
+	if method.timeout != 0 || hasTimeoutAnno {
+		fmt.Printf("oneway method \"%s\" can not have a timeout\n", name)
+		os.Exit(0)
+	}
+}
+
+// 将基服务的方法合并到srv.Methods中，继承的方法位于自身方法之前。path为正在处理的继承链，用于发现循环继承
+func checkExtends(srv *Service, syms *Symbols, path []string) {
+	if len(srv.Bases) != 0 || len(srv.BaseNames) == 0 {
+		return
+	}
+	path = append(path, srv.Name)
+	// 方法名到最初定义该方法的方法
+	defined := make(map[string]*Method)
+	for _, method := range srv.Methods {
+		defined[method.Name] = method
+	}
+	var bases []*Service
+	var inherited []*Method
+	m := make(map[string]struct{})
+	for _, name := range srv.BaseNames {
+		checkRepeatedDefine(m, name, "base service", srv.Name, "service")
+		m[name] = struct{}{}
+		base, ok := lookupService(syms, name)
+		if !ok {
+			fmt.Printf("undefined service \"%s\" extended by service \"%s\"\n", name, srv.Name)
+			os.Exit(0)
+		}
+		if containsString(path, name) {
+			fmt.Printf("circular inheritance of services: %s -> %s\n", strings.Join(path, " -> "), name)
+			os.Exit(0)
+		}
+		checkExtends(base, syms, path)
+		for _, method := range base.Methods {
+			origin := method
+			if method.Origin != nil {
+				origin = method.Origin
+			}
+			if def, ok := defined[method.Name]; ok {
+				if def.Origin == origin {
+					// 经由不同的基服务继承了同一个方法
+					continue
+				}
+				if def.Origin == nil {
+					fmt.Printf("method \"%s\" of service \"%s\" conflicts with method inherited from service \"%s\"\n",
+						method.Name, srv.Name, origin.Service.Name)
+				} else {
+					fmt.Printf("method \"%s\" inherited from service \"%s\" conflicts with method inherited from service \"%s\" in service \"%s\"\n",
+						method.Name, def.Origin.Service.Name, origin.Service.Name, srv.Name)
+				}
+				os.Exit(0)
+			}
+			copied := *method
+			copied.Service = srv
+			copied.Origin = origin
+			defined[method.Name] = &copied
+			inherited = append(inherited, &copied)
+		}
+		bases = append(bases, base)
+	}
+	srv.Methods = append(inherited, srv.Methods...)
+	srv.Bases = bases
+}
+
+func checkArgNames(method *Method, syms *Symbols) {
+	m := make(map[string]struct{})
+	for i := range method.ReqTypes {
+		name := method.ArgName(i)
+		checkRepeatedDefine(m, name, "parameter", method.Service.Name+"."+method.Name, "method")
+		m[name] = struct{}{}
+		if method.ReqNames[i] == "" {
+			continue
+		}
+		_, reserved := reservedArgNames[name]
+		_, isMsg := lookupMessage(syms, name)
+		_, isEnum := lookupEnum(syms, name)
+		_, isTypedef := lookupTypedef(syms, name)
+		if reserved || isBuiltin(name) || isMsg || isEnum || isTypedef || isGeneratedLocal(name) {
+			fmt.Printf("[%s.%s]: invalid parameter name \"%s\"\n", method.Service.Name, method.Name, name)
+			os.Exit(0)
+		}
+	}
+}
+
+// 已知注解允许的参数类型以及修饰对象
+var knownAnnotations = map[string]struct {
+	kinds   []int
+	targets []string
+}{
+	"deprecated": {[]int{AnnoValueNone, AnnoValueString}, []string{"message", "member", "service", "method"}},
+	"json":       {[]int{AnnoValueString}, []string{"member"}},
+	"tag":        {[]int{AnnoValueNumber}, []string{"member"}},
+	"timeout":    {[]int{AnnoValueDuration}, []string{"service", "method"}},
+}
+
+func checkAnnotations(annos Annotations, target, of string) {
+	m := make(map[string]struct{})
+	for _, anno := range annos {
+		checkRepeatedDefine(m, "@"+anno.Name, "annotation", of, target)
+		m["@"+anno.Name] = struct{}{}
+		rule, ok := knownAnnotations[anno.Name]
+		if !ok {
+			continue
+		}
+		if !containsString(rule.targets, target) {
+			fmt.Printf("annotation \"@%s\" cannot be applied to %s \"%s\"\n", anno.Name, target, of)
+			os.Exit(0)
+		}
+		if !containsInt(rule.kinds, anno.Kind) || !validAnnotationValue(anno) {
+			fmt.Printf("invalid value of annotation \"@%s\" on %s \"%s\"\n", anno.Name, target, of)
+			os.Exit(0)
+		}
+	}
+}
+
+func validAnnotationValue(anno *Annotation) bool {
+	switch anno.Name {
+	case "json":
+		// 键名会直接写入生成的Go结构体标签、C字符串以及Node代码中
+		if anno.Value == "" {
+			return false
+		}
+		for i := 0; i < len(anno.Value); i++ {
+			ch := anno.Value[i]
+			if !isLetter_(ch) && !isNumber(ch) && ch != '-' && ch != '.' {
+				return false
+			}
+		}
+	case "timeout":
+		return anno.Duration > 0
+	case "tag":
+		return anno.Number > 0 && anno.Number <= math.MaxInt32
+	}
+	return true
+}
+
+func containsString(ss []string, s string) bool {
+	for _, v := range ss {
+		if v == s {
+			return true
+		}
+	}
+	return false
+}
+
+func containsInt(is []int, i int) bool {
+	for _, v := range is {
+		if v == i {
+			return true
+		}
+	}
+	return false
+}
+
+// 生成代码中以序号结尾的局部变量，如Node中的buf1、C中的node1
+func isGeneratedLocal(name string) bool {
+	for _, prefix := range []string{"buf", "node"} {
+		if rest := strings.TrimPrefix(name, prefix); rest != name && rest != "" && strings.Trim(rest, "0123456789") == "" {
+			return true
+		}
+	}
+	return false
+}
+
 func checkAtMostOneStream(occurStream bool, tName, service, method string) bool {
 	if !isStream(tName) {
 		return occurStream
@@ -72,11 +1079,18 @@ func checkRepeatedDefine(m map[string]struct{}, what, t1, of, t2 string) {
 	os.Exit(0)
 }
 
-func checkUndefine(m map[string]*Message, what, t1, t2 string) {
+func checkUndefine(syms *Symbols, what, t1, t2 string) {
 	if isBuiltin(what) {
 		return
 	}
-	if _, ok := m[what]; ok {
+	if _, ok := lookupError(syms, what); ok {
+		fmt.Printf("error \"%s\" cannot be used as type in %s \"%s\"\n", what, t1, t2)
+		os.Exit(0)
+	}
+	if _, ok := lookupMessage(syms, what); ok {
+		return
+	}
+	if _, ok := lookupEnum(syms, what); ok {
 		return
 	}
 	fmt.Printf("undefined type \"%s\" in %s \"%s\"\n", what, t1, t2)
@@ -90,3 +1104,51 @@ func checkMemberType(t, message string) {
 	fmt.Printf("invalid stream member in message \"%s\"\n", message)
 	os.Exit(0)
 }
+
+// 定长数组在C中内联于结构体，元素只能为定长的数值、bool或enum
+func checkArray(mem *Member, message string) {
+	if mem.Type.Kind != TypeKindArray {
+		return
+	}
+	if mem.Optional {
+		fmt.Printf("array member \"%s\" of message \"%s\" can not be optional\n", mem.Name, message)
+		os.Exit(0)
+	}
+	elem := mem.Type.Elem
+	if elem.Kind != TypeKindEnum && !isNumeric(elem) && elem.Name != "bool" {
+		fmt.Printf("invalid element type \"%s\" of array member \"%s\" in message \"%s\"\n", elem.Name, mem.Name, message)
+		os.Exit(0)
+	}
+}
+
+func checkNotArray(t *Type, t1, of string) {
+	if t.Kind != TypeKindArray {
+		return
+	}
+	fmt.Printf("array type \"%s\" can only be used as message member in %s \"%s\"\n", t.Name, t1, of)
+	os.Exit(0)
+}
+
+func checkStreamElem(t *Type, service string) {
+	if !t.IsTypedStream() || t.Elem.Kind == TypeKindMessage {
+		return
+	}
+	fmt.Printf("invalid element type \"%s\" of stream in service \"%s\"\n", t.Elem.Name, service)
+	os.Exit(0)
+}
+
+func checkContainer(t *Type, t1, of string) {
+	if t.Kind != TypeKindList && t.Kind != TypeKindMap {
+		return
+	}
+	for ; t.Kind == TypeKindList || t.Kind == TypeKindMap; t = t.Elem {
+		if t.Kind == TypeKindMap && !isMapKey(t.Key) {
+			fmt.Printf("invalid map key type \"%s\" in %s \"%s\"\n", t.Key.Name, t1, of)
+			os.Exit(0)
+		}
+	}
+	if isStream(t.Name) || t.Name == "void" || t.Kind == TypeKindArray {
+		fmt.Printf("invalid element type \"%s\" in %s \"%s\"\n", t.Name, t1, of)
+		os.Exit(0)
+	}
+}
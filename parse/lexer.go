@@ -17,8 +17,11 @@ type lexer struct {
 	curLine  int    // 当前行
 	curKth   int    // 当前行的第几个字符
 
-	locationMap []int    // 预处理后代码行号到预处理前行号映射
-	lines       []string // 保存所有行
+	locationMap []int      // 预处理后代码行号到预处理前行号映射
+	lines       []string   // 保存所有行
+	docs        [][]string // 预处理后每一行代码紧邻其上的注释行
+	comments    [][]string // 预处理后每一行代码的行尾注释，至多一条
+	prevLine    int        // 上一个token所在行，用于确定声明结束的行
 }
 
 func newLexer(code []byte) (*lexer, error) {
@@ -42,26 +45,36 @@ func newLexer(code []byte) (*lexer, error) {
 func (l *lexer) preHandleCode() error {
 	buff := bufio.NewReader(bytes.NewBuffer(l.srcCode))
 	var writeTo bytes.Buffer
+	var leading []string // 尚未归属到代码行的注释行
 	for curLine := 0; ; curLine++ {
 		line, err := readLine(buff)
 		if err != nil && err != io.EOF {
 			return err
 		}
-		index := bytes.Index(line, []byte("//"))
-		if index != -1 {
-			// 去除注释
-			line = line[:index]
-		}
-		if index := bytes.Index(line, []byte("/")); index != -1 {
+		// 去除注释
+		line, comment, ok := splitComment(line)
+		if !ok {
 			return fmt.Errorf("syntax error: expect // at %dth line", curLine+1)
 		}
-		// 如果为空行，则跳过
+		// 如果为空行，则跳过。空行会打断注释与代码的关联
 		if len(line) == 0 || emptyLine(line) {
+			if comment != nil {
+				leading = append(leading, commentText(comment))
+			} else {
+				leading = nil
+			}
 			if err == io.EOF {
 				break
 			}
 			continue
 		}
+		var trailing []string
+		if comment != nil {
+			trailing = append(trailing, commentText(comment))
+		}
+		l.docs = append(l.docs, leading)
+		l.comments = append(l.comments, trailing)
+		leading = nil
 		writeTo.Write(line)
 		writeTo.Write([]byte("\n"))
 		// 记录新代码行号到旧代码行号的映射
@@ -99,6 +112,30 @@ func readLine(buff *bufio.Reader) ([]byte, error) {
 	return line, nil
 }
 
+// 将行拆分为代码和注释，字符串中的"//"不视为注释，没有注释时comment为nil。出现单独的'/'时返回false
+func splitComment(line []byte) (code, comment []byte, ok bool) {
+	inString := false
+	for i := 0; i < len(line); i++ {
+		switch {
+		case line[i] == '"':
+			inString = !inString
+		case inString && line[i] == '\\':
+			i++
+		case !inString && line[i] == '/':
+			if i+1 < len(line) && line[i+1] == '/' {
+				return line[:i], line[i:], true
+			}
+			return nil, nil, false
+		}
+	}
+	return line, nil, true
+}
+
+// 去除注释开头的"//"以及首尾空白
+func commentText(comment []byte) string {
+	return string(bytes.TrimSpace(bytes.TrimPrefix(comment, []byte("//"))))
+}
+
 // 该行是否为空行
 func emptyLine(line []byte) bool {
 	for i := 0; i < len(line); i++ {
@@ -111,7 +148,12 @@ func emptyLine(line []byte) bool {
 
 // 获取下一个token，保存在l.curToken中
 func (l *lexer) getNextToken() {
-	for l.curChar == 0 || l.curChar == ' ' || l.curChar == '\t' {
+	l.prevLine = l.curToken.Line
+	// 换行与空白一样只用于分隔token
+	for l.curChar == 0 || l.curChar == ' ' || l.curChar == '\t' || l.curChar == '\n' {
+		if l.curChar == '\n' {
+			l.curLine++
+		}
 		if l.cursor >= len(l.srcCode) {
 			l.curToken.Kind = T_EOF
 			return
@@ -123,8 +165,6 @@ func (l *lexer) getNextToken() {
 	// 记录该token在该行的第几个字符
 	l.curToken.Kth = l.curKth
 	switch ch {
-	case '0':
-		l.curToken.Kind = T_EOF
 	case '(':
 		l.curToken.Kind = T_LEFTBRACKET
 		l.curToken.Length = 1
@@ -137,19 +177,55 @@ func (l *lexer) getNextToken() {
 	case '}':
 		l.curToken.Kind = T_RIGHTBRACE
 		l.curToken.Length = 1
-	// case '\r':
-	// 	l.getNextChar()
-	// 	if l.curChar != '\n' {
-	// 		fmt.Printf("expect \\n at end of %dth line\n", l.curLine)
-	// 		os.Exit(1)
-	// 	}
-	// 	fallthrough
-	case '\n':
-		l.curToken.Kind = T_CRLF
-		defer func() { l.curLine++ }()
+	case '[':
+		// 紧跟数字和]时为定长数组的长度，如uint8[16]
+		if end := l.arrayLenEnd(); end > 0 {
+			l.curToken.Kind = T_ARRAYLEN
+			l.curToken.Value = string(l.srcCode[l.cursor:end])
+			l.curToken.Length = end - l.cursor + 2
+			for l.cursor <= end {
+				l.getNextChar()
+			}
+			break
+		}
+		// 紧跟]时为list类型的前缀，如[]int32，中间允许有空格
+		if end := l.listEnd(); end > 0 {
+			l.curToken.Kind = T_LIST
+			l.curToken.Length = end - l.cursor + 2
+			for l.cursor <= end {
+				l.getNextChar()
+			}
+			break
+		}
+		l.curToken.Kind = T_LEFTSQUARE
+		l.curToken.Length = 1
+	case ']':
+		l.curToken.Kind = T_RIGHTSQUARE
+		l.curToken.Length = 1
+	case '<':
+		l.curToken.Kind = T_LEFTANGLE
+		l.curToken.Length = 1
+	case '>':
+		l.curToken.Kind = T_RIGHTANGLE
+		l.curToken.Length = 1
+	case ';':
+		l.curToken.Kind = T_SEMICOLON
+		l.curToken.Length = 1
 	case ',':
 		l.curToken.Kind = T_COMMA
 		l.curToken.Length = 1
+	case '=':
+		l.curToken.Kind = T_ASSIGN
+		l.curToken.Length = 1
+	case '.':
+		l.curToken.Kind = T_DOT
+		l.curToken.Length = 1
+	case '@':
+		l.curToken.Kind = T_AT
+		l.curToken.Length = 1
+	case '"':
+		l.getString()
+		goto end
 	// case '/':
 	// 	// 处理注释
 	// 	l.getNextChar()
@@ -161,7 +237,12 @@ func (l *lexer) getNextToken() {
 	// 		l.getNextChar()
 	// 	}
 	// 	goto start
-	default: // 解析identity
+	default:
+		if isNumber(ch) || ch == '-' {
+			l.getNumber()
+			goto end
+		}
+		// 解析identity
 		if !isLetter_(ch) {
 			l.logError()
 		}
@@ -175,11 +256,35 @@ func (l *lexer) getNextToken() {
 			id += string(ch)
 		}
 		l.curToken.Length = len(id)
-		// message和service是关键字，特殊处理
+		// message、service、map、enum、optional、import、package、const、extends、oneof、typedef、error、throws和reserved是关键字，特殊处理
 		if id == "message" {
 			l.curToken.Kind = T_MESSAGE
 		} else if id == "service" {
 			l.curToken.Kind = T_SERVICE
+		} else if id == "map" {
+			l.curToken.Kind = T_MAP
+		} else if id == "enum" {
+			l.curToken.Kind = T_ENUM
+		} else if id == "optional" {
+			l.curToken.Kind = T_OPTIONAL
+		} else if id == "import" {
+			l.curToken.Kind = T_IMPORT
+		} else if id == "package" {
+			l.curToken.Kind = T_PACKAGE
+		} else if id == "const" {
+			l.curToken.Kind = T_CONST
+		} else if id == "extends" {
+			l.curToken.Kind = T_EXTENDS
+		} else if id == "oneof" {
+			l.curToken.Kind = T_ONEOF
+		} else if id == "typedef" {
+			l.curToken.Kind = T_TYPEDEF
+		} else if id == "error" {
+			l.curToken.Kind = T_ERROR
+		} else if id == "throws" {
+			l.curToken.Kind = T_THROWS
+		} else if id == "reserved" {
+			l.curToken.Kind = T_RESERVED
 		} else {
 			l.curToken.Kind = T_ID
 			l.curToken.Value = id
@@ -192,6 +297,95 @@ end:
 	l.curToken.Line = l.curLine
 }
 
+// 当前字符[之后为数字以及]时返回]的位置，否则返回0
+func (l *lexer) arrayLenEnd() int {
+	i := l.cursor
+	for i < len(l.srcCode) && isNumber(l.srcCode[i]) {
+		i++
+	}
+	if i == l.cursor || i >= len(l.srcCode) || l.srcCode[i] != ']' {
+		return 0
+	}
+	return i
+}
+
+// 当前字符[之后为]时返回]的位置，否则返回0，[与]之间可以有空格
+func (l *lexer) listEnd() int {
+	i := l.cursor
+	for i < len(l.srcCode) && (l.srcCode[i] == ' ' || l.srcCode[i] == '\t') {
+		i++
+	}
+	if i >= len(l.srcCode) || l.srcCode[i] != ']' {
+		return 0
+	}
+	return i
+}
+
+// 解析整数或小数，允许以负号开头。紧跟单位的整数解析为时间间隔，如500ms、1h30m
+func (l *lexer) getNumber() {
+	num := string(l.curChar)
+	for {
+		l.getNextChar()
+		if !isNumber(l.curChar) {
+			break
+		}
+		num += string(l.curChar)
+	}
+	if num == "-" {
+		l.logError()
+	}
+	l.curToken.Kind = T_NUMBER
+	// 小数点后必须紧跟数字
+	if l.curChar == '.' && l.cursor < len(l.srcCode) && isNumber(l.srcCode[l.cursor]) {
+		num += "."
+		for {
+			l.getNextChar()
+			if !isNumber(l.curChar) {
+				break
+			}
+			num += string(l.curChar)
+		}
+		l.curToken.Kind = T_FLOAT
+	}
+	if l.curToken.Kind == T_NUMBER && isLetter_(l.curChar) {
+		for isLetter_(l.curChar) || isNumber(l.curChar) {
+			num += string(l.curChar)
+			l.getNextChar()
+		}
+		l.curToken.Kind = T_DURATION
+	}
+	l.curToken.Value = num
+	l.curToken.Length = len(num)
+}
+
+// 解析双引号包围的字符串，支持\"和\\转义，不允许跨行
+func (l *lexer) getString() {
+	var value []byte
+	length := 1
+	for {
+		l.getNextChar()
+		length++
+		if l.curChar == '"' {
+			break
+		}
+		if l.curChar == 0 || l.curChar == '\n' {
+			l.logError()
+		}
+		if l.curChar == '\\' {
+			l.getNextChar()
+			length++
+			if l.curChar != '"' && l.curChar != '\\' {
+				l.logError()
+			}
+		}
+		value = append(value, l.curChar)
+	}
+	l.getNextChar()
+	l.curToken.Kind = T_STRING
+	l.curToken.Value = string(value)
+	l.curToken.Length = length
+}
+
 func (l *lexer) logError() {
 	fmt.Printf("%dth line lexer failed: invalid character %c\n", l.curLine, l.curChar)
 	os.Exit(0)
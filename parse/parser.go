@@ -6,7 +6,10 @@ import (
 	"io/ioutil"
 	"os"
 	"path"
+	"path/filepath"
+	"strconv"
 	"strings"
+	"time"
 )
 
 // 语法解析器
@@ -15,18 +18,24 @@ type Parser struct {
 	lexer    *lexer // 词法解析器
 	token    *Token // 当前的token
 
-	tmpToken *Token // 暂存的token，用于保存出现错误时的上下文
+	tmpToken *Token   // 暂存的token，用于保存出现错误时的上下文
+	outer    *Message // 正在解析的外层message，用于嵌套message的命名
+
+	decls []lineDecls // 每一行代码中的声明，用于确定注释的归属
+
+	includeDirs []string            // import时查找文件的目录
+	importing   []string            // 正在解析的文件链，用于检测循环导入
+	parsed      map[string]*Symbols // 已解析过的文件，同一文件被多次导入时只解析一次
 
 	Infos *Symbols // 语法树
 }
 
-func NewParser(filepath string) *Parser {
+func NewParser(filepath string, includeDirs []string) *Parser {
 	return &Parser{
-		filepath: filepath,
-		Infos: &Symbols{
-			Services: make(map[string]*Service),
-			Messages: make(map[string]*Message),
-		},
+		filepath:    filepath,
+		includeDirs: includeDirs,
+		parsed:      make(map[string]*Symbols),
+		Infos:       newSymbols(),
 	}
 }
 
@@ -39,13 +48,123 @@ func (p *Parser) saveService(srv *Service, token Token) {
 }
 
 func (p *Parser) saveMessage(msg *Message, token Token) {
-	// 不允许出现相同的message
-	if _, ok := p.Infos.Messages[msg.Name]; ok {
+	// 不允许出现相同的message，泛型message同样不能与之同名
+	_, ok1 := p.Infos.Messages[msg.Name]
+	_, ok2 := p.Infos.Generics[msg.Name]
+	if ok1 || ok2 {
 		p.logError(fmt.Sprintf("repeated message %s", msg.Name), token)
 	}
+	if len(msg.TypeParams) != 0 {
+		p.Infos.Generics[msg.Name] = msg
+		return
+	}
 	p.Infos.Messages[msg.Name] = msg
 }
 
+func (p *Parser) savePackage(name string, token Token) {
+	// 一个文件最多只能有一个package声明
+	if p.Infos.Package != "" {
+		p.logError("repeated package declaration", token)
+	}
+	p.Infos.Package = name
+}
+
+// 解析被导入的文件，并记录在语法树中
+func (p *Parser) saveImport(token Token) {
+	file, ok := p.findImport(token.Value)
+	if !ok {
+		p.logError(fmt.Sprintf("cannot find imported file \"%s\"", token.Value), token)
+	}
+	abs, err := filepath.Abs(file)
+	if err != nil {
+		p.logError(err.Error(), token)
+	}
+	// 不允许循环导入
+	for i, f := range p.importing {
+		if f != abs {
+			continue
+		}
+		var chain []string
+		for _, f := range append(p.importing[i:], abs) {
+			chain = append(chain, path.Base(f))
+		}
+		p.logError(fmt.Sprintf("import cycle: %s", strings.Join(chain, " -> ")), token)
+	}
+	// 不允许重复导入
+	for _, imp := range p.Infos.Imports {
+		if imp.Infos == p.parsed[abs] {
+			p.logError(fmt.Sprintf("repeated import \"%s\"", token.Value), token)
+		}
+	}
+	infos, ok := p.parsed[abs]
+	if !ok {
+		parser := &Parser{
+			filepath:    file,
+			includeDirs: p.includeDirs,
+			importing:   p.importing,
+			parsed:      p.parsed,
+			Infos:       newSymbols(),
+		}
+		if err := parser.Parse(); err != nil {
+			p.logError(err.Error(), token)
+		}
+		infos = parser.Infos
+	}
+	p.Infos.Imports = append(p.Infos.Imports, &Import{
+		Path:  token.Value,
+		File:  file,
+		Infos: infos,
+	})
+}
+
+// 依次在当前文件所在目录以及include目录下查找被导入的文件
+func (p *Parser) findImport(name string) (string, bool) {
+	dirs := append([]string{filepath.Dir(p.filepath)}, p.includeDirs...)
+	if filepath.IsAbs(name) {
+		dirs = []string{""}
+	}
+	for _, dir := range dirs {
+		file := filepath.Join(dir, name)
+		if info, err := os.Stat(file); err == nil && !info.IsDir() {
+			return file, true
+		}
+	}
+	return "", false
+}
+
+func (p *Parser) saveConst(c *Const, token Token) {
+	// 不允许出现相同的常量
+	if _, ok := p.Infos.Consts[c.Name]; ok {
+		p.logError(fmt.Sprintf("repeated const %s", c.Name), token)
+	}
+	p.Infos.Consts[c.Name] = c
+}
+
+func (p *Parser) saveTypedef(def *Typedef, token Token) {
+	// 不允许出现相同的typedef
+	if _, ok := p.Infos.Typedefs[def.Name]; ok {
+		p.logError(fmt.Sprintf("repeated typedef %s", def.Name), token)
+	}
+	p.Infos.Typedefs[def.Name] = def
+}
+
+func (p *Parser) saveError(e *Error, token Token) {
+	// 不允许出现相同的error，error同时作为message保存
+	if _, ok := p.Infos.Errors[e.Name]; ok {
+		p.logError(fmt.Sprintf("repeated error %s", e.Name), token)
+	}
+	p.saveMessage(e.Message, token)
+	p.Infos.Errors[e.Name] = e
+}
+
+func (p *Parser) saveEnum(enum *Enum, token Token) {
+	// 不允许出现相同的enum
+	if _, ok := p.Infos.Enums[enum.Name]; ok {
+		p.logError(fmt.Sprintf("repeated enum %s", enum.Name), token)
+	}
+	p.Infos.Enums[enum.Name] = enum
+}
+
 // 初始化词法解析器
 func (p *Parser) initLexer() error {
 	if p.lexer != nil {
@@ -65,8 +184,11 @@ func (p *Parser) initLexer() error {
 		return err
 	}
 	// 生成词法解析器
-	p.lexer, err = newLexer(data)
-	return err
+	if p.lexer, err = newLexer(data); err != nil {
+		return err
+	}
+	p.decls = make([]lineDecls, len(p.lexer.lines))
+	return nil
 }
 
 func (p *Parser) nextToken() {
@@ -79,6 +201,12 @@ func (p *Parser) Parse() error {
 	if err := p.initLexer(); err != nil {
 		return err
 	}
+	abs, err := filepath.Abs(p.filepath)
+	if err != nil {
+		return err
+	}
+	p.importing = append(p.importing[:len(p.importing):len(p.importing)], abs)
+	p.parsed[abs] = p.Infos
 	p.token = &p.lexer.curToken
 	// 获取第一个token
 	p.nextToken()
@@ -87,6 +215,7 @@ func (p *Parser) Parse() error {
 	if p.token.Kind != T_EOF {
 		return fmt.Errorf("syntax error: want eof at end")
 	}
+	p.attachComments()
 	// 语义检查
 	fixSymbols(p.Infos)
 	return nil
@@ -94,53 +223,348 @@ func (p *Parser) Parse() error {
 
 // 非终结符Code对应的过程
 func (p *Parser) procCode() {
-	switch p.token.Kind {
-	case T_EOF:
-		return
-	case T_MESSAGE:
-		fallthrough
-	case T_SERVICE:
+	switch {
+	case inFirstOfStmt(p.token.Kind):
 		// 产生式1
 		p.procStmt()
-		p.procExtra()
-	case T_CRLF:
+		p.procSep()
+		p.procCode()
+	case p.token.Kind == T_EOF:
 		// 产生式2
-		p.procExtra()
+		return
 	default:
-		p.Panic1("message|service", "")
+		p.Panic1("message|service|enum|import|package|const|typedef|error", "")
+	}
+}
+
+// 非终结符Sep对应的过程，语句、成员以及方法之后可选的分隔符
+func (p *Parser) procSep() {
+	switch p.token.Kind {
+	case T_SEMICOLON:
+		// 产生式3
+		p.nextToken()
+	case T_COMMA:
+		// 产生式4
+		p.nextToken()
+	default:
+		// 产生式48
 	}
 }
 
 // 非终结符Stmt对应的过程
 func (p *Parser) procStmt() {
+	var annos Annotations
+	var doc []string
+	if p.token.Kind == T_AT {
+		// 产生式40
+		token := *p.token
+		annos, doc = p.procAnnotations()
+		if p.token.Kind != T_MESSAGE && p.token.Kind != T_SERVICE {
+			p.logError("annotations can only be applied to message, service, member and method", token)
+		}
+	}
 	switch p.token.Kind {
 	case T_MESSAGE:
 		// 产生式5
 		msg, token := p.procMsgStmt()
+		msg.Annos, msg.Doc = annos, append(doc, msg.Doc...)
 		p.saveMessage(msg, token)
 	case T_SERVICE:
 		// 产生式6
 		srv, token := p.procServiceStmt()
+		srv.Annos, srv.Doc = annos, append(doc, srv.Doc...)
 		p.saveService(srv, token)
+	case T_ENUM:
+		// 产生式23
+		enum, token := p.procEnumStmt()
+		p.saveEnum(enum, token)
+	case T_IMPORT:
+		// 产生式32
+		token := p.procImportStmt()
+		p.saveImport(token)
+	case T_PACKAGE:
+		// 产生式34
+		name, token := p.procPackageStmt()
+		p.savePackage(name, token)
+	case T_CONST:
+		// 产生式52
+		c, token := p.procConstStmt()
+		p.saveConst(c, token)
+	case T_TYPEDEF:
+		// 产生式72
+		def, token := p.procTypedefStmt()
+		p.saveTypedef(def, token)
+	case T_ERROR:
+		// 产生式74
+		e, token := p.procErrorStmt()
+		p.saveError(e, token)
 	default:
-		p.Panic1("message|service", "")
+		p.Panic1("message|service|enum|import|package|const|typedef|error", "")
 	}
 }
 
-// 非终结符Extra对应的过程
-func (p *Parser) procExtra() {
+// 连续的注解，对应产生式40、50、51中的Annotation部分，返回注解以及注解所在行的注释
+func (p *Parser) procAnnotations() (Annotations, []string) {
+	var annos Annotations
+	var doc []string
+	for p.token.Kind == T_AT {
+		line := p.token.Line
+		annos = append(annos, p.procAnnotation())
+		// 注解独占一行时，该行的注释同样属于被修饰的对象
+		if p.token.Line != line {
+			doc = append(doc, p.doc(Token{Line: line})...)
+			doc = append(doc, p.lexer.comments[line]...)
+			p.decls[line].annotated = true
+		}
+	}
+	return annos, doc
+}
+
+// 非终结符Annotation对应的过程
+func (p *Parser) procAnnotation() *Annotation {
+	// 产生式41
+	if p.token.Kind != T_AT {
+		p.Panic1("@", "")
+	}
+	p.nextToken()
+	if p.token.Kind != T_ID {
+		p.Panic1("annotation name", "@")
+	}
+	anno := &Annotation{Name: p.token.Value}
+	p.nextToken()
+	if p.token.Kind == T_LEFTBRACKET {
+		// 产生式42
+		p.nextToken()
+		p.procAnnoValue(anno)
+		if p.token.Kind != T_RIGHTBRACKET {
+			p.Panic1(")", anno.Value)
+		}
+		p.nextToken()
+	}
+	// 产生式43
+	return anno
+}
+
+// 非终结符AnnoValue对应的过程
+func (p *Parser) procAnnoValue(anno *Annotation) {
+	anno.Value = p.token.Value
 	switch p.token.Kind {
-	case T_CRLF:
-		// 产生式3
+	case T_STRING:
+		// 产生式44
+		anno.Kind = AnnoValueString
+	case T_NUMBER:
+		// 产生式45
+		v, err := strconv.ParseInt(p.token.Value, 10, 64)
+		if err != nil {
+			p.logError(fmt.Sprintf("annotation value %s out of range of int64", p.token.Value), *p.token)
+		}
+		anno.Kind = AnnoValueNumber
+		anno.Number = v
+	case T_DURATION:
+		// 产生式46
+		d, err := time.ParseDuration(p.token.Value)
+		if err != nil {
+			p.logError(fmt.Sprintf("invalid duration %s", p.token.Value), *p.token)
+		}
+		anno.Kind = AnnoValueDuration
+		anno.Duration = d
+	case T_ID:
+		// 产生式47
+		anno.Kind = AnnoValueIdent
+	default:
+		p.Panic1("annotation value", "(")
+	}
+	p.nextToken()
+}
+
+// 非终结符ImportStmt对应的过程，返回文件路径对应的token
+func (p *Parser) procImportStmt() Token {
+	// 产生式33
+	if p.token.Kind != T_IMPORT {
+		p.Panic1("import", "")
+	}
+	p.nextToken()
+	if p.token.Kind != T_STRING {
+		p.Panic1("file path", "import")
+	}
+	token := *p.token
+	p.nextToken()
+	return token
+}
+
+// 非终结符PackageStmt对应的过程，返回package名以及其第一个token
+func (p *Parser) procPackageStmt() (string, Token) {
+	// 产生式35
+	if p.token.Kind != T_PACKAGE {
+		p.Panic1("package", "")
+	}
+	p.nextToken()
+	if p.token.Kind != T_ID {
+		p.Panic1("package name", "package")
+	}
+	token := *p.token
+	name := p.token.Value
+	p.nextToken()
+	return name + p.procPkgName(), token
+}
+
+// 非终结符ConstStmt对应的过程，返回常量以及常量名对应的token
+func (p *Parser) procConstStmt() (*Const, Token) {
+	// 产生式53
+	if p.token.Kind != T_CONST {
+		p.Panic1("const", "")
+	}
+	start := *p.token
+	doc := p.doc(start)
+	p.nextToken()
+	if p.token.Kind != T_ID {
+		p.Panic1("type", "const")
+	}
+	t := newType(p.token.Value)
+	p.nextToken()
+	if p.token.Kind != T_ID {
+		p.Panic1("const name", t.Name)
+	}
+	token := *p.token
+	p.nextToken()
+	if p.token.Kind != T_ASSIGN {
+		p.Panic1("=", token.Value)
+	}
+	p.nextToken()
+	c := &Const{
+		Name:  token.Value,
+		Type:  t,
+		Value: p.procLiteral(),
+		Doc:   doc,
+	}
+	p.endDecl(start, &c.Doc)
+	return c, token
+}
+
+// 非终结符TypedefStmt对应的过程，返回类型别名以及别名对应的token
+func (p *Parser) procTypedefStmt() (*Typedef, Token) {
+	// 产生式73
+	if p.token.Kind != T_TYPEDEF {
+		p.Panic1("typedef", "")
+	}
+	start := *p.token
+	doc := p.doc(start)
+	p.nextToken()
+	if p.token.Kind != T_ID {
+		p.Panic1("type", "typedef")
+	}
+	t := newType(p.token.Value)
+	p.nextToken()
+	if p.token.Kind != T_ID {
+		p.Panic1("type name", t.Name)
+	}
+	token := *p.token
+	p.nextToken()
+	def := &Typedef{
+		Name: token.Value,
+		Type: t,
+		Doc:  doc,
+	}
+	p.endDecl(start, &def.Doc)
+	return def, token
+}
+
+// 非终结符ErrorStmt对应的过程，返回error以及error名对应的token
+func (p *Parser) procErrorStmt() (*Error, Token) {
+	// 产生式75
+	if p.token.Kind != T_ERROR {
+		p.Panic1("error", "")
+	}
+	p.nextToken()
+	if p.token.Kind != T_ID {
+		p.Panic1("error name", "error")
+	}
+	token := *p.token
+	e := &Error{Message: &Message{Name: token.Value, Doc: p.doc(token)}}
+	p.nextToken()
+	if p.token.Kind != T_ASSIGN {
+		p.Panic1("=", token.Value)
+	}
+	p.nextToken()
+	if p.token.Kind != T_NUMBER {
+		p.Panic1("error code", "=")
+	}
+	code, err := strconv.ParseInt(p.token.Value, 10, 32)
+	if err != nil || code <= 0 {
+		p.logError(fmt.Sprintf("error code of \"%s\" must be a positive int32", e.Name), *p.token)
+	}
+	e.Code = int32(code)
+	p.nextToken()
+	p.procErrorBody(e.Message)
+	p.endDecl(token, &e.Doc)
+	return e, token
+}
+
+// 非终结符ErrorBody对应的过程，与message不同，error可以没有成员
+func (p *Parser) procErrorBody(msg *Message) {
+	switch p.token.Kind {
+	case T_LEFTBRACE:
+		// 产生式76
 		p.nextToken()
-		p.procStmt()
-		p.procExtra()
-	case T_EOF:
-		// 产生式4
-		return
+		outer := p.outer
+		p.outer = msg
+		p.procMembers(msg)
+		if p.token.Kind != T_RIGHTBRACE {
+			p.Panic1(`}`, "")
+		}
+		p.outer = outer
+		p.nextToken()
+	default:
+		if !inFollowOfStmt(p.token.Kind) {
+			p.Panic1("{", msg.Name)
+		}
+		// 产生式77
+	}
+}
+
+// 非终结符Literal对应的过程
+func (p *Parser) procLiteral() *Literal {
+	literal := &Literal{Value: p.token.Value}
+	switch p.token.Kind {
+	case T_NUMBER:
+		// 产生式54
+		literal.Kind = LiteralInt
+	case T_FLOAT:
+		// 产生式55
+		literal.Kind = LiteralFloat
+	case T_STRING:
+		// 产生式56
+		literal.Kind = LiteralString
+	case T_ID:
+		// 产生式57
+		literal.Kind = LiteralIdent
+		if literal.Value == "true" || literal.Value == "false" {
+			literal.Kind = LiteralBool
+		}
 	default:
-		p.Panic1(`\n`, "}")
+		p.Panic1("literal", "=")
 	}
+	p.nextToken()
+	return literal
+}
+
+// 非终结符PkgName对应的过程
+func (p *Parser) procPkgName() string {
+	if p.token.Kind != T_DOT {
+		if !inFollowOfStmt(p.token.Kind) {
+			p.Panic1(". or ;", "")
+		}
+		// 产生式37
+		return ""
+	}
+	// 产生式36
+	p.nextToken()
+	if p.token.Kind != T_ID {
+		p.Panic1("package name", ".")
+	}
+	name := "." + p.token.Value
+	p.nextToken()
+	return name + p.procPkgName()
 }
 
 // 非终结符MsgStmt对应的过程
@@ -148,43 +572,111 @@ func (p *Parser) procMsgStmt() (*Message, Token) {
 	var token Token
 	// 产生式7
 	if p.token.Kind != T_MESSAGE {
-		p.Panic1(`\n`, "")
+		p.Panic1("message", "")
 	}
 	p.nextToken()
 	if p.token.Kind != T_ID {
 		p.Panic1("message name", "message")
 	}
-	msg := &Message{Name: p.token.Value}
+	msg := &Message{Name: p.token.Value, Doc: p.doc(*p.token), Parent: p.outer}
+	if p.outer != nil {
+		// 嵌套的message以外层message名为前缀，如Response_Item
+		msg.Name = p.outer.Name + "_" + msg.Name
+	}
 	token = *p.token
 	tmp1 := *p.token
-	p.tmpToken = &tmp1 // 暂存此token，方便后面的错误处理
 	p.nextToken()
+	msg.TypeParams = p.procTypeParams()
+	if len(msg.TypeParams) != 0 && p.outer != nil {
+		p.logError(fmt.Sprintf("nested message \"%s\" can not be generic", tmp1.Value), tmp1)
+	}
+	if p.outer != nil && len(p.outer.TypeParams) != 0 {
+		p.logError(fmt.Sprintf("generic message \"%s\" can not have nested message", p.outer.Name), tmp1)
+	}
 	if p.token.Kind != T_LEFTBRACE {
-		p.Panic2("{", msg.Name, tmp1)
+		p.Panic2("{", tmp1.Value, tmp1)
 	}
-	tmp2 := *p.token
+	outer := p.outer
+	p.outer = msg
 	p.nextToken()
-	if p.token.Kind != T_CRLF {
-		if p.token.Kind == T_RIGHTBRACE {
-			p.logError(fmt.Sprintf("message \"%s\" should have at least one member", tmp1.Value), tmp1)
-		}
-		p.Panic2(`\n`, "{", tmp2)
+	p.procMembers(msg)
+	if p.token.Kind != T_RIGHTBRACE {
+		p.Panic1(`}`, "")
 	}
+	p.outer = outer
 	p.nextToken()
-	member := p.procMember()
-	msg.Mems = append(msg.Mems, member)
-	if p.token.Kind != T_CRLF {
-		p.Panic1(`\n`, member.Name)
+	p.endDecl(token, &msg.Doc)
+
+	return msg, token
+}
+
+// 非终结符Field对应的过程，将成员或oneof加入msg
+func (p *Parser) procField(msg *Message) {
+	switch p.token.Kind {
+	case T_ONEOF:
+		// 产生式64
+		oneof := p.procOneofStmt()
+		msg.Oneofs = append(msg.Oneofs, oneof)
+		p.procSep()
+	case T_MESSAGE:
+		// 产生式69
+		nested, token := p.procMsgStmt()
+		p.saveMessage(nested, token)
+		p.procSep()
+	case T_RESERVED:
+		// 产生式94
+		p.procReservedStmt(msg)
+	default:
+		// 产生式65
+		mem := p.procMember()
+		msg.Mems = append(msg.Mems, mem)
+		p.procSep()
+	}
+}
+
+// 非终结符OneofStmt对应的过程
+func (p *Parser) procOneofStmt() *Oneof {
+	// 产生式66
+	p.nextToken()
+	if p.token.Kind != T_ID {
+		p.Panic1("oneof name", "oneof")
 	}
+	start := *p.token
+	oneof := &Oneof{Name: start.Value, Doc: p.doc(start)}
 	p.nextToken()
-	mems := p.procMembers()
-	msg.Mems = append(msg.Mems, mems...)
+	if p.token.Kind != T_LEFTBRACE {
+		p.Panic1("{", oneof.Name)
+	}
+	p.nextToken()
+	if p.token.Kind == T_RIGHTBRACE {
+		p.logError(fmt.Sprintf("oneof \"%s\" should have at least one member", oneof.Name), *p.token)
+	}
+	mem := p.procMember()
+	oneof.Mems = append(oneof.Mems, mem)
+	p.procSep()
+	p.procVariants(oneof)
 	if p.token.Kind != T_RIGHTBRACE {
-		p.Panic1(`}`, "")
+		p.Panic1("}", "")
 	}
 	p.nextToken()
+	p.endDecl(start, &oneof.Doc)
+	return oneof
+}
 
-	return msg, token
+// 非终结符Variants对应的过程
+func (p *Parser) procVariants(oneof *Oneof) {
+	switch p.token.Kind {
+	case T_ID, T_LIST, T_MAP, T_OPTIONAL, T_AT:
+		// 产生式67
+		mem := p.procMember()
+		oneof.Mems = append(oneof.Mems, mem)
+		p.procSep()
+		p.procVariants(oneof)
+	case T_RIGHTBRACE:
+		// 产生式68
+	default:
+		p.Panic1("}", "")
+	}
 }
 
 // 非终结符ServiceStmt对应的过程
@@ -199,92 +691,279 @@ func (p *Parser) procServiceStmt() (*Service, Token) {
 		p.Panic1("service name", "service")
 	}
 	token = *p.token
-	p.tmpToken = &token
-	srv := &Service{Name: p.token.Value}
+	srv := &Service{Name: p.token.Value, Doc: p.doc(*p.token)}
 	p.nextToken()
+	srv.BaseNames = p.procExtends(srv.Name)
 	if p.token.Kind != T_LEFTBRACE {
 		p.Panic1("{", srv.Name)
 	}
 	p.nextToken()
-	if p.token.Kind != T_CRLF {
-		if p.token.Kind == T_RIGHTBRACE {
-			p.logError(fmt.Sprintf("service \"%s\" should have at least one method", token.Value), token)
+	srv.Methods = p.procFuncs()
+	if p.token.Kind != T_RIGHTBRACE {
+		p.Panic1("}", "")
+	}
+	for _, method := range srv.Methods {
+		method.Service = srv
+	}
+	p.nextToken()
+	p.endDecl(token, &srv.Doc)
+	return srv, token
+}
+
+// 非终结符Extends对应的过程，返回继承的服务名
+func (p *Parser) procExtends(name string) []string {
+	switch p.token.Kind {
+	case T_EXTENDS:
+		// 产生式60
+		p.nextToken()
+		if p.token.Kind != T_ID {
+			p.Panic1("service name", "extends")
 		}
-		p.Panic1(`\n`, "{")
+		base := p.token.Value
+		p.nextToken()
+		return append([]string{base}, p.procBases(base)...)
+	case T_LEFTBRACE:
+		// 产生式61
+		return nil
+	default:
+		p.Panic1("{", name)
+	}
+	return nil
+}
+
+// 非终结符Bases对应的过程
+func (p *Parser) procBases(last string) []string {
+	switch p.token.Kind {
+	case T_COMMA:
+		// 产生式62
+		p.nextToken()
+		if p.token.Kind != T_ID {
+			p.Panic1("service name", ",")
+		}
+		base := p.token.Value
+		p.nextToken()
+		return append([]string{base}, p.procBases(base)...)
+	case T_LEFTBRACE:
+		// 产生式63
+		return nil
+	default:
+		p.Panic1("{ or ,", last)
+	}
+	return nil
+}
+
+// 非终结符EnumStmt对应的过程
+func (p *Parser) procEnumStmt() (*Enum, Token) {
+	// 产生式24
+	if p.token.Kind != T_ENUM {
+		p.Panic1("enum", "")
 	}
 	p.nextToken()
-	method := p.procFunc()
-	srv.Methods = append(srv.Methods, method)
-	if p.token.Kind != T_CRLF {
-		p.Panic1(`\n`, ")")
+	if p.token.Kind != T_ID {
+		p.Panic1("enum name", "enum")
+	}
+	token := *p.token
+	p.tmpToken = &token
+	enum := &Enum{Name: p.token.Value}
+	p.nextToken()
+	if p.token.Kind != T_LEFTBRACE {
+		p.Panic1("{", enum.Name)
 	}
 	p.nextToken()
-	methods := p.procFuncs()
-	srv.Methods = append(srv.Methods, methods...)
+	if p.token.Kind == T_RIGHTBRACE {
+		p.logError(fmt.Sprintf("enum \"%s\" should have at least one member", token.Value), token)
+	}
+	mem := p.procEnumMember(0)
+	enum.Mems = append(enum.Mems, mem)
+	p.procSep()
+	enum.Mems = append(enum.Mems, p.procEnumMembers(mem.Value+1)...)
 	if p.token.Kind != T_RIGHTBRACE {
 		p.Panic1("}", "")
 	}
-	for _, method := range srv.Methods {
-		method.Service = srv
-	}
 	p.nextToken()
-	return srv, token
+	return enum, token
 }
 
-// 非终结符Members对应的过程
-func (p *Parser) procMembers() []*Member {
-	var members []*Member
+// 非终结符EnumMembers对应的过程，next为未指定值时成员的默认值
+func (p *Parser) procEnumMembers(next int32) []*EnumMember {
+	var mems []*EnumMember
 	switch p.token.Kind {
 	case T_ID:
-		// 产生式8
-		mem := p.procMember()
-		members = append(members, mem)
-		if p.token.Kind != T_CRLF {
-			p.Panic1(`\n`, mem.Name)
+		// 产生式25
+		mem := p.procEnumMember(next)
+		mems = append(mems, mem)
+		p.procSep()
+		mems = append(mems, p.procEnumMembers(mem.Value+1)...)
+	case T_RIGHTBRACE:
+		// 产生式26
+		return nil
+	default:
+		p.Panic1("}", "")
+	}
+	return mems
+}
+
+// 非终结符EnumMember对应的过程
+func (p *Parser) procEnumMember(next int32) *EnumMember {
+	// 产生式27
+	if p.token.Kind != T_ID {
+		p.logError(fmt.Sprintf("enum \"%s\" should have at least one member", p.tmpToken.Value), *p.tmpToken)
+	}
+	mem := &EnumMember{Name: p.token.Value, Value: next}
+	p.nextToken()
+	switch p.token.Kind {
+	case T_ASSIGN:
+		// 产生式28
+		p.nextToken()
+		if p.token.Kind != T_NUMBER {
+			p.Panic1("integer", "=")
+		}
+		v, err := strconv.ParseInt(p.token.Value, 10, 32)
+		if err != nil {
+			p.logError(fmt.Sprintf("enum value %s out of range of int32", p.token.Value), *p.token)
 		}
+		mem.Value = int32(v)
 		p.nextToken()
-		mems := p.procMembers()
-		members = append(members, mems...)
+	case T_SEMICOLON, T_COMMA, T_ID, T_RIGHTBRACE:
+		// 产生式29
+	default:
+		p.Panic1("= or }", mem.Name)
+	}
+	return mem
+}
+
+// 非终结符Members对应的过程
+func (p *Parser) procMembers(msg *Message) {
+	switch p.token.Kind {
+	case T_ID, T_LIST, T_MAP, T_OPTIONAL, T_AT, T_ONEOF, T_MESSAGE, T_RESERVED:
+		// 产生式8
+		p.procField(msg)
+		p.procMembers(msg)
 	case T_RIGHTBRACE:
 		// 产生式9
-		return nil
 	default:
 		p.Panic1("}", "")
 	}
-	return members
 }
 
 // 非终结符Member对应的过程
 func (p *Parser) procMember() *Member {
+	var annos Annotations
+	var doc []string
+	if p.token.Kind == T_AT {
+		// 产生式50
+		annos, doc = p.procAnnotations()
+		if !inFirstOfType(p.token.Kind) && p.token.Kind != T_OPTIONAL {
+			p.Panic1("member", "")
+		}
+	}
 	// 产生式10
-	if p.token.Kind != T_ID {
-		p.logError(fmt.Sprintf("message \"%s\" should have at least one member", p.tmpToken.Value), *p.tmpToken)
+	if !inFirstOfType(p.token.Kind) && p.token.Kind != T_OPTIONAL {
+		p.Panic1("member", "")
 	}
-	t := newType(p.token.Value)
-	p.nextToken()
+	start := *p.token
+	doc = append(doc, p.doc(start)...)
+	optional := p.procOptional()
+	t := p.procType()
 	if p.token.Kind != T_ID {
 		p.Panic1("member name", t.Name)
 	}
 	name := p.token.Value
 	p.nextToken()
-	return &Member{
-		Type: t,
-		Name: name,
+	mem := &Member{
+		Type:     t,
+		Name:     name,
+		Optional: optional,
+		Default:  p.procMemberValue(),
+		Doc:      doc,
+		Annos:    annos,
+	}
+	mem.Constraints = p.procConstraints()
+	p.endDecl(start, &mem.Doc)
+	return mem
+}
+
+// 成员编号必须为正的int32
+func (p *Parser) parseTag(token Token) int32 {
+	tag, err := strconv.ParseInt(token.Value, 10, 32)
+	if err != nil || tag <= 0 {
+		p.logError(fmt.Sprintf("member tag must be a positive int32, but got %s", token.Value), token)
+	}
+	return int32(tag)
+}
+
+// 非终结符ReservedStmt对应的过程，记录msg中废弃的成员编号和成员名
+func (p *Parser) procReservedStmt(msg *Message) {
+	// 产生式95
+	p.nextToken()
+	p.procReservedItem(msg, "reserved")
+	p.procMoreReserved(msg)
+}
+
+// 非终结符ReservedItem对应的过程
+func (p *Parser) procReservedItem(msg *Message, after string) {
+	switch p.token.Kind {
+	case T_NUMBER:
+		// 产生式96
+		msg.ReservedTags = append(msg.ReservedTags, p.parseTag(*p.token))
+	case T_STRING:
+		// 产生式97
+		msg.ReservedNames = append(msg.ReservedNames, p.token.Value)
+	default:
+		p.Panic1("tag or name", after)
+	}
+	p.nextToken()
+}
+
+// 非终结符MoreReserved对应的过程，逗号总是属于reserved列表，以分号结束
+func (p *Parser) procMoreReserved(msg *Message) {
+	switch p.token.Kind {
+	case T_COMMA:
+		// 产生式98
+		p.nextToken()
+		p.procReservedItem(msg, ",")
+		p.procMoreReserved(msg)
+	case T_SEMICOLON:
+		// 产生式49
+		p.nextToken()
+	default:
+		// 产生式99
+	}
+}
+
+// 非终结符MemberValue对应的过程，返回成员的默认值
+func (p *Parser) procMemberValue() *Literal {
+	if p.token.Kind != T_ASSIGN {
+		// 产生式59
+		return nil
 	}
+	// 产生式58
+	p.nextToken()
+	return p.procLiteral()
+}
+
+// 非终结符Optional对应的过程
+func (p *Parser) procOptional() bool {
+	if p.token.Kind == T_OPTIONAL {
+		// 产生式30
+		p.nextToken()
+		if !inFirstOfType(p.token.Kind) {
+			p.Panic1("type", "optional")
+		}
+		return true
+	}
+	// 产生式31
+	return false
 }
 
 // 非终结符Funcs对应的过程
 func (p *Parser) procFuncs() []*Method {
 	var methods []*Method
 	switch p.token.Kind {
-	case T_ID:
+	case T_ID, T_LIST, T_MAP, T_AT:
 		// 产生式12
 		method := p.procFunc()
 		methods = append(methods, method)
-		if p.token.Kind != T_CRLF {
-			p.Panic1(`\n`, ")")
-		}
-		p.nextToken()
 		ms := p.procFuncs()
 		methods = append(methods, ms...)
 	case T_RIGHTBRACE:
@@ -299,12 +978,17 @@ func (p *Parser) procFuncs() []*Method {
 // 非终结符Func对应的过程
 func (p *Parser) procFunc() *Method {
 	method := new(Method)
-	// 产生式14
-	if p.token.Kind != T_ID {
-		p.logError(fmt.Sprintf("service \"%s\" should have at least one method", p.tmpToken.Value), *p.tmpToken)
+	if p.token.Kind == T_AT {
+		// 产生式51
+		method.Annos, method.Doc = p.procAnnotations()
+		if !inFirstOfType(p.token.Kind) {
+			p.Panic1("method", "")
+		}
 	}
-	method.RetType = newType(p.token.Value)
-	p.nextToken()
+	// 产生式14
+	start := *p.token
+	method.Doc = append(method.Doc, p.doc(start)...)
+	method.RetType = p.procType()
 	if p.token.Kind != T_ID {
 		p.Panic1("function name", method.RetType.Name)
 	}
@@ -314,71 +998,477 @@ func (p *Parser) procFunc() *Method {
 		p.Panic1("(", method.Name)
 	}
 	p.nextToken()
-	method.ReqTypes = p.procArgList()
+	method.ReqTypes, method.ReqNames, method.ReqConstraints = p.procArgList()
 	if p.token.Kind != T_RIGHTBRACKET {
 		p.Panic1(")", method.ReqTypes[len(method.ReqTypes)-1].Name)
 	}
 	p.nextToken()
+	p.procOptions(method)
+	method.ThrowNames = p.procThrows()
+	p.endDecl(start, &method.Doc)
 	return method
 }
 
-// 非终结符ArgList对应的过程
-func (p *Parser) procArgList() []*Type {
+// 非终结符Options对应的过程，记录方法的修饰符
+func (p *Parser) procOptions(method *Method) {
+	if !p.isOption() {
+		// 产生式88
+		return
+	}
+	// 产生式87
+	p.procOption(method, make(map[string]struct{}))
+}
+
+// 非终结符Option对应的过程，m为已经出现的修饰符
+func (p *Parser) procOption(method *Method, m map[string]struct{}) {
+	// 产生式89
+	token := *p.token
+	if _, ok := m[token.Value]; ok {
+		p.logError(fmt.Sprintf("repeated option \"%s\" of method \"%s\"", token.Value, method.Name), token)
+	}
+	m[token.Value] = struct{}{}
+	p.nextToken()
+	switch token.Value {
+	case "oneway":
+		method.Oneway = true
+	case "idempotent":
+		method.Idempotent = true
+	case "timeout":
+		method.timeout = p.procOptionValue(token.Value)
+	default:
+		p.logError(fmt.Sprintf("unknown option \"%s\" of method \"%s\"", token.Value, method.Name), token)
+	}
+	if token.Value != "timeout" && p.token.Kind == T_ASSIGN {
+		p.logError(fmt.Sprintf("option \"%s\" of method \"%s\" takes no value", token.Value, method.Name), *p.token)
+	}
+	if p.isOption() {
+		p.procOption(method, m)
+	}
+}
+
+// 非终结符OptionValue对应的过程，返回timeout的值
+func (p *Parser) procOptionValue(name string) time.Duration {
+	if p.token.Kind != T_ASSIGN {
+		p.Panic1("=", name)
+	}
+	// 产生式90
+	p.nextToken()
+	if p.token.Kind != T_DURATION {
+		p.Panic1("duration", "=")
+	}
+	d, err := time.ParseDuration(p.token.Value)
+	if err != nil || d <= 0 {
+		p.logError(fmt.Sprintf("invalid duration %s", p.token.Value), *p.token)
+	}
+	p.nextToken()
+	return d
+}
+
+// 非终结符Throws对应的过程，返回声明的error名
+func (p *Parser) procThrows() []string {
 	switch p.token.Kind {
-	case T_ID:
+	case T_THROWS:
+		// 产生式78
+		p.nextToken()
+		if p.token.Kind != T_ID {
+			p.Panic1("error name", "throws")
+		}
+		name := p.token.Value
+		p.nextToken()
+		return append([]string{name}, p.procErrors(name)...)
+	default:
+		// 产生式79
+		p.procSep()
+		return nil
+	}
+}
+
+// 非终结符Errors对应的过程，逗号总是属于error列表，以分号结束
+func (p *Parser) procErrors(last string) []string {
+	switch p.token.Kind {
+	case T_COMMA:
+		// 产生式80
+		p.nextToken()
+		if p.token.Kind != T_ID {
+			p.Panic1("error name", ",")
+		}
+		name := p.token.Value
+		p.nextToken()
+		return append([]string{name}, p.procErrors(name)...)
+	case T_SEMICOLON:
+		// 产生式108
+		p.nextToken()
+		return nil
+	default:
+		// 产生式81
+		return nil
+	}
+}
+
+// 非终结符ArgList对应的过程，返回参数类型、参数名以及参数的校验约束
+func (p *Parser) procArgList() ([]*Type, []string, []Constraints) {
+	switch p.token.Kind {
+	case T_ID, T_LIST, T_MAP:
 		// 产生式15
 		return p.procArgs()
 	case T_RIGHTBRACKET:
 		// 产生式16
-		return nil
+		return nil, nil, nil
 	default:
 		p.Panic1("type or )", "(")
 	}
-	return nil
+	return nil, nil, nil
 }
 
 // 非终结符Args对应的过程
-func (p *Parser) procArgs() []*Type {
-	var args []*Type
+func (p *Parser) procArgs() ([]*Type, []string, []Constraints) {
 	// 产生式17
-	if p.token.Kind != T_ID {
+	if !inFirstOfType(p.token.Kind) {
 		p.Panic1("type", "(")
 	}
-	args = append(args, newType(p.token.Value))
-
-	p.nextToken()
-	args = append(args, p.procArgs_()...)
-	return args
+	t := p.procType()
+	name := p.procArgName()
+	cs := p.procConstraints()
+	types, names, css := p.procArgs_()
+	return append([]*Type{t}, types...), append([]string{name}, names...), append([]Constraints{cs}, css...)
 }
 
 // 非终结符Args_对应的过程
-func (p *Parser) procArgs_() []*Type {
-	var args []*Type
+func (p *Parser) procArgs_() ([]*Type, []string, []Constraints) {
 	switch p.token.Kind {
 	case T_COMMA:
 		// 产生式18
 		p.nextToken()
-		if p.token.Kind != T_ID {
+		if !inFirstOfType(p.token.Kind) {
 			p.Panic1("type", ",")
 		}
-		args = append(args, newType(p.token.Value))
-		p.nextToken()
-		args = append(args, p.procArgs_()...)
+		t := p.procType()
+		name := p.procArgName()
+		cs := p.procConstraints()
+		types, names, css := p.procArgs_()
+		return append([]*Type{t}, types...), append([]string{name}, names...), append([]Constraints{cs}, css...)
 	case T_RIGHTBRACKET:
 		// 产生式19
-		return nil
+		return nil, nil, nil
 	default:
 		p.Panic1(", or )", "")
 	}
+	return nil, nil, nil
+}
+
+// 非终结符ArgName对应的过程，未命名的参数返回空串
+func (p *Parser) procArgName() string {
+	switch p.token.Kind {
+	case T_ID:
+		// 产生式38
+		name := p.token.Value
+		p.nextToken()
+		return name
+	case T_COMMA, T_RIGHTBRACKET, T_LEFTSQUARE:
+		// 产生式39
+		return ""
+	default:
+		p.Panic1("parameter name, '[', ',' or ')'", "")
+	}
+	return ""
+}
+
+// 非终结符Constraints对应的过程
+func (p *Parser) procConstraints() Constraints {
+	if p.token.Kind != T_LEFTSQUARE {
+		// 产生式83
+		return nil
+	}
+	// 产生式82
+	p.nextToken()
+	c := p.procConstraint("[")
+	cs := append(Constraints{c}, p.procMoreConstraints(c.Value.Value)...)
+	if p.token.Kind != T_RIGHTSQUARE {
+		p.Panic1("]", cs[len(cs)-1].Value.Value)
+	}
+	p.nextToken()
+	return cs
+}
+
+// 非终结符Constraint对应的过程
+func (p *Parser) procConstraint(after string) *Constraint {
+	// 产生式84
+	if p.token.Kind != T_ID {
+		p.Panic1("constraint name", after)
+	}
+	c := &Constraint{Name: p.token.Value}
+	p.nextToken()
+	if p.token.Kind != T_ASSIGN {
+		p.Panic1("=", c.Name)
+	}
+	p.nextToken()
+	c.Value = p.procLiteral()
+	return c
+}
+
+// 非终结符MoreConstraints对应的过程
+func (p *Parser) procMoreConstraints(last string) Constraints {
+	switch p.token.Kind {
+	case T_COMMA:
+		// 产生式85
+		p.nextToken()
+		c := p.procConstraint(",")
+		return append(Constraints{c}, p.procMoreConstraints(c.Value.Value)...)
+	case T_RIGHTSQUARE:
+		// 产生式86
+		return nil
+	default:
+		p.Panic1(", or ]", last)
+	}
+	return nil
+}
+
+// 非终结符Type对应的过程
+func (p *Parser) procType() *Type {
+	switch p.token.Kind {
+	case T_LIST:
+		// 产生式20
+		p.nextToken()
+		return newListType(p.procType())
+	case T_MAP:
+		// 产生式22
+		p.nextToken()
+		if p.token.Kind != T_LEFTANGLE {
+			p.Panic1("<", "map")
+		}
+		p.nextToken()
+		key := p.procType()
+		if p.token.Kind != T_COMMA {
+			p.Panic1(",", key.Name)
+		}
+		p.nextToken()
+		value := p.procType()
+		if p.token.Kind != T_RIGHTANGLE {
+			p.Panic1(">", value.Name)
+		}
+		p.nextToken()
+		return newMapType(key, value)
+	case T_ID:
+		// 产生式21
+		name := p.token.Value
+		p.nextToken()
+		name += p.procTypeName(name)
+		token := *p.token
+		args := p.procTypeArg(name)
+		var t *Type
+		switch {
+		case args == nil:
+			t = newType(name)
+		case name != "stream":
+			t = newGenericType(name, args)
+		case len(args) != 1:
+			p.logError("stream can only have one type argument", token)
+		default:
+			t = newStreamType(args[0])
+		}
+		return p.procFixedLen(t)
+	default:
+		p.Panic1("type", "")
+	}
+	return nil
+}
+
+// 非终结符TypeName对应的过程，返回嵌套message的后续名称，如Response.Item中的.Item
+func (p *Parser) procTypeName(last string) string {
+	if p.token.Kind != T_DOT {
+		// 产生式71
+		return ""
+	}
+	// 产生式70
+	p.nextToken()
+	if p.token.Kind != T_ID {
+		p.Panic1("message name", last+".")
+	}
+	name := p.token.Value
+	p.nextToken()
+	return "." + name + p.procTypeName(name)
+}
+
+// 非终结符TypeArg对应的过程，返回stream<Msg>中的元素类型或者泛型message的类型实参，
+// 内置类型中只有stream可以带类型参数
+func (p *Parser) procTypeArg(name string) []*Type {
+	if p.token.Kind != T_LEFTANGLE {
+		// 产生式93
+		return nil
+	}
+	// 产生式92
+	if name != "stream" && isBuiltin(name) {
+		p.logError(fmt.Sprintf("type \"%s\" can not have type argument", name), *p.token)
+	}
+	p.nextToken()
+	args := []*Type{p.procType()}
+	args = p.procMoreTypeArgs(args)
+	if p.token.Kind != T_RIGHTANGLE {
+		p.Panic1(">", args[len(args)-1].Name)
+	}
+	p.nextToken()
 	return args
 }
 
+// 非终结符FixedLen对应的过程，类型后紧跟[N]时返回以t为元素的定长数组
+func (p *Parser) procFixedLen(t *Type) *Type {
+	if p.token.Kind != T_ARRAYLEN {
+		// 产生式107
+		return t
+	}
+	// 产生式106
+	n, err := strconv.ParseInt(p.token.Value, 10, 32)
+	if err != nil || n <= 0 {
+		p.logError(fmt.Sprintf("array length must be a positive int32, but got %s", p.token.Value), *p.token)
+	}
+	p.nextToken()
+	return newArrayType(t, int(n))
+}
+
+// 非终结符MoreTypeArgs对应的过程
+func (p *Parser) procMoreTypeArgs(args []*Type) []*Type {
+	if p.token.Kind != T_COMMA {
+		// 产生式101
+		return args
+	}
+	// 产生式100
+	p.nextToken()
+	args = append(args, p.procType())
+	return p.procMoreTypeArgs(args)
+}
+
+// 非终结符TypeParams对应的过程，返回泛型message的类型形参，如Page<T>中的T
+func (p *Parser) procTypeParams() []string {
+	if p.token.Kind != T_LEFTANGLE {
+		// 产生式103
+		return nil
+	}
+	// 产生式102
+	p.nextToken()
+	if p.token.Kind != T_ID {
+		p.Panic1("type parameter", "<")
+	}
+	params := []string{p.token.Value}
+	p.nextToken()
+	params = p.procMoreTypeParams(params)
+	if p.token.Kind != T_RIGHTANGLE {
+		p.Panic1(">", params[len(params)-1])
+	}
+	p.nextToken()
+	return params
+}
+
+// 非终结符MoreTypeParams对应的过程
+func (p *Parser) procMoreTypeParams(params []string) []string {
+	if p.token.Kind != T_COMMA {
+		// 产生式105
+		return params
+	}
+	// 产生式104
+	p.nextToken()
+	if p.token.Kind != T_ID {
+		p.Panic1("type parameter", ",")
+	}
+	params = append(params, p.token.Value)
+	p.nextToken()
+	return p.procMoreTypeParams(params)
+}
+
+// 方法参数列表之后的id是否为修饰符，id之后为.、<、[N]或者id (时为下一个方法的返回类型
+func (p *Parser) isOption() bool {
+	if p.token.Kind != T_ID {
+		return false
+	}
+	switch p.peekToken(1).Kind {
+	case T_DOT, T_LEFTANGLE, T_ARRAYLEN:
+		return false
+	case T_ID:
+		return p.peekToken(2).Kind != T_LEFTBRACKET
+	}
+	return true
+}
+
+// 向前查看之后的第n个token，不改变词法解析器的状态
+func (p *Parser) peekToken(n int) Token {
+	saved := *p.lexer
+	for i := 0; i < n; i++ {
+		p.lexer.getNextToken()
+	}
+	token := p.lexer.curToken
+	*p.lexer = saved
+	return token
+}
+
+// token是否属于FIRST(Type)
+func inFirstOfType(kind int) bool {
+	return kind == T_ID || kind == T_LIST || kind == T_MAP
+}
+
+// token是否属于FIRST(Stmt)
+func inFirstOfStmt(kind int) bool {
+	switch kind {
+	case T_MESSAGE, T_SERVICE, T_ENUM, T_IMPORT, T_PACKAGE, T_CONST, T_TYPEDEF, T_ERROR, T_AT:
+		return true
+	}
+	return false
+}
+
+// token是否属于FOLLOW(Stmt)
+func inFollowOfStmt(kind int) bool {
+	return kind == T_SEMICOLON || kind == T_COMMA || kind == T_EOF || inFirstOfStmt(kind)
+}
+
+// 一行代码中的声明
+type lineDecls struct {
+	started   bool      // 是否已有声明在该行开始
+	annotated bool      // 该行是否为独占一行的注解，其注释属于被修饰的对象
+	first     *[]string // 在该行开始的第一个声明的注释
+	firstKth  int
+	last      *[]string // 最后一个在该行开始并结束的声明的注释
+}
+
+// 声明所在行之上的注释，同一行有多个声明时只属于第一个
+func (p *Parser) doc(token Token) []string {
+	d := &p.decls[token.Line]
+	if d.started {
+		return nil
+	}
+	d.started = true
+	return p.lexer.docs[token.Line]
+}
+
+// 声明解析完毕时记录其注释，start为声明开始的token
+func (p *Parser) endDecl(start Token, doc *[]string) {
+	d := &p.decls[start.Line]
+	if d.first == nil || start.Kth < d.firstKth {
+		d.first, d.firstKth = doc, start.Kth
+	}
+	if p.lexer.prevLine == start.Line {
+		d.last = doc
+	}
+}
+
+// 行尾注释属于最后一个在该行开始并结束的声明，如message P { int32 X; int32 Y } // 注释
+// 属于P而不属于X、Y；没有这样的声明时属于在该行开始的第一个声明，如message P { // 注释
+func (p *Parser) attachComments() {
+	for line, comment := range p.lexer.comments {
+		d := p.decls[line]
+		target := d.last
+		if target == nil {
+			target = d.first
+		}
+		if len(comment) != 0 && target != nil && !d.annotated {
+			*target = append(*target, comment...)
+		}
+	}
+}
+
 func (p *Parser) logError(msg string, token Token) {
 	fmt.Printf("%s:\n", msg)
 	line := p.lexer.lines[token.Line]
 	lineNum := p.lexer.locationMap[token.Line] + 1
 	filepath := path.Base(p.filepath)
-	if token.Kind == T_CRLF {
+	if token.Kind == T_EOF {
 		fmt.Printf("[%s:%d] %s\n", filepath, lineNum, line)
 	} else {
 		fmt.Printf("[%s:%d:%d] %s", filepath, lineNum, token.Kth, line[:token.Kth])
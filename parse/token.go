@@ -9,8 +9,33 @@ const (
 	T_LEFTBRACKET         // (
 	T_RIGHTBRACKET        // )
 	T_SERVICE             // service
-	T_CRLF                // \n or \r\n
 	T_COMMA               // ,
+	T_LEFTSQUARE          // [
+	T_RIGHTSQUARE         // ]
+	T_LEFTANGLE           // <
+	T_RIGHTANGLE          // >
+	T_MAP                 // map
+	T_ENUM                // enum
+	T_ASSIGN              // =
+	T_NUMBER              // 整数
+	T_OPTIONAL            // optional
+	T_IMPORT              // import
+	T_STRING              // 双引号包围的字符串
+	T_PACKAGE             // package
+	T_DOT                 // .
+	T_AT                  // @
+	T_DURATION            // 带单位的时间间隔，如500ms
+	T_CONST               // const
+	T_FLOAT               // 小数
+	T_EXTENDS             // extends
+	T_ONEOF               // oneof
+	T_TYPEDEF             // typedef
+	T_ERROR               // error
+	T_THROWS              // throws
+	T_RESERVED            // reserved
+	T_ARRAYLEN            // [16]，定长数组的长度，与list的[]以及校验约束的[区分
+	T_SEMICOLON           // ;
+	T_LIST                // []，list类型的前缀，与校验约束的[区分
 	T_EOF
 )
 
@@ -24,8 +49,8 @@ type Token struct {
 
 // 获取token的原字符串
 func (t *Token) content(l *lexer) string {
-	if t.Kind == T_CRLF {
-		return "\\n"
+	if t.Kind == T_EOF {
+		return "EOF"
 	}
 	return l.lines[t.Line][t.Kth : t.Kth+t.Length]
 }